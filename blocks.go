@@ -0,0 +1,587 @@
+package coalition
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Domain separation prefix for the provider keys of files
+var blockProviderDomain = []byte("coalition-block")
+
+// Block types, raw blocks hold file data and node blocks link to other blocks
+const (
+	blockTypeRaw byte = iota
+	blockTypeNode
+)
+
+// Block fetch response statuses
+const (
+	blockFound byte = iota
+	blockNotFound
+)
+
+// Stores blocks by their cid, the hex encoded sha256 hash of the block
+type BlockStore interface {
+	Has(cid string) bool
+	Get(cid string) ([]byte, error)
+	Put(cid string, block []byte) error
+	Delete(cid string) error
+}
+
+// A block store held in memory
+type MemoryBlockStore struct {
+	mutex  sync.RWMutex
+	blocks map[string][]byte
+}
+
+func (store *MemoryBlockStore) Has(cid string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	_, exists := store.blocks[cid]
+	return exists
+}
+
+func (store *MemoryBlockStore) Get(cid string) ([]byte, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	block, exists := store.blocks[cid]
+	if !exists {
+		return nil, fmt.Errorf("block %s not found", cid)
+	}
+	return block, nil
+}
+
+func (store *MemoryBlockStore) Put(cid string, block []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.blocks[cid] = block
+	return nil
+}
+
+func (store *MemoryBlockStore) Delete(cid string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.blocks, cid)
+	return nil
+}
+
+func NewMemoryBlockStore() *MemoryBlockStore {
+	return &MemoryBlockStore{blocks: make(map[string][]byte)}
+}
+
+// A block store keeping a file per block in a directory.
+// Blocks survive restarts so interrupted downloads resume where they stopped.
+type FileBlockStore struct {
+	dir string
+}
+
+// Returns the path of a block's file, cids are validated so they can't escape the directory
+func (store *FileBlockStore) path(cid string) (string, error) {
+	if !isCID(cid) {
+		return "", fmt.Errorf("invalid cid %s", cid)
+	}
+	return filepath.Join(store.dir, cid), nil
+}
+
+func (store *FileBlockStore) Has(cid string) bool {
+	path, err := store.path(cid)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func (store *FileBlockStore) Get(cid string) ([]byte, error) {
+	path, err := store.path(cid)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// Blocks are written to a temporary file and renamed so partial blocks are never stored
+func (store *FileBlockStore) Put(cid string, block []byte) error {
+	path, err := store.path(cid)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(store.dir, cid+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(block); err != nil {
+		file.Close()
+		return err
+	} else if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (store *FileBlockStore) Delete(cid string) error {
+	path, err := store.path(cid)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Create a file block store in the directory, creating the directory if needed
+func NewFileBlockStore(dir string) (*FileBlockStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileBlockStore{dir}, nil
+}
+
+// Returns the cid of a block
+func BlockCID(block []byte) string {
+	hash := sha256.Sum256(block)
+	return hex.EncodeToString(hash[:])
+}
+
+// Returns true if the string is a valid cid
+func isCID(cid string) bool {
+	decoded, err := hex.DecodeString(cid)
+	return err == nil && len(decoded) == sha256.Size && hex.EncodeToString(decoded) == cid
+}
+
+// Returns the DHT key the providers of a file's root provide
+func BlockProviderKey(root string) []byte {
+	key := sha1.Sum(append(append([]byte{}, blockProviderDomain...), []byte(root)...))
+	return key[:]
+}
+
+// A link from a node to a block with the size of the file data under it
+type dagLink struct {
+	CID  string `json:"cid"`
+	Size uint64 `json:"size"`
+}
+
+// A node of a file's merkle DAG, linking to raw blocks or further nodes in file order
+type dagNode struct {
+	Links []dagLink `json:"links"`
+	Size  uint64    `json:"size"`
+}
+
+// Parse a node block
+func parseDAGNode(block []byte) (*dagNode, error) {
+	if len(block) == 0 || block[0] != blockTypeNode {
+		return nil, fmt.Errorf("expected a node block")
+	}
+	var node dagNode
+	if err := json.Unmarshal(block[1:], &node); err != nil {
+		return nil, err
+	} else if len(node.Links) > MaxBlockLinks {
+		return nil, fmt.Errorf("node has too many links")
+	}
+	// Links must carry data and sizes are bounded so sums can't wrap
+	var size uint64
+	for _, link := range node.Links {
+		if !isCID(link.CID) {
+			return nil, fmt.Errorf("invalid cid %s", link.CID)
+		} else if link.Size == 0 {
+			return nil, fmt.Errorf("node links to an empty block")
+		} else if link.Size > MaxFileSize-size {
+			return nil, fmt.Errorf("node exceeds max file size")
+		}
+		size += link.Size
+	}
+	if size != node.Size {
+		return nil, fmt.Errorf("node size doesn't match it's links")
+	}
+	return &node, nil
+}
+
+// Store a block and return it's cid
+func (host *Host) putBlock(block []byte) (string, error) {
+	cid := BlockCID(block)
+	if err := host.blocks.Put(cid, block); err != nil {
+		return "", err
+	}
+	return cid, nil
+}
+
+// Get a stored block, verified against it's cid
+func (host *Host) getBlock(cid string) ([]byte, error) {
+	block, err := host.blocks.Get(cid)
+	if err != nil {
+		return nil, err
+	} else if BlockCID(block) != cid {
+		return nil, fmt.Errorf("block %s is corrupted", cid)
+	}
+	return block, nil
+}
+
+// Chunk the data into raw blocks linked together by a merkle DAG of at most maxLinks links per node.
+// Returns the cid of the DAG's root.
+func (host *Host) addFile(reader io.Reader, maxLinks int) (string, error) {
+	links := make([]dagLink, 0)
+	chunk := make([]byte, BlockSize)
+	size := uint64(0)
+	for {
+		n, err := io.ReadFull(reader, chunk)
+		if size += uint64(n); size > MaxFileSize {
+			return "", fmt.Errorf("file exceeds max size of %d bytes", MaxFileSize)
+		}
+		if n > 0 {
+			block := append([]byte{blockTypeRaw}, chunk[:n]...)
+			cid, err := host.putBlock(block)
+			if err != nil {
+				return "", err
+			}
+			links = append(links, dagLink{cid, uint64(n)})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	// Link the blocks level by level until a single root node is left
+	for {
+		nodes := make([]dagLink, 0)
+		for start := 0; start < len(links) || start == 0; start += maxLinks {
+			end := start + maxLinks
+			if end > len(links) {
+				end = len(links)
+			}
+			node := dagNode{Links: links[start:end]}
+			for _, link := range node.Links {
+				node.Size += link.Size
+			}
+			serialized, err := json.Marshal(&node)
+			if err != nil {
+				return "", err
+			}
+			cid, err := host.putBlock(append([]byte{blockTypeNode}, serialized...))
+			if err != nil {
+				return "", err
+			}
+			nodes = append(nodes, dagLink{cid, node.Size})
+		}
+		if len(nodes) == 1 {
+			return nodes[0].CID, nil
+		}
+		links = nodes
+	}
+}
+
+// Store the data as content addressed blocks and announce the host as a provider of it.
+// Returns the cid of the file's root, which is all peers need to fetch it.
+func (host *Host) AddFile(reader io.Reader) (string, error) {
+	root, err := host.addFile(reader, MaxBlockLinks)
+	if err != nil {
+		return "", err
+	}
+	if err := host.Provide(BlockProviderKey(root)); err != nil {
+		return root, err
+	}
+	return root, nil
+}
+
+// Request a block on a block exchange stream, the block is verified against it's cid
+func requestBlock(stream *Stream, cid string) ([]byte, error) {
+	request, _ := hex.DecodeString(cid)
+	if _, err := stream.Write(request); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		return nil, err
+	} else if header[0] != blockFound {
+		return nil, errBlockNotFound
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > MaxBlockSize {
+		return nil, fmt.Errorf("block exceeds max size")
+	}
+	block := make([]byte, length)
+	if _, err := io.ReadFull(stream, block); err != nil {
+		return nil, err
+	} else if BlockCID(block) != cid {
+		return nil, errInvalidBlock
+	}
+	return block, nil
+}
+
+// Returned when a peer doesn't have a block or sends one that doesn't match it's cid
+var errBlockNotFound = fmt.Errorf("block not found")
+var errInvalidBlock = fmt.Errorf("block doesn't match it's cid")
+
+// Blocks waiting to be fetched, with the providers that failed to deliver each
+// and the number of blocks being fetched
+type blockFetchQueue struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	pending  []string
+	inFlight int
+	failed   map[string]map[string]bool
+}
+
+// Take the next block the provider hasn't failed to deliver.
+// While other providers are fetching blocks it waits as they may fail and put them back,
+// it only gives up once no blocks are left for the provider and none are in flight.
+func (queue *blockFetchQueue) next(provider string) (string, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	for {
+		for i, cid := range queue.pending {
+			if !queue.failed[cid][provider] {
+				queue.pending = append(queue.pending[:i], queue.pending[i+1:]...)
+				queue.inFlight++
+				return cid, true
+			}
+		}
+		if queue.inFlight == 0 {
+			return "", false
+		}
+		queue.cond.Wait()
+	}
+}
+
+// Mark a block taken from the queue as fetched
+func (queue *blockFetchQueue) done() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.inFlight--
+	queue.cond.Broadcast()
+}
+
+// Put a block the provider failed to deliver back for other providers
+func (queue *blockFetchQueue) retry(cid, provider string) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if queue.failed[cid] == nil {
+		queue.failed[cid] = make(map[string]bool)
+	}
+	queue.failed[cid][provider] = true
+	queue.pending = append(queue.pending, cid)
+	queue.inFlight--
+	queue.cond.Broadcast()
+}
+
+func newBlockFetchQueue() *blockFetchQueue {
+	queue := &blockFetchQueue{pending: make([]string, 0), failed: make(map[string]map[string]bool)}
+	queue.cond = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+// Fetch the blocks the host is missing from the providers in parallel, a stream per provider.
+// Blocks a provider fails to deliver are retried with the others, providers keep fetching
+// until every block is fetched or every live provider failed the blocks left. Providers sending
+// blocks that don't match their cids are dropped and it counts against them.
+func (host *Host) fetchBlocks(cids []string, providers []string) error {
+	queue := newBlockFetchQueue()
+	for _, cid := range cids {
+		if !host.blocks.Has(cid) {
+			queue.pending = append(queue.pending, cid)
+		}
+	}
+	if len(queue.pending) == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i, provider := range providers {
+		if i >= MaxBlockFetchPeers {
+			break
+		}
+		wg.Add(1)
+		go func(provider string) {
+			defer wg.Done()
+			stream, err := host.OpenStream(provider, BlockProtocol)
+			if err != nil {
+				return
+			}
+			defer stream.Close()
+
+			for {
+				cid, ok := queue.next(provider)
+				if !ok {
+					return
+				}
+				block, err := requestBlock(stream, cid)
+				if err == nil {
+					err = host.blocks.Put(cid, block)
+				}
+				if err == nil {
+					queue.done()
+					continue
+				}
+				queue.retry(cid, provider)
+				if err == errInvalidBlock {
+					host.recordAddressEvent(provider, ScoreEventMalformedResponse)
+				}
+				if err != errBlockNotFound {
+					return
+				}
+			}
+		}(provider)
+	}
+	wg.Wait()
+
+	missing := 0
+	for _, cid := range cids {
+		if !host.blocks.Has(cid) {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d blocks could not be fetched, fetched blocks are kept to resume", missing)
+	}
+	return nil
+}
+
+// Write the file data under a block in order.
+// Raw blocks linked more than once are written every time, at most MaxFileBlocks raw blocks are written
+// so DAGs linking the same blocks over and over can't keep the host busy.
+func (host *Host) writeDAG(cid string, size uint64, writer io.Writer, written *int) error {
+	block, err := host.getBlock(cid)
+	if err != nil {
+		return err
+	} else if len(block) == 0 {
+		return fmt.Errorf("block %s is empty", cid)
+	}
+	if block[0] == blockTypeRaw {
+		if *written++; *written > MaxFileBlocks {
+			return fmt.Errorf("file has too many blocks")
+		}
+		if uint64(len(block)-1) != size {
+			return fmt.Errorf("block %s size doesn't match it's link", cid)
+		}
+		_, err := writer.Write(block[1:])
+		return err
+	}
+	node, err := parseDAGNode(block)
+	if err != nil {
+		return err
+	} else if node.Size != size {
+		return fmt.Errorf("node %s size doesn't match it's link", cid)
+	}
+	for _, link := range node.Links {
+		if err := host.writeDAG(link.CID, link.Size, writer, written); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fetch the file with the root cid from it's providers and write it's data to the writer.
+// The DAG is fetched level by level and every block is verified against it's cid.
+// Blocks linked more than once are only fetched once and DAGs with more than MaxFileBlocks
+// distinct blocks are refused.
+// Blocks already in the host's block store aren't fetched again, so failed downloads resume
+// where they stopped. The host provides the file once it has all of it's blocks.
+func (host *Host) GetFile(root string, writer io.Writer) error {
+	if !isCID(root) {
+		return fmt.Errorf("invalid cid %s", root)
+	}
+
+	var providers []string
+	level := []string{root}
+	visited := map[string]bool{root: true}
+	for depth := 0; len(level) > 0; depth++ {
+		if depth > MaxDAGDepth {
+			return fmt.Errorf("file DAG is too deep")
+		}
+
+		// Providers are only looked up once blocks are missing
+		for _, cid := range level {
+			if host.blocks.Has(cid) || providers != nil {
+				continue
+			}
+			records, err := host.FindProviders(BlockProviderKey(root))
+			if err != nil {
+				return err
+			}
+			providers = make([]string, 0)
+			for _, record := range records {
+				providers = append(providers, record.PreferredAddress(""))
+			}
+		}
+		if err := host.fetchBlocks(level, providers); err != nil {
+			return err
+		}
+
+		next := make([]string, 0)
+		for _, cid := range level {
+			block, err := host.getBlock(cid)
+			if err != nil {
+				return err
+			} else if len(block) == 0 {
+				return fmt.Errorf("block %s is empty", cid)
+			} else if block[0] == blockTypeRaw {
+				continue
+			}
+			node, err := parseDAGNode(block)
+			if err != nil {
+				return err
+			}
+			for _, link := range node.Links {
+				if visited[link.CID] {
+					continue
+				} else if len(visited) >= MaxFileBlocks {
+					return fmt.Errorf("file DAG has too many blocks")
+				}
+				visited[link.CID] = true
+				next = append(next, link.CID)
+			}
+		}
+		level = next
+	}
+
+	rootBlock, err := host.getBlock(root)
+	if err != nil {
+		return err
+	}
+	rootNode, err := parseDAGNode(rootBlock)
+	if err != nil {
+		return err
+	}
+	written := 0
+	if err := host.writeDAG(root, rootNode.Size, writer, &written); err != nil {
+		return err
+	}
+	host.Provide(BlockProviderKey(root))
+	return nil
+}
+
+// Serve blocks requested on a block exchange stream.
+// Requests are raw sha256 cids, responses a status byte and the length prefixed block.
+func (host *Host) serveBlocks(stream *Stream) {
+	request := make([]byte, sha256.Size)
+	for {
+		if _, err := io.ReadFull(stream, request); err != nil {
+			return
+		}
+		response := []byte{blockNotFound, 0, 0, 0, 0}
+		if block, err := host.getBlock(hex.EncodeToString(request)); err == nil {
+			response[0] = blockFound
+			binary.BigEndian.PutUint32(response[1:], uint32(len(block)))
+			response = append(response, block...)
+		}
+		if _, err := stream.Write(response); err != nil {
+			return
+		}
+	}
+}
+
+// Returns the host's block store
+func (host *Host) BlockStore() BlockStore {
+	return host.blocks
+}
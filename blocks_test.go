@@ -0,0 +1,224 @@
+package coalition
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Returns random test file data
+func newTestFile(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestBlockExchange(t *testing.T) {
+	hosts := newTestNetwork(t, 4)
+	data := newTestFile(t, 5*BlockSize+123)
+	root, err := hosts[0].AddFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files are fetched by their root and the fetching host provides them too
+	var fetched bytes.Buffer
+	if err := hosts[1].GetFile(root, &fetched); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(fetched.Bytes(), data) {
+		t.Errorf("expected the fetched file to match")
+	}
+	records, err := hosts[2].FindProviders(BlockProviderKey(root))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(records) != 2 {
+		t.Errorf("expected 2 providers, got %d", len(records))
+	}
+
+	// Blocks are fetched from several providers at once
+	streams := make([]int32, 2)
+	for i := 0; i < 2; i++ {
+		provider := hosts[i]
+		index := i
+		provider.RegisterStreamHandler(BlockProtocol, func(stream *Stream) {
+			atomic.AddInt32(&streams[index], 1)
+			provider.serveBlocks(stream)
+		})
+	}
+	fetched.Reset()
+	if err := hosts[2].GetFile(root, &fetched); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(fetched.Bytes(), data) {
+		t.Errorf("expected the fetched file to match")
+	}
+	if atomic.LoadInt32(&streams[0]) == 0 || atomic.LoadInt32(&streams[1]) == 0 {
+		t.Errorf("expected blocks to be fetched from both providers")
+	}
+
+	// Unknown files fail
+	if err := hosts[3].GetFile(BlockCID([]byte("unknown")), &fetched); err == nil {
+		t.Errorf("expected unknown files to fail")
+	}
+	if err := hosts[3].GetFile("invalid", &fetched); err == nil {
+		t.Errorf("expected invalid cids to fail")
+	}
+}
+
+func TestBlockExchangeResume(t *testing.T) {
+	store, err := NewFileBlockStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := newTestHost(t, ListenAddress("127.0.0.1"))
+	fetcher := newTestHost(t, ListenAddress("127.0.0.1"), WithBlockStore(store))
+	if err := fetcher.Ping(testHostAddress(t, provider)); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(provider, 1)
+
+	// Deep DAGs are built when nodes run out of links
+	data := newTestFile(t, 4*BlockSize+1)
+	root, err := provider.addFile(bytes.NewReader(data), 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := provider.Provide(BlockProviderKey(root)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks already stored aren't fetched again
+	rootBlock, _ := provider.BlockStore().Get(root)
+	rootNode, err := parseDAGNode(rootBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := rootNode.Links[0].CID
+	block, _ := provider.BlockStore().Get(half)
+	if err := store.Put(half, block); err != nil {
+		t.Fatal(err)
+	}
+	provider.BlockStore().Delete(half)
+	var fetched bytes.Buffer
+	if err := fetcher.GetFile(root, &fetched); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(fetched.Bytes(), data) {
+		t.Errorf("expected the resumed file to match")
+	}
+
+	// Blocks that don't match their cids are dropped and count against the provider
+	liar := newTestHost(t, ListenAddress("127.0.0.1"))
+	liarRoot, err := liar.AddFile(bytes.NewReader(newTestFile(t, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	liarBlock, _ := liar.BlockStore().Get(liarRoot)
+	liar.RegisterStreamHandler(BlockProtocol, func(stream *Stream) {
+		request := make([]byte, 32)
+		stream.Read(request)
+		stream.Write([]byte{blockFound, 0, 0, 0, byte(len(liarBlock) + 1)})
+		stream.Write(append(liarBlock, 0))
+	})
+	liarKey := liar.PeerKey()
+	before := fetcher.Scores().Value(liarKey[:])
+	if err := fetcher.fetchBlocks([]string{liarRoot}, []string{testHostAddress(t, liar)}); err == nil {
+		t.Errorf("expected invalid blocks to fail")
+	}
+	if store.Has(liarRoot) {
+		t.Errorf("expected the invalid block to be dropped")
+	}
+	if fetcher.Scores().Value(liarKey[:]) >= before {
+		t.Errorf("expected the invalid block to count against the provider")
+	}
+}
+
+func TestMaliciousDAG(t *testing.T) {
+	hosts := newTestNetwork(t, 2)
+	provider, fetcher := hosts[0], hosts[1]
+
+	// Files repeating the same block are fetched once and written in full
+	data := make([]byte, 3*BlockSize)
+	root, err := provider.AddFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched bytes.Buffer
+	if err := fetcher.GetFile(root, &fetched); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(fetched.Bytes(), data) {
+		t.Errorf("expected the fetched file to match")
+	}
+
+	// Nodes linking the same block over and over can't blow up the download
+	cid, err := provider.putBlock([]byte{blockTypeRaw, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := uint64(1)
+	for depth := 0; depth < 3; depth++ {
+		node := dagNode{Links: make([]dagLink, MaxBlockLinks), Size: size * MaxBlockLinks}
+		for i := range node.Links {
+			node.Links[i] = dagLink{cid, size}
+		}
+		serialized, _ := json.Marshal(&node)
+		if cid, err = provider.putBlock(append([]byte{blockTypeNode}, serialized...)); err != nil {
+			t.Fatal(err)
+		}
+		size = node.Size
+	}
+	if err := provider.Provide(BlockProviderKey(cid)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetcher.GetFile(cid, io.Discard); err == nil {
+		t.Errorf("expected the file to be refused")
+	}
+
+	// Node sizes can't wrap around
+	node := dagNode{Links: []dagLink{{cid, math.MaxUint64/2 + 1}, {cid, math.MaxUint64/2 + 1}}}
+	serialized, _ := json.Marshal(&node)
+	if _, err := parseDAGNode(append([]byte{blockTypeNode}, serialized...)); err == nil {
+		t.Errorf("expected oversized nodes to be refused")
+	}
+}
+
+func TestBlockFetchRetry(t *testing.T) {
+	hosts := newTestNetwork(t, 3)
+	data := newTestFile(t, 2*BlockSize)
+	root, err := hosts[0].AddFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hosts[1].GetFile(root, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first provider lacks a block and only says so after the second provider ran out of blocks
+	rootBlock, _ := hosts[0].BlockStore().Get(root)
+	rootNode, err := parseDAGNode(rootBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := rootNode.Links[0].CID
+	hosts[0].BlockStore().Delete(missing)
+	hosts[0].RegisterStreamHandler(BlockProtocol, func(stream *Stream) {
+		time.Sleep(500 * time.Millisecond)
+		hosts[0].serveBlocks(stream)
+	})
+	hosts[1].RegisterRPCMethod(OpenStreamMethod, func(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+		time.Sleep(200 * time.Millisecond)
+		return OpenStreamHandler(host, remotePeer, req)
+	})
+
+	// The block is fetched from the second provider
+	providers := []string{testHostAddress(t, hosts[0]), testHostAddress(t, hosts[1])}
+	if err := hosts[2].fetchBlocks([]string{missing}, providers); err != nil {
+		t.Fatal(err)
+	} else if !hosts[2].BlockStore().Has(missing) {
+		t.Errorf("expected the block to be fetched")
+	}
+}
@@ -0,0 +1,80 @@
+package coalition
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Tracks the inbound connections being served, in total and per remote ip address
+type connLimiter struct {
+	mutex    sync.Mutex
+	maxConns int64
+	maxPerIP int64
+	total    int64
+	perIP    map[string]int64
+}
+
+// Reserve a connection slot for the remote ip address.
+// Returns false if either the total or per ip limit has been reached.
+func (limiter *connLimiter) acquire(ip string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.total >= limiter.maxConns || limiter.perIP[ip] >= limiter.maxPerIP {
+		return false
+	}
+	limiter.total++
+	limiter.perIP[ip]++
+	return true
+}
+
+// Release a connection slot held by the remote ip address
+func (limiter *connLimiter) release(ip string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.total--
+	limiter.perIP[ip]--
+	if limiter.perIP[ip] <= 0 {
+		delete(limiter.perIP, ip)
+	}
+}
+
+// Returns the number of inbound connections currently being served
+func (limiter *connLimiter) count() int64 {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.total
+}
+
+// Create a new connection limiter
+func newConnLimiter(maxConns, maxPerIP int64) (*connLimiter, error) {
+	if maxConns < 1 {
+		return nil, fmt.Errorf("max inbound connections must be >= 1")
+	} else if maxPerIP < 1 {
+		return nil, fmt.Errorf("max connections per ip must be >= 1")
+	}
+
+	limiter := &connLimiter{
+		maxConns: maxConns,
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int64),
+	}
+	return limiter, nil
+}
+
+// Returns the ip address of the remote end of a connection
+func remoteIP(conn net.Conn) string {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
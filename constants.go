@@ -47,3 +47,446 @@ const TCPIODeadline = time.Minute
 
 // TCP IO buffer size in bytes(1 MB)
 const TCPIOBufferSize = 1024 * 1024
+
+// Max number of RPC handlers that can execute concurrently across all methods
+const MaxConcurrentHandlersOption = "max_concurrent_handlers"
+const DefaultMaxConcurrentHandlers = int64(256)
+
+// Max number of concurrently executing handlers for a single RPC method
+const MethodConcurrencyOption = "method_concurrency"
+
+// How long an RPC request waits for a free handler slot before it is rejected.
+// A zero timeout rejects requests immediately when no slot is free.
+const HandlerQueueTimeoutOption = "handler_queue_timeout"
+const DefaultHandlerQueueTimeout = time.Second * 5
+
+// Max number of inbound connections being served at once
+const MaxInboundConnectionsOption = "max_inbound_connections"
+const DefaultMaxInboundConnections = int64(1024)
+
+// Max number of inbound connections being served at once for a single remote ip address
+const MaxConnectionsPerIPOption = "max_connections_per_ip"
+const DefaultMaxConnectionsPerIP = int64(32)
+
+// Deadline for a client to send the request size header after connecting
+const HeaderReadTimeoutOption = "header_read_timeout"
+const DefaultHeaderReadTimeout = time.Second * 5
+
+// Backoff bounds when accepting connections fails
+const MinAcceptBackoff = time.Millisecond * 5
+const MaxAcceptBackoff = time.Second
+
+// RPC response codes
+const (
+	RPCCodeOK = iota
+	RPCCodeBadRequest
+	RPCCodeUnknownMethod
+	RPCCodeHandlerError
+	RPCCodeInternalError
+	RPCCodeBusy
+	RPCCodeRateLimited
+	RPCCodeForbidden
+	RPCCodeReplayRejected
+)
+
+// Token bucket rate limits for inbound RPCs keyed by the remote peer key
+const PeerRateLimitOption = "peer_rate_limit"
+
+// Token bucket rate limits for inbound RPCs keyed by the remote ip address
+const IPRateLimitOption = "ip_rate_limit"
+
+// Rate limit method name that applies to methods without a specific limit
+const AnyMethod = "*"
+
+// Default find_node rate limits, it's the most expensive standard RPC
+var DefaultPeerRateLimits = map[string]RateLimit{
+	FindNodeMethod:      {Rate: 10, Burst: 20},
+	HolePunchMethod:     {Rate: 0.1, Burst: 2},
+	PexMethod:           {Rate: 0.1, Burst: 5},
+	AddProviderMethod:   {Rate: 1, Burst: 20},
+	GetProvidersMethod:  {Rate: 10, Burst: 20},
+	PubSubMethod:        {Rate: 50, Burst: 200},
+	DirectMessageMethod: {Rate: 10, Burst: 50},
+	MailboxPutMethod:    {Rate: 1, Burst: 20},
+	MailboxFetchMethod:  {Rate: 0.1, Burst: 5},
+	MailboxAckMethod:    {Rate: 0.1, Burst: 5},
+	OpenStreamMethod:    {Rate: 10, Burst: 50},
+}
+var DefaultIPRateLimits = map[string]RateLimit{FindNodeMethod: {Rate: 50, Burst: 100}}
+
+// Filter used to block or allow peers by key and ip range
+const PeerFilterOption = "peer_filter"
+
+// Pre-shared key of a private network, only hosts with the same key can talk
+const PrivateNetworkOption = "private_network"
+const PrivateNetworkKeySize = 32
+
+// Max plaintext size of a single encrypted private network frame
+const PrivateNetworkFrameSize = 64 * 1024
+
+// How far a signed request timestamp may drift from the host's clock
+const ReplayWindowOption = "replay_window"
+const DefaultReplayWindow = time.Minute
+
+// Max number of request nonces remembered to detect replayed requests
+const ReplayCacheSizeOption = "replay_cache_size"
+const DefaultReplayCacheSize = int64(64 * 1024)
+
+// Size of RPC request nonces in bytes
+const RequestNonceSize = 16
+
+// S/Kademlia crypto puzzle difficulties in leading zero bits required of peer keys
+const CryptoPuzzleOption = "crypto_puzzle"
+
+// Max crypto puzzle difficulty, each extra bit doubles the work of solving a puzzle
+const MaxPuzzleDifficulty = 32
+
+// Solvers give up after this many times the expected number of attempts
+const PuzzleAttemptsFactor = 1 << 10
+
+// The host's solution to the dynamic crypto puzzle
+const PuzzleSolutionOption = "puzzle_solution"
+
+// Number of disjoint paths used by lookups, as specified by S/Kademlia
+const DisjointPathsOption = "disjoint_paths"
+const DefaultDisjointPaths = 1
+
+// Max peers from the same ip4 /24 or ip6 /48 subnet in a kbucket and across the route table.
+// Loopback and private addresses are exempt.
+const SubnetLimitsOption = "subnet_limits"
+const DefaultMaxPeersPerSubnetBucket = int64(2)
+const DefaultMaxPeersPerSubnetTable = int64(10)
+
+// Subnet prefix lengths used for diversity limits
+const IP4SubnetPrefix = 24
+const IP6SubnetPrefix = 48
+
+// Half life of peer scores, scores decay towards zero over time
+const ScoreHalfLifeOption = "score_half_life"
+const DefaultScoreHalfLife = time.Hour
+
+// Peers scoring below the threshold are evicted first and skipped in lookups
+const ScoreThresholdOption = "score_threshold"
+const DefaultScoreThreshold = float64(-20)
+
+// Bounds of a peer's score
+const PeerScoreCeiling = float64(20)
+const PeerScoreFloor = float64(-100)
+
+// Max number of peer scores tracked before decayed scores are dropped
+const MaxTrackedScores = 10000
+
+// How long a signed peer record is trusted after it was signed
+const PeerRecordTTLOption = "peer_record_ttl"
+const DefaultPeerRecordTTL = time.Hour * 24
+
+// Max clock drift allowed for peer record sequence numbers from the future
+const PeerRecordClockDrift = time.Minute
+
+// find_node protocol version that returns signed peer records instead of addresses
+const FindNodeRecordsVersion = 2
+
+// Rate at which inbound peers are dialed back to check they're reachable
+const DialBackRateLimitOption = "dial_back_rate_limit"
+
+var DefaultDialBackRateLimit = RateLimit{Rate: 10, Burst: 20}
+
+// How long the result of a dial back check is trusted
+const DialBackCacheTTLOption = "dial_back_cache_ttl"
+const DefaultDialBackCacheTTL = time.Minute * 10
+
+// Max number of peers waiting to be dialed back
+const DialBackQueueSizeOption = "dial_back_queue_size"
+const DefaultDialBackQueueSize = int64(256)
+
+// Number of concurrent dial back checks
+const DialBackWorkers = 4
+
+// Max number of dial back results remembered before expired results are dropped
+const MaxDialBackResults = 10000
+
+// Timeout for establishing outbound connections
+const DialTimeout = time.Second * 10
+
+// RPC method for peers to identify themselves and report how they see the caller
+const IdentifyMethod = "identify"
+
+// User agent reported by the identify RPC method
+const AgentVersionOption = "agent_version"
+const DefaultAgentVersion = "coalition-p2p/1.0"
+
+// Number of peers from different subnets that must observe the same public ip address
+// before the host advertises it
+const ObservedAddressThreshold = 2
+
+// How long an observed address is remembered
+const ObservedAddressTTL = time.Minute * 30
+
+// Number of peers identified by the identify service each period
+const IdentifyPeers = 5
+
+// Period between identify rounds
+const IdentifyPeriod = time.Minute * 10
+
+// The ip4 address or network interface name the host listens on
+const ListenAddressOption = "listen_address"
+const DefaultListenAddress = "0.0.0.0"
+
+// Addresses advertised instead of the host's interface addresses
+const AnnounceAddressesOption = "announce_addresses"
+
+// Address classes left out of the host's addresses and find_node responses
+const ExcludeAddressesOption = "exclude_addresses"
+
+// Gateway port mapper used to make the host reachable from behind a NAT
+const PortMapperOption = "port_mapper"
+
+// Requested lifetime of gateway port mappings, mappings are renewed half way through
+const PortMappingLifetime = time.Hour
+
+// Period between attempts to map a port after a failure
+const PortMappingRetryPeriod = time.Minute
+
+// Max time spent waiting for a gateway to answer a port mapping request
+const PortMappingTimeout = time.Second * 3
+
+// Description of the host's UPnP port mappings
+const PortMappingDescription = "coalition-p2p"
+
+// NAT-PMP and PCP gateway port
+const NATPMPPort = 5351
+
+// SSDP multicast address used to discover UPnP gateways
+const SSDPAddress = "239.255.255.250:1900"
+
+// RPC methods of the circuit relay protocol
+const RelayReserveMethod = "relay_reserve"
+const RelayConnectMethod = "relay_connect"
+const RelayAcceptMethod = "relay_accept"
+
+// Serve as a circuit relay for peers that aren't publicly reachable
+const RelayOption = "relay"
+
+var DefaultRelayLimits = RelayLimits{
+	MaxReservations:    128,
+	MaxCircuits:        256,
+	ReservationTTL:     time.Hour,
+	MaxCircuitDuration: time.Minute * 2,
+	MaxCircuitBytes:    4 * TCPIOBufferSize,
+	CircuitBandwidth:   TCPIOBufferSize,
+}
+
+// Relays the host keeps a reservation on
+const StaticRelaysOption = "static_relays"
+
+// How long a relay waits for the relayed peer to accept a circuit
+const RelayAcceptTimeout = time.Second * 10
+
+// Period between attempts to reserve slots on static relays
+const RelayReservePeriod = time.Minute
+
+// Transport carrying the host's connections
+const TransportOption = "transport"
+
+// Upgrade relayed connections to direct ones by hole punching
+const HolePunchingOption = "hole_punching"
+const HolePunchMethod = "hole_punch"
+
+// How long peers keep dialing each other while hole punching
+const HolePunchTimeout = time.Second * 5
+
+// Delay between rounds of hole punching dials and the timeout of each dial
+const HolePunchRetryInterval = time.Millisecond * 100
+const HolePunchDialTimeout = time.Second
+
+// How long before hole punching a relayed peer is attempted again
+const HolePunchRetryPeriod = time.Minute * 10
+
+// Max addresses a peer may ask the host to punch
+const MaxHolePunchAddresses = 8
+
+// Announce the host over udp multicast to find peers on the local network
+const LocalDiscoveryOption = "local_discovery"
+
+// Only hosts announcing the same service name find each other
+const LocalDiscoveryServiceNameOption = "local_discovery_service_name"
+const DefaultLocalDiscoveryServiceName = "coalition-p2p"
+
+// Period between local announcements
+const LocalDiscoveryIntervalOption = "local_discovery_interval"
+const DefaultLocalDiscoveryInterval = time.Second * 30
+
+// Multicast group address announcements are sent to
+const LocalDiscoveryGroupOption = "local_discovery_group"
+const DefaultLocalDiscoveryGroup = "239.255.70.77:6770"
+
+// Network interface announcements are sent and received on, the system's default if empty
+const LocalDiscoveryInterfaceOption = "local_discovery_interface"
+
+// Resolver used for hostnames in node addresses and dnsaddrs
+const ResolverOption = "resolver"
+
+// Node addresses are published in TXT records of _dnsaddr.<name> as dnsaddr=<address>
+const DNSAddrScheme = "dnsaddr://"
+const DNSAddrPrefix = "_dnsaddr."
+const DNSAddrRecordKey = "dnsaddr="
+
+// Max depth of nested dnsaddrs and max addresses resolved from a dnsaddr
+const DNSAddrMaxDepth = 4
+const MaxDNSAddrAddresses = 64
+
+// Swap samples of healthy peers with neighbours to fill route tables and heal partitions
+const PexMethod = "pex"
+
+// Max peer records in a peer exchange sample
+const PexSampleSize = 16
+
+// Neighbours swapped with per round and the period between rounds
+const PexPeers = 3
+const PexPeriod = time.Minute * 5
+
+// Store and find the peers providing a key on the nodes closest to it
+const AddProviderMethod = "add_provider"
+const GetProvidersMethod = "get_providers"
+
+// How long provider records are kept and the period the host republishes it's own before they expire
+const ProviderTTL = time.Hour
+const ProviderRepublishPeriod = time.Minute * 30
+
+// Closest nodes a provider record is stored on and looked up from
+const ProviderReplication = 20
+
+// Max providers stored per key and max keys stored
+const MaxProvidersPerKey = 64
+const MaxProviderKeys = 10000
+
+// Topic based publish/subscribe between subscribers found through provider records
+const PubSubMethod = "pubsub"
+
+// Router spreading messages through a topic's subscribers.
+// Floodsub forwards every message to every subscriber it knows, gossipsub forwards them
+// through a mesh of subscribers and gossips the ids of recent messages to the rest.
+const PubSubRouterOption = "pubsub_router"
+const FloodSubRouter = "floodsub"
+const GossipSubRouter = "gossipsub"
+const DefaultPubSubRouter = GossipSubRouter
+
+// Target, low and high degree of gossipsub meshes
+const GossipSubD = 6
+const GossipSubDlo = 4
+const GossipSubDhi = 12
+
+// Subscribers outside the mesh gossiped to every heartbeat
+const GossipSubDlazy = 6
+
+// Period between heartbeats maintaining meshes and gossiping
+const GossipSubHeartbeat = time.Second
+
+// Heartbeats messages are cached for and heartbeats their ids are gossiped for
+const GossipSubHistoryLength = 5
+const GossipSubHistoryGossip = 3
+
+// How long message ids are remembered to drop duplicates
+const PubSubSeenTTL = time.Minute * 2
+
+// How long subscribers of a topic the host published to without subscribing are kept
+const PubSubFanoutTTL = time.Minute
+
+// Period between looking up the subscribers of a topic
+const PubSubDiscoveryPeriod = time.Minute
+
+// Per topic limits apply to all topics without their own limits when set for any topic
+const AnyTopic = "*"
+
+// Max size of the message data of a topic
+const TopicMessageSizeOption = "topic_message_size"
+const DefaultTopicMessageSize = 1 << 16
+
+// Rate limit of the messages each publisher sends to a topic, publishers above it are ignored
+const TopicRateLimitOption = "topic_rate_limit"
+
+var DefaultTopicRateLimits = map[string]RateLimit{AnyTopic: {Rate: 10, Burst: 100}}
+
+// Max subscribers tracked per topic
+const MaxPubSubTopicPeers = 128
+
+// Max topics, message ids and messages in a pubsub rpc
+const MaxPubSubTopics = 64
+const MaxPubSubIDs = 512
+const MaxPubSubMessages = 64
+
+// Max follow up rpcs sent in answer to a peer's pubsub response
+const MaxPubSubReplyRounds = 1
+
+// Messages buffered per subscription
+const PubSubSubscriptionBuffer = 64
+
+// Send messages to peers by key, parking them in mailboxes on the closest nodes while the peer is offline
+const DirectMessageMethod = "direct_message"
+const MailboxPutMethod = "mailbox_put"
+const MailboxFetchMethod = "mailbox_fetch"
+const MailboxAckMethod = "mailbox_ack"
+
+// Max size of direct message data and the bytes encryption and signing add to it
+const MaxDirectMessageSize = 1 << 16
+const DirectMessageOverhead = 1024
+
+// Size of random direct message ids
+const DirectMessageIDSize = 16
+
+// Sends to the recipient before parking a message and the delay before the first retry, doubled every retry
+const DirectMessageAttempts = 3
+const DirectMessageRetryInterval = time.Millisecond * 500
+
+// Max clock drift allowed for direct message timestamps from the future
+const DirectMessageClockDrift = time.Minute
+
+// Direct messages buffered until read
+const DirectMessageBuffer = 64
+
+// Closest nodes messages are parked on
+const MailboxReplication = 20
+
+// How long parked messages are kept and the period between mailbox checks
+const MailboxTTL = time.Hour * 24
+const MailboxCheckPeriod = time.Minute * 5
+
+// Max messages parked per recipient and in total
+const MaxMailboxSize = 64
+const MaxMailboxStoreSize = 10000
+
+// Max messages a peer can park in total and in a single mailbox
+const MaxMailboxSenderSize = 256
+const MaxMailboxSenderShare = 16
+
+// Open flow controlled byte streams with peers for payloads beyond the rpc payload limit
+const OpenStreamMethod = "open_stream"
+
+// Max data per stream frame and max unread data a stream accepts before the reader grants more
+const StreamChunkSize = 1024 * 16
+const StreamWindowSize = 1024 * 256
+
+// How long a stream may go without frames and how long a closed stream waits for the peer to close
+const StreamIdleTimeout = time.Minute * 5
+const StreamCloseTimeout = time.Second * 10
+
+// Store blocks of files with the block store instead of in memory
+const BlockStoreOption = "block_store"
+
+// Stream protocol blocks are exchanged over
+const BlockProtocol = "blocks"
+
+// Size of the file data in a block and the max size of any block
+const BlockSize = 1024 * 256
+const MaxBlockSize = BlockSize + 1
+
+// Max links per DAG node and max depth of a file's DAG
+const MaxBlockLinks = 1024
+const MaxDAGDepth = 8
+
+// Max distinct blocks in a file's DAG and max size of a file's data
+const MaxFileBlocks = 1 << 18
+const MaxFileSize = uint64(MaxFileBlocks) * BlockSize
+
+// Max providers a file is fetched from at once
+const MaxBlockFetchPeers = 8
@@ -2,11 +2,16 @@ package coalition
 
 import (
 	"bytes"
+	"encoding/hex"
 	"sync"
 )
 
 // Find network peers closest to a search key
 func (host *Host) FindClosestNodes(searchKey []byte) ([]*Peer, error) {
+	if host.disjointPaths > 1 {
+		return host.findClosestNodesDisjoint(searchKey, host.disjointPaths)
+	}
+
 	var wg sync.WaitGroup
 	var mutex sync.Mutex
 
@@ -16,7 +21,7 @@ func (host *Host) FindClosestNodes(searchKey []byte) ([]*Peer, error) {
 	activeNodes, inactiveNodes := host.filterDeadNodes(host.RouteTable().Peers())
 	prevLookUpRes := make([]*Peer, 0)
 	currentLookUpRes := SortPeersByClosest(
-		activeNodes,
+		host.filterLowScores(activeNodes),
 		searchKey,
 	)
 	if len(currentLookUpRes) == 0 {
@@ -32,8 +37,12 @@ func (host *Host) FindClosestNodes(searchKey []byte) ([]*Peer, error) {
 		// Max distance of furtherest peer in prev lookups
 		maxDistance := XORBytes(prevLookUpRes[len(prevLookUpRes)-1].Key(), searchKey)
 
+		// Query a diverse set of lookup nodes
+		currentLookUpRes = LimitPeersPerSubnet(currentLookUpRes, host.subnetLimits.perBucket)
+
 		// Find closer set of nodes to the key from the lookup nodes
 		newRes := make([]*Peer, 0)
+		referrers := make(map[string][]byte)
 		for i := 0; i < concurrentRequests && i < len(currentLookUpRes); i++ {
 			wg.Add(1)
 			go func(lookupNode *Peer) {
@@ -44,7 +53,7 @@ func (host *Host) FindClosestNodes(searchKey []byte) ([]*Peer, error) {
 				if err != nil {
 					return
 				}
-				responseAddrs, err := host.FindNode(lookupNodeAddr, searchKey)
+				responseRecords, err := host.FindNodeRecords(lookupNodeAddr, searchKey)
 				if err != nil {
 					return
 				}
@@ -52,8 +61,8 @@ func (host *Host) FindClosestNodes(searchKey []byte) ([]*Peer, error) {
 				mutex.Lock()
 				defer mutex.Unlock()
 
-				for _, responseAddr := range responseAddrs {
-					peer, err := NewPeerFromAddress(responseAddr)
+				for _, responseRecord := range responseRecords {
+					peer, err := NewPeerFromRecord(responseRecord, lookupNode.IPAddress())
 					if err != nil {
 						continue
 					}
@@ -94,6 +103,11 @@ func (host *Host) FindClosestNodes(searchKey []byte) ([]*Peer, error) {
 						continue
 					}
 
+					// Skip peers with a poor reputation
+					if host.scores.Value(peer.Key()) < host.scoreThreshold {
+						continue
+					}
+
 					// Ensure this peer is closer than the furtherest of the previous peers
 					// And ensure the peer isn't this host
 					distance := XORBytes(peer.Key(), searchKey)
@@ -103,6 +117,7 @@ func (host *Host) FindClosestNodes(searchKey []byte) ([]*Peer, error) {
 					}
 
 					newRes = append(newRes, peer)
+					referrers[hex.EncodeToString(peer.Key())] = lookupNode.Key()
 				}
 			}(currentLookUpRes[i])
 		}
@@ -112,6 +127,11 @@ func (host *Host) FindClosestNodes(searchKey []byte) ([]*Peer, error) {
 		activeNodes, deadNodes := host.filterDeadNodes(newRes)
 		inactiveNodes = append(inactiveNodes, deadNodes...)
 
+		// Peers returning unreachable addresses lose reputation
+		for _, deadNode := range deadNodes {
+			host.scores.Record(referrers[hex.EncodeToString(deadNode.Key())], ScoreEventUnreachableReferral)
+		}
+
 		// Unable to find closer live nodes to the search key
 		if len(activeNodes) == 0 {
 			break
@@ -122,10 +142,195 @@ func (host *Host) FindClosestNodes(searchKey []byte) ([]*Peer, error) {
 	}
 
 	// Sort all lookups from closest to farthest
-	// Return at most max peers
+	// Return at most max peers from a diverse set of subnets
 	prevLookUpRes = SortPeersByClosest(prevLookUpRes, searchKey)
+	prevLookUpRes = LimitPeersPerSubnet(prevLookUpRes, host.subnetLimits.perTable)
 	if len(prevLookUpRes) >= int(host.maxPeers) {
 		return prevLookUpRes[:host.maxPeers], nil
 	}
 	return prevLookUpRes, nil
 }
+
+// Find network peers closest to a search key over disjoint lookup paths.
+// The known peers are split between the paths and no peer is queried by more
+// than one path, so an adversarial peer can only steer the path that reached it.
+func (host *Host) findClosestNodesDisjoint(searchKey []byte, paths int) ([]*Peer, error) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	activeNodes, _ := host.filterDeadNodes(host.RouteTable().Peers())
+	seeds := SortPeersByClosest(host.filterLowScores(activeNodes), searchKey)
+	if len(seeds) == 0 {
+		return make([]*Peer, 0), nil
+	}
+
+	// A peer belongs to the first path to claim it
+	claimed := make(map[string]bool)
+	claim := func(peer *Peer) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		key := hex.EncodeToString(peer.Key())
+		if claimed[key] {
+			return false
+		}
+		claimed[key] = true
+		return true
+	}
+
+	// Deal the seeds out to the paths from closest to farthest
+	pathResults := make([][]*Peer, paths)
+	for i := 0; i < paths; i++ {
+		pathSeeds := make([]*Peer, 0)
+		for j := i; j < len(seeds); j += paths {
+			pathSeeds = append(pathSeeds, seeds[j])
+		}
+
+		wg.Add(1)
+		go func(i int, pathSeeds []*Peer) {
+			defer wg.Done()
+			pathResults[i] = host.runLookupPath(searchKey, pathSeeds, claim)
+		}(i, pathSeeds)
+	}
+	wg.Wait()
+
+	// Merge the results of all paths
+	merged := make([]*Peer, 0)
+	seen := make(map[string]bool)
+	for _, results := range pathResults {
+		for _, peer := range results {
+			key := hex.EncodeToString(peer.Key())
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, peer)
+		}
+	}
+
+	// Sort all lookups from closest to farthest
+	// Return at most max peers from a diverse set of subnets
+	merged = SortPeersByClosest(merged, searchKey)
+	merged = LimitPeersPerSubnet(merged, host.subnetLimits.perTable)
+	if len(merged) >= int(host.maxPeers) {
+		return merged[:host.maxPeers], nil
+	}
+	return merged, nil
+}
+
+// Run a single path of a disjoint lookup.
+// Only peers the path manages to claim are queried.
+// Returns the peers that responded on this path from closest to farthest.
+func (host *Host) runLookupPath(
+	searchKey []byte,
+	seeds []*Peer,
+	claim func(*Peer) bool,
+) []*Peer {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	hostKey := host.PeerKey()
+	concurrentRequests := int(host.concurrentRequests)
+
+	known := make(map[string]bool)
+	for _, peer := range seeds {
+		known[hex.EncodeToString(peer.Key())] = true
+	}
+	referrers := make(map[string][]byte)
+	candidates := SortPeersByClosest(seeds, searchKey)
+	results := make([]*Peer, 0)
+
+	for {
+		// Once the path has max peers results, only closer candidates can improve it
+		var maxDistance []byte
+		if len(results) >= int(host.maxPeers) {
+			maxDistance = XORBytes(results[host.maxPeers-1].Key(), searchKey)
+		}
+
+		// Claim the next batch of closest candidates from a diverse set of subnets
+		batch := make([]*Peer, 0)
+		remaining := make([]*Peer, 0)
+		subnetCounts := make(map[string]int64)
+		for _, candidate := range candidates {
+			subnet := SubnetKey(candidate.IPAddress())
+			diverse := subnet == "" || host.subnetLimits.perBucket < 1 ||
+				subnetCounts[subnet] < host.subnetLimits.perBucket
+			distance := XORBytes(candidate.Key(), searchKey)
+			if maxDistance != nil && bytes.Compare(distance, maxDistance) >= 0 {
+				continue
+			} else if host.scores.Value(candidate.Key()) < host.scoreThreshold {
+				continue
+			} else if len(batch) >= concurrentRequests || !diverse {
+				remaining = append(remaining, candidate)
+			} else if claim(candidate) {
+				subnetCounts[subnet]++
+				batch = append(batch, candidate)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		// Ask the batch for closer nodes
+		newCandidates := make([]*Peer, 0)
+		for _, lookupNode := range batch {
+			wg.Add(1)
+			go func(lookupNode *Peer) {
+				defer wg.Done()
+
+				lookupNodeAddr, err := lookupNode.Address()
+				if err != nil {
+					return
+				}
+				responseRecords, err := host.FindNodeRecords(lookupNodeAddr, searchKey)
+				if err != nil {
+					// Peers returning unreachable addresses lose reputation
+					mutex.Lock()
+					referrer, referred := referrers[hex.EncodeToString(lookupNode.Key())]
+					mutex.Unlock()
+					if referred {
+						host.scores.Record(referrer, ScoreEventUnreachableReferral)
+					}
+					return
+				}
+
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				results = append(results, lookupNode)
+				for _, responseRecord := range responseRecords {
+					peer, err := NewPeerFromRecord(responseRecord, lookupNode.IPAddress())
+					if err != nil {
+						continue
+					}
+
+					// Skip this host and peers already known to the path
+					key := hex.EncodeToString(peer.Key())
+					if known[key] || bytes.Equal(peer.Key(), hostKey[:]) {
+						continue
+					}
+					known[key] = true
+					referrers[key] = lookupNode.Key()
+					newCandidates = append(newCandidates, peer)
+				}
+			}(lookupNode)
+		}
+		wg.Wait()
+
+		results = SortPeersByClosest(results, searchKey)
+		candidates = SortPeersByClosest(append(remaining, newCandidates...), searchKey)
+	}
+
+	return results
+}
+
+// Helper to filter peers scoring below the score threshold
+func (host *Host) filterLowScores(peers []*Peer) []*Peer {
+	output := make([]*Peer, 0)
+	for _, peer := range peers {
+		if host.scores.Value(peer.Key()) >= host.scoreThreshold {
+			output = append(output, peer)
+		}
+	}
+	return output
+}
@@ -0,0 +1,127 @@
+package coalition
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+)
+
+// Create a listening host, closed at the end of the test
+func newTestHost(t *testing.T, options ...Option) *Host {
+	host, err := NewHost(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go host.Listen()
+	t.Cleanup(host.Close)
+	return host
+}
+
+// Returns the first address of a host
+func testHostAddress(t *testing.T, host *Host) string {
+	addrs, err := host.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(addrs) == 0 {
+		t.Fatal("host has no addresses")
+	}
+	return addrs[0]
+}
+
+func TestDisjointLookupWithAdversaries(t *testing.T) {
+	lookupHost := newTestHost(t, DisjointPaths(2))
+	lookupKey := lookupHost.PeerKey()
+
+	// Count the find_node queries each host receives from the lookup host
+	queries := make(map[*Host]*int32)
+	countQueries := func(host *Host, handler RPCHandlerFunc) {
+		counter := new(int32)
+		queries[host] = counter
+		host.RegisterRPCMethod(FindNodeMethod, func(h *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+			if bytes.Equal(remotePeer.Key(), lookupKey[:]) {
+				atomic.AddInt32(counter, 1)
+			}
+			return handler(h, remotePeer, req)
+		})
+	}
+
+	// A chain of honest hosts, each knowing it's neighbours
+	honest := make([]*Host, 0)
+	for i := 0; i < 5; i++ {
+		host := newTestHost(t)
+		countQueries(host, FindNodeHandler)
+		if i > 0 {
+			if err := honest[i-1].Ping(testHostAddress(t, host)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		honest = append(honest, host)
+	}
+
+	// Colluding adversaries that only ever return each other and forged records
+	adversaries := make([]*Host, 0)
+	for i := 0; i < 3; i++ {
+		adversaries = append(adversaries, newTestHost(t))
+	}
+	adversaryRecords := make([]*PeerRecord, 0)
+	for _, host := range adversaries {
+		record, err := host.PeerRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		adversaryRecords = append(adversaryRecords, record)
+
+		// Claim the honest target lives at the adversary's address
+		forged := *record
+		forged.Addresses = make([]string, 0)
+		for _, address := range record.Addresses {
+			_, ip, port, err := ParseNodeAddress(address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			targetKey := honest[len(honest)-1].PeerKey()
+			forgedAddr, err := FormatNodeAddress(targetKey[:], ip, port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			forged.Addresses = append(forged.Addresses, forgedAddr)
+		}
+		adversaryRecords = append(adversaryRecords, &forged)
+	}
+	for _, host := range adversaries {
+		countQueries(host, func(*Host, *Peer, RPCRequest) (interface{}, error) {
+			return adversaryRecords, nil
+		})
+	}
+
+	// The lookup host knows one honest host and one adversary
+	if err := lookupHost.Ping(testHostAddress(t, honest[0])); err != nil {
+		t.Fatal(err)
+	} else if err := lookupHost.Ping(testHostAddress(t, adversaries[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	// The end of the honest chain should be found despite the adversaries
+	target := honest[len(honest)-1].PeerKey()
+	peers, err := lookupHost.FindClosestNodes(target[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, peer := range peers {
+		if bytes.Equal(peer.Key(), target[:]) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the target to be found")
+	}
+
+	// No host should have been queried by more than one path
+	for host, counter := range queries {
+		if count := atomic.LoadInt32(counter); count > 1 {
+			key := host.PeerKey()
+			t.Errorf("host [%x] was queried %d times", key, count)
+		}
+	}
+}
@@ -0,0 +1,703 @@
+package coalition
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Domain separation prefixes for direct message signatures and encryption keys
+var directMessageDomain = []byte("coalition-direct-message")
+var directMessageKeyDomain = []byte("coalition-direct-message-key")
+
+// Field prime of curve25519, 2^255 - 19
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// Convert an ed25519 public key to the X25519 public key of the same curve point.
+// The montgomery u coordinate is (1 + y) / (1 - y) of the edwards y coordinate.
+func ed25519PublicKeyToX25519(publicKey ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+	encoded := make([]byte, len(publicKey))
+	for i := range publicKey {
+		encoded[len(publicKey)-1-i] = publicKey[i]
+	}
+	encoded[0] &= 0x7f
+	y := new(big.Int).SetBytes(encoded)
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.Sign() == 0 {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator.ModInverse(denominator, curve25519P))
+	u.Mod(u, curve25519P)
+
+	uBytes := u.FillBytes(make([]byte, 32))
+	for i, j := 0, len(uBytes)-1; i < j; i, j = i+1, j-1 {
+		uBytes[i], uBytes[j] = uBytes[j], uBytes[i]
+	}
+	return ecdh.X25519().NewPublicKey(uBytes)
+}
+
+// Convert an ed25519 private key to the X25519 private key of it's public key
+func ed25519PrivateKeyToX25519(privateKey ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	digest := sha512.Sum512(privateKey.Seed())
+	return ecdh.X25519().NewPrivateKey(digest[:32])
+}
+
+// Derive the AES-GCM cipher of a message from the X25519 shared secret
+func directMessageCipher(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	hash := sha256.New()
+	hash.Write(directMessageKeyDomain)
+	hash.Write(shared)
+	hash.Write(ephemeral)
+	hash.Write(recipient)
+	block, err := aes.NewCipher(hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// A direct message encrypted to the recipient's key with an ephemeral X25519 key.
+// Only the id and recipient are visible to the peers relaying or storing it.
+type DirectEnvelope struct {
+	ID         string `json:"id"`
+	Recipient  string `json:"recipient"`
+	Ephemeral  string `json:"ephemeral"`
+	Nonce      string `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Returns the additional data authenticated with the envelope's ciphertext
+func (envelope *DirectEnvelope) additionalData() []byte {
+	return []byte(envelope.ID + envelope.Recipient + envelope.Ephemeral)
+}
+
+// The sealed contents of a direct message, signed by the sender
+type directPayload struct {
+	Timestamp int64  `json:"timestamp"`
+	Data      []byte `json:"data"`
+	Signature string `json:"signature"`
+}
+
+// Returns the digest signed by the sender
+func (payload *directPayload) digest(id, recipient string) []byte {
+	hash := sha256.New()
+	hash.Write(directMessageDomain)
+	hash.Write([]byte(id))
+	hash.Write([]byte(recipient))
+	hash.Write(Uint64ToBytes(uint64(payload.Timestamp)))
+	hash.Write(payload.Data)
+	return hash.Sum(nil)
+}
+
+// A direct message received by the host
+type DirectMessage struct {
+	ID        string
+	From      []byte
+	Data      []byte
+	Timestamp time.Time
+}
+
+// How a direct message was delivered
+type DeliveryStatus int
+
+const (
+	// The recipient acknowledged the message
+	DeliveryAcknowledged DeliveryStatus = iota
+	// The recipient was offline and the message was parked in it's mailboxes
+	DeliveryStored
+)
+
+// Mailboxes parked on the host for offline peers.
+// Envelopes are counted against the peer that parked them so one peer can't fill the store or a mailbox.
+type mailboxStore struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	envelopes map[string][]*DirectEnvelope
+	expiries  map[string]time.Time
+	senders   map[string]string
+	sent      map[string]int
+	size      int
+}
+
+// Forget an envelope that left the store
+func (store *mailboxStore) drop(id string) {
+	sender := store.senders[id]
+	if store.sent[sender]--; store.sent[sender] <= 0 {
+		delete(store.sent, sender)
+	}
+	delete(store.senders, id)
+	delete(store.expiries, id)
+	store.size--
+}
+
+// Remove expired envelopes
+func (store *mailboxStore) prune() {
+	for recipient, envelopes := range store.envelopes {
+		kept := make([]*DirectEnvelope, 0)
+		for _, envelope := range envelopes {
+			if time.Now().Before(store.expiries[envelope.ID]) {
+				kept = append(kept, envelope)
+				continue
+			}
+			store.drop(envelope.ID)
+		}
+		if len(kept) == 0 {
+			delete(store.envelopes, recipient)
+		} else {
+			store.envelopes[recipient] = kept
+		}
+	}
+}
+
+// Park an envelope from the sender in it's recipient's mailbox, envelopes already parked are kept as is
+func (store *mailboxStore) put(sender []byte, envelope *DirectEnvelope) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.prune()
+
+	hexSender := hex.EncodeToString(sender)
+	if _, exists := store.expiries[envelope.ID]; exists {
+		return nil
+	} else if store.size >= MaxMailboxStoreSize {
+		return fmt.Errorf("mailbox store is full")
+	} else if len(store.envelopes[envelope.Recipient]) >= MaxMailboxSize {
+		return fmt.Errorf("mailbox is full")
+	} else if store.sent[hexSender] >= MaxMailboxSenderSize {
+		return fmt.Errorf("too many messages parked by the peer")
+	}
+	parked := 0
+	for _, parkedEnvelope := range store.envelopes[envelope.Recipient] {
+		if store.senders[parkedEnvelope.ID] == hexSender {
+			parked++
+		}
+	}
+	if parked >= MaxMailboxSenderShare {
+		return fmt.Errorf("too many messages parked by the peer in the mailbox")
+	}
+
+	store.envelopes[envelope.Recipient] = append(store.envelopes[envelope.Recipient], envelope)
+	store.expiries[envelope.ID] = time.Now().Add(store.ttl)
+	store.senders[envelope.ID] = hexSender
+	store.sent[hexSender]++
+	store.size++
+	return nil
+}
+
+// Returns the envelopes parked for the recipient, they're kept until the recipient acknowledges them
+func (store *mailboxStore) get(recipient []byte) []*DirectEnvelope {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.prune()
+
+	envelopes := store.envelopes[hex.EncodeToString(recipient)]
+	return append(make([]*DirectEnvelope, 0, len(envelopes)), envelopes...)
+}
+
+// Remove the envelopes with the ids from the recipient's mailbox
+func (store *mailboxStore) remove(recipient []byte, ids []string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	removed := make(map[string]bool)
+	for _, id := range ids {
+		removed[id] = true
+	}
+	hexRecipient := hex.EncodeToString(recipient)
+	kept := make([]*DirectEnvelope, 0)
+	for _, envelope := range store.envelopes[hexRecipient] {
+		if !removed[envelope.ID] {
+			kept = append(kept, envelope)
+			continue
+		}
+		store.drop(envelope.ID)
+	}
+	if len(kept) == 0 {
+		delete(store.envelopes, hexRecipient)
+	} else {
+		store.envelopes[hexRecipient] = kept
+	}
+}
+
+func newMailboxStore(ttl time.Duration) *mailboxStore {
+	return &mailboxStore{
+		ttl:       ttl,
+		envelopes: make(map[string][]*DirectEnvelope),
+		expiries:  make(map[string]time.Time),
+		senders:   make(map[string]string),
+		sent:      make(map[string]int),
+	}
+}
+
+// Direct messages received by the host, with the ids of recent ones to drop duplicates
+type directInbox struct {
+	mutex    sync.Mutex
+	messages chan *DirectMessage
+	seen     map[string]time.Time
+}
+
+// Deliver a message unless it was already delivered.
+// Fails if the inbox is full so the sender keeps the message.
+func (inbox *directInbox) deliver(message *DirectMessage) error {
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+
+	for id, seenAt := range inbox.seen {
+		if time.Since(seenAt) > MailboxTTL {
+			delete(inbox.seen, id)
+		}
+	}
+	if _, seen := inbox.seen[message.ID]; seen {
+		return nil
+	}
+	select {
+	case inbox.messages <- message:
+		inbox.seen[message.ID] = time.Now()
+		return nil
+	default:
+		return fmt.Errorf("inbox is full")
+	}
+}
+
+func newDirectInbox(size int) *directInbox {
+	return &directInbox{
+		messages: make(chan *DirectMessage, size),
+		seen:     make(map[string]time.Time),
+	}
+}
+
+// Parse a direct message envelope sent by a peer
+func parseDirectEnvelope(data interface{}) (*DirectEnvelope, error) {
+	serialized, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var envelope DirectEnvelope
+	if err := json.Unmarshal(serialized, &envelope); err != nil {
+		return nil, fmt.Errorf("expected a direct message envelope")
+	}
+	if len(envelope.ID) != DirectMessageIDSize*2 || len(envelope.Recipient) != PeerKeySize*2 {
+		return nil, fmt.Errorf("invalid direct message envelope")
+	} else if len(envelope.Ciphertext) > MaxDirectMessageSize+DirectMessageOverhead {
+		return nil, fmt.Errorf("direct message is too large")
+	}
+	return &envelope, nil
+}
+
+// Find the signed record of a peer by it's key, from the route table or the nodes closest to the key.
+// The record carries the public key direct messages are encrypted to.
+func (host *Host) findPeerRecord(peerKey []byte) (*PeerRecord, error) {
+	if peer := host.table.Get(peerKey); peer != nil && peer.Record() != nil {
+		if key, err := peer.Record().Verify(host.recordTTL); err == nil && bytes.Equal(key, peerKey) {
+			return peer.Record(), nil
+		}
+	}
+
+	peers, err := host.FindClosestNodes(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, peer := range peers {
+		if bytes.Equal(peer.Key(), peerKey) && peer.Record() != nil {
+			return peer.Record(), nil
+		}
+	}
+
+	// Offline peers are still known to the nodes closest to them
+	for i, peer := range peers {
+		if i >= MailboxReplication {
+			break
+		}
+		peerAddr, err := peer.Address()
+		if err != nil {
+			continue
+		}
+		records, err := host.FindNodeRecords(peerAddr, peerKey)
+		if err != nil {
+			continue
+		}
+		for _, record := range records {
+			if key, _ := record.PeerKey(); bytes.Equal(key, peerKey) {
+				return record, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("peer %x not found", peerKey)
+}
+
+// Encrypt and sign a direct message sent at the time to the recipient's record
+func (host *Host) sealDirectMessage(record *PeerRecord, data []byte, sentAt time.Time) (*DirectEnvelope, error) {
+	recipientKey, err := record.PeerKey()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, _ := hex.DecodeString(record.PublicKey)
+	recipient, err := ed25519PublicKeyToX25519(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := directMessageCipher(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, DirectMessageIDSize)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	} else if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	envelope := &DirectEnvelope{
+		ID:        hex.EncodeToString(id),
+		Recipient: hex.EncodeToString(recipientKey),
+		Ephemeral: hex.EncodeToString(ephemeral.PublicKey().Bytes()),
+		Nonce:     hex.EncodeToString(nonce),
+	}
+
+	payload := &directPayload{Timestamp: sentAt.UnixMilli(), Data: data}
+	signature, err := host.Sign(payload.digest(envelope.ID, envelope.Recipient))
+	if err != nil {
+		return nil, err
+	}
+	payload.Signature = hex.EncodeToString(signature[:])
+	plaintext, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	envelope.Ciphertext = aead.Seal(nil, nonce, plaintext, envelope.additionalData())
+	return envelope, nil
+}
+
+// Decrypt a direct message sent to the host and verify the sender's signature
+func (host *Host) openDirectMessage(envelope *DirectEnvelope) (*DirectMessage, error) {
+	hostKey := host.PeerKey()
+	if envelope.Recipient != hex.EncodeToString(hostKey[:]) {
+		return nil, fmt.Errorf("direct message is for another peer")
+	}
+	ephemeralBytes, err := hex.DecodeString(envelope.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralBytes)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(envelope.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := ed25519PrivateKeyToX25519(host.key)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := privateKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := directMessageCipher(shared, ephemeralBytes, privateKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	} else if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid direct message nonce")
+	}
+	plaintext, err := aead.Open(nil, nonce, envelope.Ciphertext, envelope.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("direct message failed to decrypt")
+	}
+
+	var payload directPayload
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, fmt.Errorf("expected a direct message payload")
+	}
+	signature, err := hex.DecodeString(payload.Signature)
+	if err != nil {
+		return nil, err
+	}
+	senderKey, err := RecoverPeerKeyFromPeerSignature(signature, payload.digest(envelope.ID, envelope.Recipient))
+	if err != nil {
+		return nil, err
+	}
+
+	// Messages older than the inbox remembers could be replayed
+	sentAt := time.UnixMilli(payload.Timestamp)
+	if time.Since(sentAt) > MailboxTTL {
+		return nil, fmt.Errorf("direct message has expired")
+	} else if time.Until(sentAt) > DirectMessageClockDrift {
+		return nil, fmt.Errorf("direct message is from the future")
+	}
+	return &DirectMessage{
+		ID:        envelope.ID,
+		From:      senderKey,
+		Data:      payload.Data,
+		Timestamp: sentAt,
+	}, nil
+}
+
+// Park a message in the recipient's mailboxes on the nodes closest to it's key.
+// Returns the number of nodes that stored it.
+func (host *Host) parkDirectMessage(recipientKey []byte, envelope *DirectEnvelope) int {
+	peers, err := host.FindClosestNodes(recipientKey)
+	if err != nil {
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	stored, queried := 0, 0
+	for _, peer := range peers {
+		if queried >= MailboxReplication {
+			break
+		} else if bytes.Equal(peer.Key(), recipientKey) {
+			continue
+		}
+		peerAddr, err := peer.Address()
+		if err != nil {
+			continue
+		}
+		queried++
+		wg.Add(1)
+		go func(peerAddr string) {
+			defer wg.Done()
+			if _, err := host.SendMessage(peerAddr, 1, MailboxPutMethod, envelope); err != nil {
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			stored++
+		}(peerAddr)
+	}
+	wg.Wait()
+	return stored
+}
+
+// Send a message to the peer with the key, encrypted end to end to the peer's public key.
+// The signed response of the recipient acknowledges delivery, unacknowledged sends are retried
+// and if the recipient stays unreachable the message is parked in it's mailboxes.
+func (host *Host) SendDirectMessage(peerKey []byte, data []byte) (DeliveryStatus, error) {
+	if len(peerKey) != PeerKeySize {
+		return 0, fmt.Errorf("invalid peer key length")
+	} else if len(data) > MaxDirectMessageSize {
+		return 0, fmt.Errorf("message exceeds max size of %d bytes", MaxDirectMessageSize)
+	}
+	record, err := host.findPeerRecord(peerKey)
+	if err != nil {
+		return 0, err
+	}
+	envelope, err := host.sealDirectMessage(record, data, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	address := record.PreferredAddress("")
+	if peer := host.table.Get(peerKey); peer != nil {
+		if peerAddr, err := peer.Address(); err == nil {
+			address = peerAddr
+		}
+	}
+	retryInterval := DirectMessageRetryInterval
+	for attempt := 0; attempt < DirectMessageAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryInterval)
+			retryInterval *= 2
+		}
+		if _, err := host.SendMessage(address, 1, DirectMessageMethod, envelope); err == nil {
+			return DeliveryAcknowledged, nil
+		}
+	}
+
+	if host.parkDirectMessage(peerKey, envelope) == 0 {
+		return 0, fmt.Errorf("peer is unreachable and no mailbox stored the message")
+	}
+	return DeliveryStored, nil
+}
+
+// Returns the channel direct messages sent to the host are delivered on
+func (host *Host) DirectMessages() <-chan *DirectMessage {
+	return host.inbox.messages
+}
+
+// Collect the messages parked in the host's mailboxes on the nodes closest to it.
+// Messages are only removed from the mailboxes once they're in the inbox,
+// messages that don't fit in the inbox are collected by a later check.
+// Envelopes that can't be opened are removed too so they don't take up the mailboxes.
+// Returns the number of new messages delivered.
+func (host *Host) CheckMailbox() (int, error) {
+	hostKey := host.PeerKey()
+	peers, err := host.FindClosestNodes(hostKey[:])
+	if err != nil {
+		return 0, err
+	}
+	if len(peers) > MailboxReplication {
+		peers = peers[:MailboxReplication]
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	envelopes := make([]*DirectEnvelope, 0)
+	mailboxEnvelopes := make(map[string][]*DirectEnvelope)
+	for _, peer := range peers {
+		peerAddr, err := peer.Address()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(peerAddr string) {
+			defer wg.Done()
+			response, err := host.SendMessage(peerAddr, 1, MailboxFetchMethod, nil)
+			if err != nil {
+				return
+			}
+			values, ok := response.([]interface{})
+			if !ok || len(values) > MaxMailboxSize {
+				host.recordAddressEvent(peerAddr, ScoreEventMalformedResponse)
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, value := range values {
+				envelope, err := parseDirectEnvelope(value)
+				if err != nil {
+					host.recordAddressEvent(peerAddr, ScoreEventMalformedResponse)
+					continue
+				}
+				envelopes = append(envelopes, envelope)
+				mailboxEnvelopes[peerAddr] = append(mailboxEnvelopes[peerAddr], envelope)
+			}
+		}(peerAddr)
+	}
+	wg.Wait()
+
+	// Every mailbox holds a copy, duplicates are dropped by the inbox
+	delivered := 0
+	inInbox := make(map[string]bool)
+	invalid := make(map[*DirectEnvelope]bool)
+	for _, envelope := range envelopes {
+		if inInbox[envelope.ID] {
+			continue
+		}
+		message, err := host.openDirectMessage(envelope)
+		if err != nil {
+			invalid[envelope] = true
+			continue
+		}
+		host.inbox.mutex.Lock()
+		_, seen := host.inbox.seen[message.ID]
+		host.inbox.mutex.Unlock()
+		if seen {
+			inInbox[envelope.ID] = true
+		} else if host.inbox.deliver(message) == nil {
+			inInbox[envelope.ID] = true
+			delivered++
+		}
+	}
+
+	// Acknowledge the messages in the inbox and the invalid envelopes so the mailboxes drop them
+	for peerAddr, parked := range mailboxEnvelopes {
+		acked := make([]string, 0)
+		for _, envelope := range parked {
+			if inInbox[envelope.ID] || invalid[envelope] {
+				acked = append(acked, envelope.ID)
+			}
+		}
+		if len(acked) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(peerAddr string, acked []string) {
+			defer wg.Done()
+			host.SendMessage(peerAddr, 1, MailboxAckMethod, acked)
+		}(peerAddr, acked)
+	}
+	wg.Wait()
+	return delivered, nil
+}
+
+// Handles direct_message requests carrying messages for the host.
+// A successful response acknowledges delivery, messages are refused while the inbox is full.
+func DirectMessageHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	envelope, err := parseDirectEnvelope(req.Data)
+	if err != nil {
+		return nil, err
+	}
+	message, err := host.openDirectMessage(envelope)
+	if err != nil {
+		host.scores.Record(remotePeer.Key(), ScoreEventInvalidSignature)
+		return nil, err
+	}
+	if err := host.inbox.deliver(message); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// Handles mailbox_put requests parking messages for offline peers
+func MailboxPutHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	envelope, err := parseDirectEnvelope(req.Data)
+	if err != nil {
+		return nil, err
+	}
+	if err := host.mailboxes.put(remotePeer.Key(), envelope); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// Handles mailbox_fetch requests which hand the caller the messages parked for it
+func MailboxFetchHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	return host.mailboxes.get(remotePeer.Key()), nil
+}
+
+// Handles mailbox_ack requests which remove the messages the caller collected from it's mailbox
+func MailboxAckHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	values, ok := req.Data.([]interface{})
+	if !ok || len(values) > MaxMailboxSize {
+		return nil, fmt.Errorf("expected a list of message ids")
+	}
+	ids := make([]string, 0, len(values))
+	for _, value := range values {
+		id, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a list of message ids")
+		}
+		ids = append(ids, id)
+	}
+	host.mailboxes.remove(remotePeer.Key(), ids)
+	return true, nil
+}
+
+// A long running service that collects messages parked in the host's mailboxes
+func (host *Host) startMailboxService() {
+	for !host.closed.Load() {
+		time.Sleep(MailboxCheckPeriod)
+		host.CheckMailbox()
+	}
+}
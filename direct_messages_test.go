@@ -0,0 +1,259 @@
+package coalition
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Wait for a direct message sent to the host
+func nextTestDirectMessage(t *testing.T, host *Host) *DirectMessage {
+	select {
+	case message := <-host.DirectMessages():
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a direct message")
+	}
+	return nil
+}
+
+func TestX25519KeyConversion(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		converted, err := ed25519PublicKeyToX25519(publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		derived, err := ed25519PrivateKeyToX25519(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !converted.Equal(derived.PublicKey()) {
+			t.Errorf("expected the converted public key to match the private key")
+		}
+	}
+}
+
+func TestDirectMessages(t *testing.T) {
+	_, recipientIdentity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := NewHost(ListenAddress("127.0.0.1"), Identity(recipientIdentity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go recipient.Listen()
+	hosts := newTestNetwork(t, 3)
+	for _, host := range hosts {
+		if err := recipient.Ping(testHostAddress(t, host)); err != nil {
+			t.Fatal(err)
+		}
+		waitForPeers(host, len(hosts))
+	}
+	sender := hosts[0]
+	senderKey := sender.PeerKey()
+	recipientKey := recipient.PeerKey()
+
+	// Online peers acknowledge messages sent to their key
+	status, err := sender.SendDirectMessage(recipientKey[:], []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	} else if status != DeliveryAcknowledged {
+		t.Errorf("expected the message to be acknowledged")
+	}
+	message := nextTestDirectMessage(t, recipient)
+	if string(message.Data) != "hello" || !bytes.Equal(message.From, senderKey[:]) {
+		t.Errorf("unexpected direct message %s from %x", message.Data, message.From)
+	}
+
+	// Messages only open for their recipient
+	record, err := sender.findPeerRecord(recipientKey[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := sender.sealDirectMessage(record, []byte("secret"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(envelope.Ciphertext, []byte("secret")) {
+		t.Errorf("expected the message to be encrypted")
+	}
+	if _, err := hosts[1].openDirectMessage(envelope); err == nil {
+		t.Errorf("expected other peers to fail opening the message")
+	}
+	envelope.Ciphertext[0] ^= 0xff
+	if _, err := recipient.openDirectMessage(envelope); err == nil {
+		t.Errorf("expected tampered messages to fail opening")
+	}
+
+	// Expired messages and messages from the future are refused
+	for _, sentAt := range []time.Time{time.Now().Add(-MailboxTTL - time.Minute), time.Now().Add(time.Hour)} {
+		envelope, err := sender.sealDirectMessage(record, []byte("replayed"), sentAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := recipient.openDirectMessage(envelope); err == nil {
+			t.Errorf("expected the message sent at %s to fail opening", sentAt)
+		}
+	}
+
+	// Messages to offline peers are parked in their mailboxes
+	recipient.Close()
+	status, err = sender.SendDirectMessage(recipientKey[:], []byte("while away"))
+	if err != nil {
+		t.Fatal(err)
+	} else if status != DeliveryStored {
+		t.Errorf("expected the message to be parked")
+	}
+
+	// Returning peers collect their messages once
+	returned := newTestHost(t, ListenAddress("127.0.0.1"), Identity(recipientIdentity))
+	if err := returned.Bootstrap(testHostAddress(t, hosts[1])); err != nil {
+		t.Fatal(err)
+	}
+	message = nextTestDirectMessage(t, returned)
+	if string(message.Data) != "while away" || !bytes.Equal(message.From, senderKey[:]) {
+		t.Errorf("unexpected direct message %s from %x", message.Data, message.From)
+	}
+	if delivered, err := returned.CheckMailbox(); err != nil {
+		t.Fatal(err)
+	} else if delivered != 0 {
+		t.Errorf("expected collected messages to be removed from the mailboxes")
+	}
+	for _, host := range hosts {
+		if parked := host.mailboxes.get(recipientKey[:]); len(parked) != 0 {
+			t.Errorf("expected acknowledged messages to be removed from the mailboxes")
+		}
+	}
+}
+
+func TestMailboxFullInbox(t *testing.T) {
+	hosts := newTestNetwork(t, 3)
+	recipient := newTestHost(t, ListenAddress("127.0.0.1"))
+	for _, host := range hosts {
+		if err := recipient.Ping(testHostAddress(t, host)); err != nil {
+			t.Fatal(err)
+		}
+		waitForPeers(host, len(hosts))
+	}
+	sender := hosts[0]
+	recipientKey := recipient.PeerKey()
+
+	// Fill up the recipient's inbox
+	for i := 0; i < DirectMessageBuffer; i++ {
+		if err := recipient.inbox.deliver(&DirectMessage{ID: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Park a message for the recipient
+	record, err := sender.findPeerRecord(recipientKey[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := sender.sealDirectMessage(record, []byte("parked"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := sender.parkDirectMessage(recipientKey[:], envelope); stored == 0 {
+		t.Fatal("expected the message to be parked")
+	}
+
+	// Messages that don't fit in the inbox stay in the mailboxes
+	if delivered, err := recipient.CheckMailbox(); err != nil {
+		t.Fatal(err)
+	} else if delivered != 0 {
+		t.Errorf("expected no messages to be delivered to a full inbox")
+	}
+	parked := 0
+	for _, host := range hosts {
+		parked += len(host.mailboxes.get(recipientKey[:]))
+	}
+	if parked == 0 {
+		t.Fatal("expected the message to stay in the mailboxes")
+	}
+
+	// Once there's room the message is delivered
+	for i := 0; i < DirectMessageBuffer; i++ {
+		nextTestDirectMessage(t, recipient)
+	}
+	if delivered, err := recipient.CheckMailbox(); err != nil {
+		t.Fatal(err)
+	} else if delivered != 1 {
+		t.Errorf("expected the parked message to be delivered, got %d", delivered)
+	}
+	if message := nextTestDirectMessage(t, recipient); string(message.Data) != "parked" {
+		t.Errorf("unexpected direct message %s", message.Data)
+	}
+	// Envelopes that can't be opened are removed from the mailboxes
+	envelope, err = sender.sealDirectMessage(record, []byte("tampered"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Ciphertext[0] ^= 0xff
+	if stored := sender.parkDirectMessage(recipientKey[:], envelope); stored == 0 {
+		t.Fatal("expected the message to be parked")
+	}
+	if delivered, err := recipient.CheckMailbox(); err != nil {
+		t.Fatal(err)
+	} else if delivered != 0 {
+		t.Errorf("expected the tampered message not to be delivered")
+	}
+	for _, host := range hosts {
+		if parked := host.mailboxes.get(recipientKey[:]); len(parked) != 0 {
+			t.Errorf("expected the tampered message to be removed from the mailboxes")
+		}
+	}
+}
+
+func TestMailboxSenderQuota(t *testing.T) {
+	store := newMailboxStore(MailboxTTL)
+	sender := make([]byte, PeerKeySize)
+	recipient := make([]byte, PeerKeySize)
+	envelope := func(id int, recipient []byte) *DirectEnvelope {
+		return &DirectEnvelope{ID: fmt.Sprint(id), Recipient: hex.EncodeToString(recipient)}
+	}
+
+	// A peer can only take up part of a mailbox
+	for i := 0; i < MaxMailboxSenderShare; i++ {
+		if err := store.put(sender, envelope(i, recipient)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.put(sender, envelope(MaxMailboxSenderShare, recipient)); err == nil {
+		t.Errorf("expected the peer's share of the mailbox to be full")
+	}
+	otherSender := make([]byte, PeerKeySize)
+	otherSender[0] = 1
+	if err := store.put(otherSender, envelope(MaxMailboxSenderShare, recipient)); err != nil {
+		t.Error(err)
+	}
+
+	// A peer can only park so many messages across mailboxes
+	id := MaxMailboxSenderShare + 1
+	for parked := MaxMailboxSenderShare; parked < MaxMailboxSenderSize; parked++ {
+		other := make([]byte, PeerKeySize)
+		other[0], other[1] = byte(id), byte(id>>8)
+		if err := store.put(sender, envelope(id, other)); err != nil {
+			t.Fatal(err)
+		}
+		id++
+	}
+	if err := store.put(sender, envelope(id, otherSender)); err == nil {
+		t.Errorf("expected the peer's quota to be used up")
+	}
+
+	// Collected messages free up the quota
+	store.remove(recipient, []string{"0"})
+	if err := store.put(sender, envelope(id, otherSender)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,154 @@
+package coalition
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Resolves dns names, satisfied by *net.Resolver
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Returns true if the name is a valid dns hostname
+func isHostname(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' {
+				return false
+			}
+		}
+	}
+
+	// Names ending with a numeric label would be mistaken for ip addresses
+	last := labels[len(labels)-1]
+	return strings.Trim(last, "0123456789") != ""
+}
+
+// Resolve a hostname to an ip4 address, ip addresses are returned as is
+func resolveIP4(resolver Resolver, host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr).To4(); ip != nil {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no ip4 address", host)
+}
+
+// Returns true if the address is a dnsaddr(dnsaddr://name) to be resolved to node addresses
+func IsDNSAddress(address string) bool {
+	return strings.HasPrefix(address, DNSAddrScheme)
+}
+
+// Resolve a dns name to node addresses from the TXT records of _dnsaddr.<name>.
+// Records hold a direct or relayed node address as dnsaddr=node://..., or point to
+// another name to resolve as dnsaddr=dnsaddr://name, nested up to DNSAddrMaxDepth deep.
+func ResolveDNSAddr(resolver Resolver, name string) ([]string, error) {
+	addrs := make([]string, 0)
+	seen := make(map[string]bool)
+	if err := resolveDNSAddr(resolver, strings.TrimPrefix(name, DNSAddrScheme), 0, seen, &addrs); err != nil {
+		return nil, err
+	} else if len(addrs) == 0 {
+		return nil, fmt.Errorf("no node addresses found for %s", name)
+	}
+	return addrs, nil
+}
+
+func resolveDNSAddr(resolver Resolver, name string, depth int, seen map[string]bool, addrs *[]string) error {
+	if depth >= DNSAddrMaxDepth {
+		return fmt.Errorf("dnsaddr %s is nested too deep", name)
+	} else if !isHostname(name) {
+		return fmt.Errorf("invalid dnsaddr name %s", name)
+	} else if seen[name] {
+		return nil
+	}
+	seen[name] = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	records, err := resolver.LookupTXT(ctx, DNSAddrPrefix+name)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		value := strings.TrimPrefix(record, DNSAddrRecordKey)
+		if value == record || len(*addrs) >= MaxDNSAddrAddresses {
+			continue
+		}
+
+		// Nested names that fail to resolve are skipped
+		if IsDNSAddress(value) {
+			resolveDNSAddr(resolver, strings.TrimPrefix(value, DNSAddrScheme), depth+1, seen, addrs)
+			continue
+		}
+		if _, _, _, err := ParsePeerAddress(value); err != nil || seen[value] {
+			continue
+		}
+		seen[value] = true
+		*addrs = append(*addrs, value)
+	}
+	return nil
+}
+
+// Resolve a dns name to node addresses with the host's resolver
+func (host *Host) ResolveDNSAddr(name string) ([]string, error) {
+	return ResolveDNSAddr(host.resolver, name)
+}
+
+// Join the network through the seeds, which are node addresses or dnsaddrs resolving to them.
+// Every seed address is pinged and the host then looks itself up to fill it's route table
+// and collects the messages parked for it while it was away.
+func (host *Host) Bootstrap(seeds ...string) error {
+	addrs := make([]string, 0)
+	for _, seed := range seeds {
+		if !IsDNSAddress(seed) {
+			if _, _, _, err := ParsePeerAddress(seed); err != nil {
+				return err
+			}
+			addrs = append(addrs, seed)
+			continue
+		}
+		resolved, err := host.ResolveDNSAddr(seed)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, resolved...)
+	}
+
+	reached := 0
+	for _, addr := range addrs {
+		if err := host.Ping(addr); err == nil {
+			reached++
+		}
+	}
+	if reached == 0 {
+		return fmt.Errorf("none of the bootstrap nodes could be reached")
+	}
+
+	hostKey := host.PeerKey()
+	if _, err := host.FindClosestNodes(hostKey[:]); err != nil {
+		return err
+	}
+	host.CheckMailbox()
+	return nil
+}
@@ -0,0 +1,104 @@
+package coalition
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A resolver answering from static records
+type stubResolver struct {
+	hosts map[string][]string
+	txt   map[string][]string
+}
+
+func (resolver *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, exists := resolver.hosts[host]; exists {
+		return addrs, nil
+	}
+	return nil, fmt.Errorf("no such host %s", host)
+}
+
+func (resolver *stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if records, exists := resolver.txt[name]; exists {
+		return records, nil
+	}
+	return nil, fmt.Errorf("no such host %s", name)
+}
+
+func TestResolveDNSAddr(t *testing.T) {
+	key := make([]byte, PeerKeySize)
+	addrA, _ := FormatNodeAddress(key, "198.51.100.1", 3000)
+	addrB, _ := FormatNodeAddress(key, "198.51.100.2", 3000)
+	resolver := &stubResolver{txt: map[string][]string{
+		"_dnsaddr.bootstrap.example.com": {
+			"dnsaddr=" + addrA,
+			"dnsaddr=dnsaddr://eu.bootstrap.example.com",
+			"dnsaddr=dnsaddr://missing.example.com",
+			"dnsaddr=node://invalid",
+			"v=spf1 -all",
+		},
+		"_dnsaddr.eu.bootstrap.example.com": {"dnsaddr=" + addrB, "dnsaddr=" + addrA},
+		"_dnsaddr.loop.example.com":         {"dnsaddr=dnsaddr://loop.example.com"},
+	}}
+
+	// Nested names are followed and invalid records are skipped
+	addrs, err := ResolveDNSAddr(resolver, "dnsaddr://bootstrap.example.com")
+	if err != nil {
+		t.Fatal(err)
+	} else if strings.Join(addrs, ",") != addrA+","+addrB {
+		t.Errorf("unexpected addresses %v", addrs)
+	}
+
+	// Names without addresses fail
+	if _, err := ResolveDNSAddr(resolver, "loop.example.com"); err == nil {
+		t.Errorf("expected names without addresses to fail")
+	}
+	if _, err := ResolveDNSAddr(resolver, "missing.example.com"); err == nil {
+		t.Errorf("expected unknown names to fail")
+	}
+}
+
+func TestHostnameAddresses(t *testing.T) {
+	server := newTestHost(t, ListenAddress("127.0.0.1"))
+	serverKey := server.PeerKey()
+	port, err := server.Port()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hostnames are kept in parsed addresses
+	hostnameAddr := fmt.Sprintf("node://%x@Seed.Example.com:%d", serverKey, port)
+	if _, host, _, err := ParseNodeAddress(hostnameAddr); err != nil {
+		t.Fatal(err)
+	} else if host != "seed.example.com" {
+		t.Errorf("expected the lower cased hostname, got %s", host)
+	}
+	for _, invalid := range []string{"-seed.example.com", "seed..example.com", "1.2.3", "seed_1.example.com"} {
+		if _, _, _, err := ParseNodeAddress(fmt.Sprintf("node://%x@%s:%d", serverKey, invalid, port)); err == nil {
+			t.Errorf("expected %s to be invalid", invalid)
+		}
+	}
+
+	// Hostnames are resolved when dialed and peers are stored by ip address
+	resolver := &stubResolver{
+		hosts: map[string][]string{"seed.example.com": {"::1", "127.0.0.1"}},
+		txt:   map[string][]string{"_dnsaddr.example.com": {"dnsaddr=" + hostnameAddr}},
+	}
+	client := newTestHost(t, ListenAddress("127.0.0.1"), DNSResolver(resolver))
+	if err := client.Bootstrap("dnsaddr://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	peer := client.RouteTable().Get(serverKey[:])
+	if peer == nil {
+		t.Fatal("expected the seed in the route table")
+	} else if peer.IPAddress() != "127.0.0.1" {
+		t.Errorf("expected the seed's resolved ip address, got %s", peer.IPAddress())
+	}
+
+	// Unresolvable hostnames fail to dial
+	if err := client.Ping(fmt.Sprintf("node://%x@unknown.example.com:%d", serverKey, port)); err == nil {
+		t.Errorf("expected unknown hostnames to fail")
+	}
+}
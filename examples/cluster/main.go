@@ -31,17 +31,9 @@ func main() {
 		}
 		fmt.Printf("Node listening on [%s]\n", addrs[0])
 
-		// Ping all boot nodes
-		for i := 0; i < len(bootNodes); i++ {
-			if err := host.Ping(bootNodes[i]); err != nil {
-				panic(err)
-			}
-		}
-
-		// Initiate a request to find closest nodes to itself
-		// It will attempt to connect to all nodes in it's path
-		hostKey := host.PeerKey()
-		if _, err := host.FindClosestNodes(hostKey[:]); err != nil {
+		// Ping all boot nodes and find the closest nodes to itself
+		// Boot nodes may be given as dnsaddr://name to be resolved from dns
+		if err := host.Bootstrap(bootNodes...); err != nil {
 			panic(err)
 		}
 		hosts = append(hosts, host)
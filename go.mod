@@ -1,3 +1,3 @@
 module github.com/the-code-genin/coalition-p2p
 
-go 1.19
+go 1.20
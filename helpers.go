@@ -1,7 +1,6 @@
 package coalition
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/ed25519"
 	"crypto/sha1"
@@ -13,6 +12,7 @@ import (
 	"net"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -40,7 +40,8 @@ func FormatNodeAddress(key []byte, addr string, port int) (string, error) {
 	return nodeAddr, nil
 }
 
-// Parse a node address(node://) into (peer key, ip4Address, port)
+// Parse a node address(node://) into (peer key, ip4Address, port).
+// Addresses may name the node by hostname instead, which is returned as is to be resolved at dial time.
 func ParseNodeAddress(address string) ([]byte, string, int, error) {
 	re, err := regexp.Compile(`^node\:\/\/([0-9A-f]+)\@(.+)\:(\d+)$`)
 	if err != nil {
@@ -61,21 +62,80 @@ func ParseNodeAddress(address string) ([]byte, string, int, error) {
 		return nil, "", 0, fmt.Errorf("invalid peer key")
 	}
 
+	port, err := strconv.Atoi(res[3])
+	if err != nil {
+		return nil, "", 0, err
+	}
+
 	ipAddress := net.ParseIP(res[2])
 	if ipAddress == nil {
-		return nil, "", 0, fmt.Errorf("invalid ip adddress")
+		if !isHostname(res[2]) {
+			return nil, "", 0, fmt.Errorf("invalid ip adddress or hostname")
+		}
+		return key, strings.ToLower(strings.TrimSuffix(res[2], ".")), port, nil
 	}
 	ip4Address := ipAddress.To4()
 	if ip4Address == nil {
 		return nil, "", 0, fmt.Errorf("invalid ip4 address")
 	}
 
-	port, err := strconv.Atoi(res[3])
+	return key, ip4Address.String(), port, nil
+}
+
+// Separates the relay's node address from the relayed peer's key in relayed node addresses
+const relayAddressSeparator = "/relay/"
+
+// Format a relayed node address(node://relaykey@ip:port/relay/peerkey) which reaches the peer
+// through the relay at the relay's node address
+func FormatRelayAddress(relayAddress string, key []byte) (string, error) {
+	if _, _, _, err := ParseNodeAddress(relayAddress); err != nil {
+		return "", err
+	} else if len(key) != PeerKeySize {
+		return "", fmt.Errorf("invalid peer key size")
+	}
+	return relayAddress + relayAddressSeparator + hex.EncodeToString(key), nil
+}
+
+// Returns true if the address is a relayed node address
+func IsRelayAddress(address string) bool {
+	return strings.Contains(address, relayAddressSeparator)
+}
+
+// Parse a relayed node address into (relay node address, peer key)
+func ParseRelayAddress(address string) (string, []byte, error) {
+	index := strings.LastIndex(address, relayAddressSeparator)
+	if index < 0 {
+		return "", nil, fmt.Errorf("invalid relay address")
+	}
+	relayAddress := address[:index]
+	if _, _, _, err := ParseNodeAddress(relayAddress); err != nil {
+		return "", nil, err
+	}
+
+	key, err := hex.DecodeString(address[index+len(relayAddressSeparator):])
 	if err != nil {
-		return nil, "", 0, err
+		return "", nil, err
+	} else if len(key) != PeerKeySize {
+		return "", nil, fmt.Errorf("invalid peer key")
 	}
+	return relayAddress, key, nil
+}
 
-	return key, ip4Address.String(), port, nil
+// Parse a direct or relayed node address into (peer key, ip4Address, port).
+// Relayed addresses are dialed on the relay's ip address and port.
+func ParsePeerAddress(address string) ([]byte, string, int, error) {
+	if !IsRelayAddress(address) {
+		return ParseNodeAddress(address)
+	}
+	relayAddress, key, err := ParseRelayAddress(address)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	_, ip4Address, port, err := ParseNodeAddress(relayAddress)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return key, ip4Address, port, nil
 }
 
 // Get this computer's public ip4 addresses
@@ -205,12 +265,21 @@ func WriteToConn(conn net.Conn, data []byte) error {
 
 // Reads a payload from the connection
 func ReadFromConn(conn net.Conn) ([]byte, error) {
-	conn.SetReadDeadline(time.Now().Add(TCPIODeadline))
-	requestReader := bufio.NewReader(conn)
+	return ReadFromConnWithTimeouts(conn, TCPIODeadline, TCPIODeadline)
+}
 
+// Reads a payload from the connection.
+// The payload size header must arrive within the header timeout,
+// after which the payload must arrive within the body timeout.
+func ReadFromConnWithTimeouts(
+	conn net.Conn,
+	headerTimeout time.Duration,
+	bodyTimeout time.Duration,
+) ([]byte, error) {
 	// Parse the size of the request payload in bytes
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
 	payloadSizeBuffer := make([]byte, 8)
-	_, err := io.ReadFull(requestReader, payloadSizeBuffer)
+	_, err := io.ReadFull(conn, payloadSizeBuffer)
 	if err != nil {
 		return nil, err
 	}
@@ -220,8 +289,9 @@ func ReadFromConn(conn net.Conn) ([]byte, error) {
 	}
 
 	// Read the payload from the connection
+	conn.SetReadDeadline(time.Now().Add(bodyTimeout))
 	payload := make([]byte, payloadSize)
-	_, err = io.ReadFull(requestReader, payload)
+	_, err = io.ReadFull(conn, payload)
 	if err != nil {
 		return nil, err
 	}
@@ -277,3 +347,109 @@ func ANDBytes(sliceA, sliceB []byte) []byte {
 	}
 	return output
 }
+
+// Returns the ip4 /24 or ip6 /48 subnet of an ip address.
+// Returns an empty string for invalid, loopback and private addresses which are exempt from diversity limits.
+func SubnetKey(ipAddress string) string {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(IP4SubnetPrefix, 32)), Mask: net.CIDRMask(IP4SubnetPrefix, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(IP6SubnetPrefix, 128)), Mask: net.CIDRMask(IP6SubnetPrefix, 128)}).String()
+}
+
+// Resolve an ip4 address or the first ip4 address of the named network interface
+func resolveListenAddress(address string) (string, error) {
+	if ip := net.ParseIP(address); ip != nil {
+		if ip.To4() == nil {
+			return "", fmt.Errorf("listen address must be an ip4 address")
+		}
+		return ip.To4().String(), nil
+	}
+
+	inface, err := net.InterfaceByName(address)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := inface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4().String(), nil
+		}
+	}
+	return "", fmt.Errorf("interface %s has no ip4 address", address)
+}
+
+// An address advertised in place of the host's interface addresses
+type announceAddress struct {
+	ipAddress string
+	port      int
+}
+
+// Parse an ip4 address with an optional port
+func parseAnnounceAddress(address string) (announceAddress, error) {
+	ipAddress, port := address, 0
+	if host, portStr, err := net.SplitHostPort(address); err == nil {
+		ipAddress = host
+		port, err = strconv.Atoi(portStr)
+		if err != nil || port < 1 || port > 65535 {
+			return announceAddress{}, fmt.Errorf("invalid announce address port %s", portStr)
+		}
+	}
+	ip := net.ParseIP(ipAddress)
+	if ip == nil || ip.To4() == nil {
+		return announceAddress{}, fmt.Errorf("invalid announce address %s", address)
+	}
+	return announceAddress{ip.To4().String(), port}, nil
+}
+
+// The scope of an ip address
+type AddressClass string
+
+const (
+	LoopbackAddress  AddressClass = "loopback"
+	LinkLocalAddress AddressClass = "link-local"
+	PrivateAddress   AddressClass = "private"
+	PublicAddress    AddressClass = "public"
+)
+
+// Classify an ip address as loopback, link-local, private or public
+func IPAddressClass(ipAddress string) AddressClass {
+	ip := net.ParseIP(ipAddress)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.IsLoopback():
+		return LoopbackAddress
+	case ip.IsLinkLocalUnicast():
+		return LinkLocalAddress
+	case ip.IsPrivate():
+		return PrivateAddress
+	}
+	return PublicAddress
+}
+
+// Keep at most limit peers from each subnet, preserving the order of the peers.
+// A limit below 1 keeps all peers.
+func LimitPeersPerSubnet(peers []*Peer, limit int64) []*Peer {
+	if limit < 1 {
+		return peers
+	}
+	output := make([]*Peer, 0)
+	counts := make(map[string]int64)
+	for _, peer := range peers {
+		subnet := SubnetKey(peer.IPAddress())
+		if subnet != "" && counts[subnet] >= limit {
+			continue
+		}
+		counts[subnet]++
+		output = append(output, peer)
+	}
+	return output
+}
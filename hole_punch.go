@@ -0,0 +1,224 @@
+package coalition
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Tracks when relayed peers were last hole punched so they aren't punched over and over
+type holePunchAttempts struct {
+	mutex    sync.Mutex
+	period   time.Duration
+	attempts map[string]time.Time
+}
+
+// Record an attempt on the peer
+func (attempts *holePunchAttempts) record(key []byte) {
+	attempts.mutex.Lock()
+	defer attempts.mutex.Unlock()
+	attempts.attempts[hex.EncodeToString(key)] = time.Now()
+}
+
+// Record an attempt on the peer if it wasn't attempted within the retry period
+func (attempts *holePunchAttempts) start(key []byte) bool {
+	attempts.mutex.Lock()
+	defer attempts.mutex.Unlock()
+
+	for hexKey, attempted := range attempts.attempts {
+		if time.Since(attempted) >= attempts.period {
+			delete(attempts.attempts, hexKey)
+		}
+	}
+	hexKey := hex.EncodeToString(key)
+	if _, exists := attempts.attempts[hexKey]; exists {
+		return false
+	}
+	attempts.attempts[hexKey] = time.Now()
+	return true
+}
+
+func newHolePunchAttempts(period time.Duration) *holePunchAttempts {
+	return &holePunchAttempts{
+		period:   period,
+		attempts: make(map[string]time.Time),
+	}
+}
+
+// Returns the direct addresses the host can be punched on.
+// Besides the host's own addresses, the relays holding its reservations
+// report the ip address its NAT maps connections to.
+func (host *Host) holePunchAddresses() ([]string, error) {
+	addrs, err := host.directAddresses()
+	if err != nil {
+		return nil, err
+	}
+	port, err := host.Port()
+	if err != nil {
+		return nil, err
+	}
+
+	key := host.PeerKey()
+	for _, ip := range host.relayReservations.observedIPs() {
+		addr, err := FormatNodeAddress(key[:], ip, port)
+		if err != nil {
+			return nil, err
+		}
+		exists := false
+		for _, existing := range addrs {
+			exists = exists || existing == addr
+		}
+		if !exists {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) > MaxHolePunchAddresses {
+		addrs = addrs[:MaxHolePunchAddresses]
+	}
+	return addrs, nil
+}
+
+// Parse the direct addresses of the peer to punch, ignoring those of other peers
+func (host *Host) parseHolePunchAddresses(key []byte, data interface{}) ([]string, error) {
+	values, ok := data.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of addresses")
+	}
+
+	addrs := make([]string, 0)
+	for _, value := range values {
+		addr, ok := value.(string)
+		if !ok || len(addrs) >= MaxHolePunchAddresses {
+			continue
+		}
+		addrKey, ip, _, err := ParseNodeAddress(addr)
+		if err != nil || net.ParseIP(ip) == nil || !bytes.Equal(addrKey, key) || !host.filter.AllowsPeer(key, ip) {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses to punch")
+	}
+	return addrs, nil
+}
+
+// Dial the peer's addresses from the host's listening port until one connects or hole punching times out.
+// Each dial opens the host's NAT to the peer, so whichever end dials second gets through.
+// The connections only punch holes and are closed right away.
+func (host *Host) punch(addrs []string) (string, error) {
+	port, err := host.Port()
+	if err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(HolePunchTimeout)
+	for time.Now().Before(deadline) && !host.closed.Load() {
+		for _, addr := range addrs {
+			_, ip, peerPort, err := ParseNodeAddress(addr)
+			if err != nil {
+				continue
+			}
+			conn, err := host.transport.DialFrom(port, ip, peerPort, HolePunchDialTimeout)
+			if err != nil {
+				continue
+			}
+			conn.Close()
+			return addr, nil
+		}
+		time.Sleep(HolePunchRetryInterval)
+	}
+	return "", fmt.Errorf("hole punching timed out")
+}
+
+// Upgrade the connection to a relayed peer to a direct one.
+// Both peers exchange their addresses over the relay and dial each other at once, so their
+// NATs let each other through. The peer is then pinged on the address that got through,
+// which switches it over from the relay in the route table.
+// Returns the peer's direct address.
+func (host *Host) HolePunch(relayedAddress string) (string, error) {
+	if !IsRelayAddress(relayedAddress) {
+		return "", fmt.Errorf("only relayed peers can be hole punched")
+	}
+	_, key, err := ParseRelayAddress(relayedAddress)
+	if err != nil {
+		return "", err
+	}
+	host.holePunches.record(key)
+
+	addrs, err := host.holePunchAddresses()
+	if err != nil {
+		return "", err
+	}
+	response, err := host.SendMessage(relayedAddress, 1, HolePunchMethod, addrs)
+	if err != nil {
+		return "", err
+	}
+	peerAddrs, err := host.parseHolePunchAddresses(key, response)
+	if err != nil {
+		return "", err
+	}
+
+	addr, err := host.punch(peerAddrs)
+	if err != nil {
+		return "", err
+	}
+	if err := host.Ping(addr); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
+
+// Keep the addresses of a relayed peer that it's known to be on, those in it's verified peer record
+// and those on the ip address the relay sees it on, so peers can't make the host dial arbitrary targets
+func (host *Host) verifiedHolePunchAddresses(remotePeer *Peer, record *PeerRecord, addrs []string) []string {
+	known := make(map[string]bool)
+	if record != nil {
+		if key, err := record.Verify(host.recordTTL); err == nil && bytes.Equal(key, remotePeer.Key()) {
+			for _, addr := range record.Addresses {
+				known[addr] = true
+			}
+		}
+	}
+	observedIP, _, err := net.SplitHostPort(remotePeer.ObservedAddress())
+	if err != nil {
+		observedIP = ""
+	}
+
+	verified := make([]string, 0)
+	for _, addr := range addrs {
+		_, ip, _, err := ParseNodeAddress(addr)
+		if err != nil {
+			continue
+		} else if known[addr] || (observedIP != "" && ip == observedIP) {
+			verified = append(verified, addr)
+		}
+	}
+	return verified
+}
+
+// Handles hole_punch requests from relayed peers upgrading to a direct connection.
+// Only requests over a relay are accepted and each peer is punched at most once per retry period.
+// The host punches the peer's addresses in the background and returns its own for the peer to punch.
+func HolePunchHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	if !host.holePunching {
+		return nil, fmt.Errorf("hole punching is disabled")
+	} else if remotePeer.Relay() == "" {
+		return nil, fmt.Errorf("hole punching is only accepted over a relay")
+	}
+	addrs, err := host.parseHolePunchAddresses(remotePeer.Key(), req.Data)
+	if err != nil {
+		return nil, err
+	}
+	addrs = host.verifiedHolePunchAddresses(remotePeer, req.Record, addrs)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no verified addresses to punch")
+	} else if !host.holePunches.start(remotePeer.Key()) {
+		return nil, fmt.Errorf("peer was hole punched recently")
+	}
+	go host.punch(addrs)
+	return host.holePunchAddresses()
+}
@@ -6,9 +6,14 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	mathrand "math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,12 +22,51 @@ type Host struct {
 	listener           net.Listener
 	table              *RouteTable
 	key                ed25519.PrivateKey
+	rpcMutex           sync.RWMutex
 	rpcHandlers        RPCHandlerFuncMap
-	closed             bool
+	closed             atomic.Bool
 	maxPeers           int64
 	pingPeriod         int64
 	latencyPeriod      int64
 	concurrentRequests int64
+	handlerLimiter     *handlerLimiter
+	connLimiter        *connLimiter
+	headerReadTimeout  time.Duration
+	rateLimiter        *RateLimiter
+	filter             *PeerFilter
+	networkKey         []byte
+	replayCache        *replayCache
+	puzzleDifficulty   puzzleDifficulty
+	puzzleSolution     []byte
+	disjointPaths      int
+	subnetLimits       subnetLimits
+	scores             *Scoreboard
+	scoreThreshold     float64
+	recordTTL          time.Duration
+	recordMutex        sync.Mutex
+	record             *PeerRecord
+	dialBack           *dialBackService
+	rpcVersions        map[string]int
+	agentVersion       string
+	observedAddrs      *observedAddrBook
+	listenIP           string
+	announceAddrs      []announceAddress
+	excludedAddrs      map[AddressClass]bool
+	nat                *natManager
+	relay              *relayService
+	relayReservations  *relayReservations
+	transport          Transport
+	holePunching       bool
+	holePunches        *holePunchAttempts
+	localDiscovery     *localDiscovery
+	resolver           Resolver
+	providers          *providerStore
+	pubsub             *pubSub
+	mailboxes          *mailboxStore
+	inbox              *directInbox
+	streamMutex        sync.Mutex
+	streamHandlers     map[string]StreamHandlerFunc
+	blocks             BlockStore
 }
 
 // Return the host's ed25519 public key
@@ -44,13 +88,24 @@ func (host *Host) Port() (int, error) {
 	return tcpAddr.Port, nil
 }
 
-// Return the host's peer addresses
+// Return the host's peer addresses, direct addresses followed by relayed addresses
 func (host *Host) Addresses() ([]string, error) {
-	ipAddrs, err := GetPublicIP4Addresses()
+	addrs, err := host.directAddresses()
 	if err != nil {
-		return nil, nil
+		return nil, err
+	}
+	relayedAddrs, err := host.relayedAddresses()
+	if err != nil {
+		return nil, err
 	}
+	return append(addrs, relayedAddrs...), nil
+}
 
+// Return the host's direct peer addresses.
+// Announce addresses replace the discovered ones, otherwise the listening ip address
+// or every interface address is advertised along with the gateway's mapped address
+// and observed public addresses.
+func (host *Host) directAddresses() ([]string, error) {
 	port, err := host.Port()
 	if err != nil {
 		return nil, nil
@@ -59,16 +114,119 @@ func (host *Host) Addresses() ([]string, error) {
 	key := host.PeerKey()
 
 	res := make([]string, 0)
+	if len(host.announceAddrs) > 0 {
+		for _, addr := range host.announceAddrs {
+			announcePort := addr.port
+			if announcePort == 0 {
+				announcePort = port
+			}
+			nodeAddr, err := FormatNodeAddress(key[:], addr.ipAddress, announcePort)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, nodeAddr)
+		}
+		return res, nil
+	}
+
+	// A host bound to a single ip address is only reachable on it
+	ipAddrs := []string{host.listenIP}
+	if net.ParseIP(host.listenIP).IsUnspecified() {
+		ipAddrs, err = GetPublicIP4Addresses()
+		if err != nil {
+			return nil, nil
+		}
+	}
+	hostAddrs := make([]announceAddress, 0)
 	for _, ipAddr := range ipAddrs {
-		nodeAddr, err := FormatNodeAddress(key[:], ipAddr, port)
+		hostAddrs = append(hostAddrs, announceAddress{ipAddr, port})
+	}
+
+	// Add the gateway's external address when the port is mapped
+	if mapping := host.nat.current(); mapping != nil {
+		hostAddrs = append(hostAddrs, announceAddress{mapping.ExternalIP, mapping.ExternalPort})
+	}
+
+	// Add the public addresses peers agree they observe the host from
+	for _, ipAddr := range host.observedAddrs.confirmed() {
+		hostAddrs = append(hostAddrs, announceAddress{ipAddr, port})
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range hostAddrs {
+		if !host.advertises(addr.ipAddress) {
+			continue
+		}
+		nodeAddr, err := FormatNodeAddress(key[:], addr.ipAddress, addr.port)
 		if err != nil {
 			return nil, err
+		} else if seen[nodeAddr] {
+			continue
 		}
+		seen[nodeAddr] = true
 		res = append(res, nodeAddr)
 	}
 	return res, nil
 }
 
+// Returns false for ip addresses in classes excluded from being advertised
+func (host *Host) advertises(ipAddress string) bool {
+	return !host.excludedAddrs[IPAddressClass(ipAddress)]
+}
+
+// Returns true if a peer record has at least one address that may be advertised
+func (host *Host) advertisesRecord(record *PeerRecord) bool {
+	for _, address := range record.Addresses {
+		_, ip, _, err := ParsePeerAddress(address)
+		if err == nil && host.advertises(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the host's current addresses as a record signed by the host's key.
+// The record is re-signed when the addresses change or it's half way to expiry.
+func (host *Host) PeerRecord() (*PeerRecord, error) {
+	addrs, err := host.Addresses()
+	if err != nil {
+		return nil, err
+	}
+
+	host.recordMutex.Lock()
+	defer host.recordMutex.Unlock()
+
+	if record := host.record; record != nil {
+		signedAt := time.Unix(0, int64(record.Seq))
+		sameAddrs := len(addrs) == len(record.Addresses)
+		for i := 0; sameAddrs && i < len(addrs); i++ {
+			sameAddrs = addrs[i] == record.Addresses[i]
+		}
+		if sameAddrs && time.Since(signedAt) < host.recordTTL/2 {
+			return record, nil
+		}
+	}
+
+	record, err := NewPeerRecord(host.key, addrs)
+	if err != nil {
+		return nil, err
+	}
+	host.record = record
+	return record, nil
+}
+
+// Store a peer's signed record with it's route table entry if the record is valid
+func (host *Host) storePeerRecord(peerKey []byte, record *PeerRecord) {
+	if record == nil {
+		return
+	}
+	recordKey, err := record.Verify(host.recordTTL)
+	if err != nil || !bytes.Equal(recordKey, peerKey) {
+		return
+	}
+	host.table.SetRecord(peerKey, record)
+}
+
 // Generate a peer signature from a digest by signing with the host's private key
 func (host *Host) Sign(digest []byte) ([PeerSignatureSize]byte, error) {
 	output := *new([PeerSignatureSize]byte)
@@ -91,40 +249,151 @@ func (host *Host) RouteTable() *RouteTable {
 
 // Start listening for connections on the specified port for RPC requests
 func (host *Host) Listen() {
-	for !host.closed {
+	backoff := time.Duration(0)
+	for !host.closed.Load() {
 		conn, err := host.listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// Back off on accept errors such as running out of file descriptors
+			if backoff == 0 {
+				backoff = MinAcceptBackoff
+			} else if backoff *= 2; backoff > MaxAcceptBackoff {
+				backoff = MaxAcceptBackoff
+			}
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		// Drop connections from filtered ip addresses or over the inbound limits
+		ip := remoteIP(conn)
+		if !host.filter.AllowsIP(ip) {
+			conn.Close()
+			continue
+		} else if !host.connLimiter.acquire(ip) {
+			conn.Close()
 			continue
 		}
-		go HandleRPCConnection(host, conn)
+		go func(conn net.Conn) {
+			defer host.connLimiter.release(ip)
+			HandleRPCConnection(host, conn)
+		}(conn)
 	}
 }
 
-// Send a message to the node at the address
-func (host *Host) SendMessage(
-	address string,
-	version int,
-	method string,
-	data interface{},
-) (interface{}, error) {
-	// Parse the node address
-	remotePeerKey, remoteIP4Address, remotePort, err := ParseNodeAddress(address)
+// Returns the host's inbound RPC rate limiter
+func (host *Host) RateLimiter() *RateLimiter {
+	return host.rateLimiter
+}
+
+// Returns the host's peer reputation scores
+func (host *Host) Scores() *Scoreboard {
+	return host.scores
+}
+
+// Returns the host's peer filter
+func (host *Host) Filter() *PeerFilter {
+	return host.filter
+}
+
+// Returns the last known reachability of a peer.
+// Peers are public once they've answered an RPC request on their advertised address.
+func (host *Host) Reachability(peerKey []byte) Reachability {
+	return host.dialBack.status(peerKey)
+}
+
+// Returns the host's port mapping on the gateway, nil if the port isn't mapped
+func (host *Host) PortMapping() *PortMapping {
+	return host.nat.current()
+}
+
+// Dial a peer's ip address and port.
+// Within a private network the connection is upgraded after a successful handshake.
+func (host *Host) dial(ipAddress string, port int) (net.Conn, error) {
+	conn, err := host.transport.Dial(ipAddress, port, DialTimeout)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if host.networkKey == nil {
+		return conn, nil
 	}
 
-	// Dial node
-	conn, err := net.Dial("tcp4", fmt.Sprintf("%s:%d", remoteIP4Address, remotePort))
+	privateConn, err := PrivateNetworkClient(conn, host.networkKey)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
-	defer conn.Close()
+	return privateConn, nil
+}
+
+// Insert/update a peer in the route table if the peer filter allows it.
+// Relayed peers are inserted with the relay's ip address and port and node address.
+func (host *Host) insertPeer(key []byte, ipAddress string, port int, relay string) (bool, error) {
+	if !host.filter.AllowsPeer(key, ipAddress) {
+		return false, nil
+	}
+	inserted, err := host.table.Insert(key, ipAddress, port)
+	if err != nil || !inserted {
+		return inserted, err
+	}
+	host.table.SetRelay(key, relay)
+	return true, nil
+}
+
+// Returns the host's dynamic crypto puzzle solution as hex
+func (host *Host) puzzleSolutionHex() string {
+	if host.puzzleSolution == nil {
+		return ""
+	}
+	return hex.EncodeToString(host.puzzleSolution)
+}
+
+// Verify a remote peer key solves the static and dynamic crypto puzzles
+func (host *Host) verifyPeerPuzzles(peerKey []byte, solutionHex string) error {
+	if !VerifyStaticPuzzle(peerKey, host.puzzleDifficulty.static) {
+		return fmt.Errorf("peer key does not solve the static crypto puzzle")
+	}
+	solution, err := hex.DecodeString(solutionHex)
+	if err != nil || !VerifyDynamicPuzzle(peerKey, solution, host.puzzleDifficulty.dynamic) {
+		return fmt.Errorf("peer key does not solve the dynamic crypto puzzle")
+	}
+	return nil
+}
 
+// Returns the number of inbound connections currently being served
+func (host *Host) InboundConnections() int64 {
+	return host.connLimiter.count()
+}
+
+// Prepare a signed request payload addressed to the remote peer
+func (host *Host) prepareRequest(
+	remotePeerKey []byte,
+	version int,
+	method string,
+	data interface{},
+) ([]byte, error) {
 	// Prepare serialized request
+	// The nonce, timestamp and recipient bind the signature to this exchange
+	nonce := make([]byte, RequestNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	record, err := host.PeerRecord()
+	if err != nil {
+		return nil, err
+	}
 	serializedRequest, err := json.Marshal(&RPCRequest{
 		version,
 		method,
 		data,
+		hex.EncodeToString(nonce),
+		time.Now().UnixMilli(),
+		hex.EncodeToString(remotePeerKey),
+		host.puzzleSolutionHex(),
+		record,
 	})
 	if err != nil {
 		return nil, err
@@ -148,18 +417,96 @@ func (host *Host) SendMessage(
 	requestPayload = append(requestPayload, Uint64ToBytes(uint64(hostPort))...)
 	requestPayload = append(requestPayload, requestSignature[:]...)
 	requestPayload = append(requestPayload, serializedRequest...)
+	return requestPayload, nil
+}
+
+// Send a message to the node at the address
+func (host *Host) SendMessage(
+	address string,
+	version int,
+	method string,
+	data interface{},
+) (interface{}, error) {
+	response, conn, err := host.sendRequest(address, version, method, data)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return response, nil
+}
+
+// Send a request to the node at a direct or relayed address.
+// On success the connection is returned open for methods that keep using it after the response.
+func (host *Host) sendRequest(
+	address string,
+	version int,
+	method string,
+	data interface{},
+) (interface{}, net.Conn, error) {
+	// Parse the node address
+	relayAddress := ""
+	if IsRelayAddress(address) {
+		var err error
+		if relayAddress, _, err = ParseRelayAddress(address); err != nil {
+			return nil, nil, err
+		}
+	} else if _, _, _, err := ParseNodeAddress(address); err != nil {
+		return nil, nil, err
+	}
+	remotePeerKey, remoteHost, remotePort, err := ParsePeerAddress(address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Hostnames are resolved at dial time
+	remoteIP4Address, err := resolveIP4(host.resolver, remoteHost)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Refuse to contact filtered peers
+	if !host.filter.AllowsPeer(remotePeerKey, remoteIP4Address) {
+		return nil, nil, fmt.Errorf("peer is blocked by the peer filter")
+	}
+
+	// Dial node, relayed peers are reached through a circuit on the relay
+	var conn net.Conn
+	if relayAddress != "" {
+		conn, err = host.dialRelayed(relayAddress, remotePeerKey)
+	} else {
+		conn, err = host.dial(remoteIP4Address, remotePort)
+	}
+	if err != nil {
+		host.scores.Record(remotePeerKey, ScoreEventUnreachable)
+		return nil, nil, err
+	}
+	keepOpen := false
+	defer func() {
+		if !keepOpen {
+			conn.Close()
+		}
+	}()
+
+	// Prepare the signed request payload
+	requestPayload, err := host.prepareRequest(remotePeerKey, version, method, data)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Send the request
 	if err := WriteToConn(conn, requestPayload); err != nil {
-		return nil, err
+		host.scores.Record(remotePeerKey, connErrorScoreEvent(err))
+		return nil, nil, err
 	}
 
 	// Read the payload from the connection
 	responsePayload, err := ReadFromConn(conn)
 	if err != nil {
-		return nil, err
+		host.scores.Record(remotePeerKey, connErrorScoreEvent(err))
+		return nil, nil, err
 	} else if len(responsePayload) <= PeerSignatureSize {
-		return nil, fmt.Errorf("incomplete response body")
+		host.scores.Record(remotePeerKey, ScoreEventMalformedResponse)
+		return nil, nil, fmt.Errorf("incomplete response body")
 	}
 
 	// Parse the peer signature and response from the response payload
@@ -170,43 +517,113 @@ func (host *Host) SendMessage(
 	responseHash := sha256.Sum256(peerResponse)
 	peerKey, err := RecoverPeerKeyFromPeerSignature(peerSignature, responseHash[:])
 	if err != nil {
-		return nil, err
+		host.scores.Record(remotePeerKey, ScoreEventInvalidSignature)
+		return nil, nil, err
 	} else if !bytes.Equal(peerKey, remotePeerKey) {
-		return nil, fmt.Errorf("peer key in address does not match peer key in response")
+		host.scores.Record(remotePeerKey, ScoreEventInvalidSignature)
+		return nil, nil, fmt.Errorf("peer key in address does not match peer key in response")
+	}
+
+	// Parse the RPC response from the payload
+	var response RPCResponse
+	if err = json.Unmarshal(peerResponse, &response); err != nil {
+		host.scores.Record(remotePeerKey, ScoreEventMalformedResponse)
+		return nil, nil, err
+	}
+
+	// Verify the remote peer key solves the crypto puzzles
+	if err := host.verifyPeerPuzzles(peerKey, response.Puzzle); err != nil {
+		host.scores.Record(remotePeerKey, ScoreEventInvalidSignature)
+		return nil, nil, err
+	}
+	host.scores.Record(remotePeerKey, ScoreEventSuccess)
+
+	// Relayed peers answering through the relay aren't publicly reachable
+	reachability := ReachabilityPublic
+	if relayAddress != "" {
+		reachability = ReachabilityPrivate
 	}
+	host.dialBack.record(remotePeerKey, remoteIP4Address, remotePort, reachability)
 
 	// Update the host's route table
-	_, err = host.table.Insert(
+	_, err = host.insertPeer(
 		remotePeerKey,
 		remoteIP4Address,
 		remotePort,
+		relayAddress,
 	)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	host.storePeerRecord(remotePeerKey, response.Record)
 
-	// Parse the RPC response from the payload
-	var response RPCResponse
-	if err = json.Unmarshal(peerResponse, &response); err != nil {
-		return nil, err
-	} else if !response.Success {
-		return nil, fmt.Errorf(response.Data.(string))
+	if !response.Success {
+		message, ok := response.Data.(string)
+		if !ok {
+			message = "rpc request failed"
+		}
+		return nil, nil, &RPCError{response.Code, message}
+	}
+
+	// Try to upgrade relayed peers to a direct connection
+	if relayAddress != "" && host.holePunching && host.holePunches.start(remotePeerKey) {
+		go host.HolePunch(address)
 	}
-	return response.Data, nil
+	keepOpen = true
+	return response.Data, conn, nil
 }
 
-// Registers a new RPC method or overrites an existing method
+// Registers a new RPC method or overrites an existing method.
+// New methods are registered as version 1, overwritten methods keep their version.
 func (host *Host) RegisterRPCMethod(
 	methodName string,
 	handler RPCHandlerFunc,
 ) {
+	host.rpcMutex.Lock()
+	defer host.rpcMutex.Unlock()
+	version, exists := host.rpcVersions[methodName]
+	if !exists {
+		version = 1
+	}
 	host.rpcHandlers[methodName] = handler
+	host.rpcVersions[methodName] = version
+}
+
+// Registers a new RPC method or overrites an existing method with the latest version it supports
+func (host *Host) RegisterVersionedRPCMethod(
+	methodName string,
+	version int,
+	handler RPCHandlerFunc,
+) {
+	host.rpcMutex.Lock()
+	defer host.rpcMutex.Unlock()
+	host.rpcHandlers[methodName] = handler
+	host.rpcVersions[methodName] = version
+}
+
+// Returns the handler registered for an RPC method
+func (host *Host) rpcHandler(methodName string) (RPCHandlerFunc, bool) {
+	host.rpcMutex.RLock()
+	defer host.rpcMutex.RUnlock()
+	handler, exists := host.rpcHandlers[methodName]
+	return handler, exists
+}
+
+// Returns the registered RPC methods with the latest version each supports
+func (host *Host) RPCMethods() map[string]int {
+	host.rpcMutex.RLock()
+	defer host.rpcMutex.RUnlock()
+	methods := make(map[string]int)
+	for method, version := range host.rpcVersions {
+		methods[method] = version
+	}
+	return methods
 }
 
 // A long running service that pings all peers within it's route table
 // It only pings the peer if it's last seen interval is greater than the ping period
 func (host *Host) startPingService() {
-	for !host.closed {
+	for !host.closed.Load() {
 		for _, peer := range host.RouteTable().Peers() {
 			if time.Now().Unix()-peer.LastSeen() < host.pingPeriod {
 				continue
@@ -221,9 +638,70 @@ func (host *Host) startPingService() {
 	}
 }
 
+// A long running service that dials back inbound peers to check they accept RPC requests.
+// Peers answering the ping are inserted into the route table by SendMessage.
+func (host *Host) startDialBackService() {
+	for !host.closed.Load() {
+		select {
+		case request := <-host.dialBack.queue:
+			// Peers may have been reached by the host since they were queued
+			if _, fresh := host.dialBack.lookup(request.key, request.ipAddress, request.port); fresh {
+				continue
+			}
+			address, err := FormatNodeAddress(request.key, request.ipAddress, request.port)
+			if err == nil {
+				err = host.Ping(address)
+			}
+
+			// Peers returning an error response are reachable and already recorded
+			if _, ok := err.(*RPCError); err != nil && !ok {
+				host.dialBack.record(request.key, request.ipAddress, request.port, ReachabilityPrivate)
+			}
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// A long running service that identifies random peers within it's route table
+// to learn the host's public addresses from how the peers observe it
+func (host *Host) startIdentifyService() {
+	for !host.closed.Load() {
+		peers := host.RouteTable().Peers()
+		for i, index := range mathrand.Perm(len(peers)) {
+			if i >= IdentifyPeers {
+				break
+			}
+			peerAddr, err := peers[index].Address()
+			if err != nil {
+				continue
+			}
+			host.Identify(peerAddr)
+		}
+
+		// Retry sooner while no public address has been confirmed
+		if len(host.observedAddrs.confirmed()) == 0 {
+			time.Sleep(IdentifyPeriod / 10)
+		} else {
+			time.Sleep(IdentifyPeriod)
+		}
+	}
+}
+
+// A long running service that keeps the host's port mapped on the gateway
+func (host *Host) startPortMappingService() {
+	for !host.closed.Load() {
+		port, err := host.Port()
+		if err != nil {
+			return
+		}
+		wait, _ := host.nat.renew(port)
+		time.Sleep(wait)
+	}
+}
+
 // A long running service that prunes inactive peers within it's route table
 func (host *Host) startLatencyPruneService() {
-	for !host.closed {
+	for !host.closed.Load() {
 		for _, peer := range host.RouteTable().Peers() {
 			if time.Now().Unix()-peer.LastSeen() < host.latencyPeriod {
 				continue
@@ -236,22 +714,54 @@ func (host *Host) startLatencyPruneService() {
 
 // Close the host and any associated resources
 func (host *Host) Close() {
-	host.closed = true
+	host.closed.Store(true)
 	host.listener.Close()
+	host.nat.close()
+	host.relayReservations.close()
+	host.localDiscovery.close()
 }
 
 // Create a new P2P host
 func NewHost(
 	options ...Option,
 ) (*Host, error) {
+	// Parse the crypto puzzle difficulties and the host's solution
+	difficulty, _ := getOption(CryptoPuzzleOption, options, puzzleDifficulty{}).(puzzleDifficulty)
+	solution, _ := getOption(PuzzleSolutionOption, options, []byte(nil)).([]byte)
+	if err := validatePuzzleDifficulty(difficulty.static); err != nil {
+		return nil, err
+	} else if err := validatePuzzleDifficulty(difficulty.dynamic); err != nil {
+		return nil, err
+	}
+
 	// Parse the peer private key
+	// Generated identities solve the crypto puzzles
 	key, ok := getOption(PrivateKeyOption, options, nil).(ed25519.PrivateKey)
 	if !ok {
-		_, privKey, err := ed25519.GenerateKey(rand.Reader)
+		privKey, privKeySolution, err := GenerateIdentity(difficulty.static, difficulty.dynamic)
 		if err != nil {
 			return nil, err
 		}
 		key = privKey
+		if solution == nil && difficulty.dynamic > 0 {
+			solution = privKeySolution
+		}
+	}
+
+	// Ensure the host's own identity solves the crypto puzzles
+	hostKey := sha1.Sum([]byte(key.Public().(ed25519.PublicKey)))
+	if !VerifyStaticPuzzle(hostKey[:], difficulty.static) {
+		return nil, fmt.Errorf("identity does not solve the static crypto puzzle")
+	}
+	if solution == nil && difficulty.dynamic > 0 {
+		hostSolution, err := SolveDynamicPuzzle(hostKey[:], difficulty.dynamic)
+		if err != nil {
+			return nil, err
+		}
+		solution = hostSolution
+	}
+	if !VerifyDynamicPuzzle(hostKey[:], solution, difficulty.dynamic) {
+		return nil, fmt.Errorf("puzzle solution does not solve the dynamic crypto puzzle")
 	}
 
 	// Parse the kademlia parameters
@@ -266,6 +776,108 @@ func NewHost(
 	} else if concurrentRequests > maxPeers {
 		return nil, fmt.Errorf("concurrent requests must be <= max peers")
 	}
+	disjointPaths := getOption(DisjointPathsOption, options, DefaultDisjointPaths).(int)
+	if disjointPaths < 1 {
+		return nil, fmt.Errorf("disjoint paths must be >= 1")
+	}
+	diversity := getOption(
+		SubnetLimitsOption,
+		options,
+		subnetLimits{DefaultMaxPeersPerSubnetBucket, DefaultMaxPeersPerSubnetTable},
+	).(subnetLimits)
+
+	// Parse the RPC handler concurrency limits
+	maxHandlers := getOption(MaxConcurrentHandlersOption, options, DefaultMaxConcurrentHandlers).(int64)
+	queueTimeout := getOption(HandlerQueueTimeoutOption, options, DefaultHandlerQueueTimeout).(time.Duration)
+	methodLimits := make([]methodLimit, 0)
+	for _, limit := range getOptions(MethodConcurrencyOption, options) {
+		methodLimits = append(methodLimits, limit.(methodLimit))
+	}
+	limiter, err := newHandlerLimiter(maxHandlers, methodLimits, queueTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the inbound connection limits
+	maxInbound := getOption(MaxInboundConnectionsOption, options, DefaultMaxInboundConnections).(int64)
+	maxPerIP := getOption(MaxConnectionsPerIPOption, options, DefaultMaxConnectionsPerIP).(int64)
+	headerReadTimeout := getOption(HeaderReadTimeoutOption, options, DefaultHeaderReadTimeout).(time.Duration)
+	connLimiter, err := newConnLimiter(maxInbound, maxPerIP)
+	if err != nil {
+		return nil, err
+	} else if headerReadTimeout <= 0 {
+		return nil, fmt.Errorf("header read timeout must be > 0")
+	}
+
+	// Parse the inbound RPC rate limits
+	peerRateLimits := make(map[string]RateLimit)
+	for method, limit := range DefaultPeerRateLimits {
+		peerRateLimits[method] = limit
+	}
+	for _, limit := range getOptions(PeerRateLimitOption, options) {
+		peerRateLimits[limit.(methodRateLimit).method] = limit.(methodRateLimit).limit
+	}
+	ipRateLimits := make(map[string]RateLimit)
+	for method, limit := range DefaultIPRateLimits {
+		ipRateLimits[method] = limit
+	}
+	for _, limit := range getOptions(IPRateLimitOption, options) {
+		ipRateLimits[limit.(methodRateLimit).method] = limit.(methodRateLimit).limit
+	}
+	rateLimiter, err := NewRateLimiter(peerRateLimits, ipRateLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the peer filter
+	filter, ok := getOption(PeerFilterOption, options, nil).(*PeerFilter)
+	if !ok {
+		filter, err = NewPeerFilter("")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse the private network key
+	networkKey, _ := getOption(PrivateNetworkOption, options, []byte(nil)).([]byte)
+	if networkKey != nil && len(networkKey) != PrivateNetworkKeySize {
+		return nil, fmt.Errorf("private network key must be %d bytes", PrivateNetworkKeySize)
+	}
+
+	// Parse the replay protection parameters
+	replayWindow := getOption(ReplayWindowOption, options, DefaultReplayWindow).(time.Duration)
+	replayCacheSize := getOption(ReplayCacheSizeOption, options, DefaultReplayCacheSize).(int64)
+	replayCache, err := newReplayCache(replayWindow, replayCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the peer scoring parameters
+	scoreHalfLife := getOption(ScoreHalfLifeOption, options, DefaultScoreHalfLife).(time.Duration)
+	scoreThreshold := getOption(ScoreThresholdOption, options, DefaultScoreThreshold).(float64)
+	scores, err := NewScoreboard(scoreHalfLife)
+	if err != nil {
+		return nil, err
+	}
+	scores.SetThreshold(scoreThreshold)
+
+	// Parse the peer record ttl
+	recordTTL := getOption(PeerRecordTTLOption, options, DefaultPeerRecordTTL).(time.Duration)
+	if recordTTL <= 0 {
+		return nil, fmt.Errorf("peer record ttl must be > 0")
+	}
+
+	// Parse the dial back parameters
+	dialBackLimit := getOption(DialBackRateLimitOption, options, DefaultDialBackRateLimit).(RateLimit)
+	dialBackTTL := getOption(DialBackCacheTTLOption, options, DefaultDialBackCacheTTL).(time.Duration)
+	dialBackQueueSize := getOption(DialBackQueueSizeOption, options, DefaultDialBackQueueSize).(int64)
+	dialBack, err := newDialBackService(dialBackLimit, dialBackTTL, dialBackQueueSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the user agent
+	agentVersion := getOption(AgentVersionOption, options, DefaultAgentVersion).(string)
 
 	// Create a peer store
 	peerKey := sha1.Sum([]byte(key.Public().(ed25519.PublicKey)))
@@ -273,35 +885,204 @@ func NewHost(
 	if err != nil {
 		return nil, err
 	}
+	table.RequireStaticPuzzle(difficulty.static)
+	table.SetSubnetLimits(diversity.perBucket, diversity.perTable)
+	table.SetScoreboard(scores, scoreThreshold)
+
+	// Parse the advertised address configuration
+	announceAddrs := make([]announceAddress, 0)
+	for _, addr := range getOption(AnnounceAddressesOption, options, []string{}).([]string) {
+		announceAddr, err := parseAnnounceAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+		announceAddrs = append(announceAddrs, announceAddr)
+	}
+	excludedAddrs := make(map[AddressClass]bool)
+	for _, class := range getOption(ExcludeAddressesOption, options, []AddressClass{}).([]AddressClass) {
+		excludedAddrs[class] = true
+	}
+
+	// Parse the gateway port mapper
+	portMapper, _ := getOption(PortMapperOption, options, nil).(PortMapper)
+
+	// Parse the circuit relay configuration
+	var relay *relayService
+	if limits, ok := getOption(RelayOption, options, nil).(RelayLimits); ok {
+		relay, err = newRelayService(limits)
+		if err != nil {
+			return nil, err
+		}
+	}
+	staticRelays := getOption(StaticRelaysOption, options, []string{}).([]string)
+	for _, relayAddress := range staticRelays {
+		if _, _, _, err := ParseNodeAddress(relayAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse the dns resolver
+	resolver, ok := getOption(ResolverOption, options, nil).(Resolver)
+	if !ok {
+		resolver = net.DefaultResolver
+	}
+
+	// Parse the hole punching configuration
+	holePunching := getOption(HolePunchingOption, options, false).(bool)
+
+	// Parse the pubsub router
+	router := getOption(PubSubRouterOption, options, DefaultPubSubRouter).(string)
+	if router != FloodSubRouter && router != GossipSubRouter {
+		return nil, fmt.Errorf("unknown pubsub router %s", router)
+	}
+
+	// Parse the per topic message limits
+	topicSizes := map[string]int{AnyTopic: DefaultTopicMessageSize}
+	for _, size := range getOptions(TopicMessageSizeOption, options) {
+		if size.(topicMessageSize).size < 1 {
+			return nil, fmt.Errorf("message size of topic [%s] must be >= 1", size.(topicMessageSize).topic)
+		}
+		topicSizes[size.(topicMessageSize).topic] = size.(topicMessageSize).size
+	}
+	topicRateLimits := make(map[string]RateLimit)
+	for topic, limit := range DefaultTopicRateLimits {
+		topicRateLimits[topic] = limit
+	}
+	for _, limit := range getOptions(TopicRateLimitOption, options) {
+		topicRateLimits[limit.(topicRateLimit).topic] = limit.(topicRateLimit).limit
+	}
+	topicLimiter, err := NewRateLimiter(topicRateLimits, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	// Start listening on the tcp port
+	// Parse the block store
+	blocks, ok := getOption(BlockStoreOption, options, nil).(BlockStore)
+	if !ok {
+		blocks = NewMemoryBlockStore()
+	}
+
+	// Start listening on the port of the listen address
+	transport, ok := getOption(TransportOption, options, nil).(Transport)
+	if !ok {
+		transport = TCPTransport{}
+	}
+	if tcp, ok := transport.(TCPTransport); ok && holePunching {
+		tcp.ReusePort = true
+		transport = tcp
+	}
 	port := getOption(PortOption, options, 0).(int)
-	listener, err := net.Listen("tcp4", fmt.Sprintf("0.0.0.0:%d", port))
+	listenIP, err := resolveListenAddress(getOption(ListenAddressOption, options, DefaultListenAddress).(string))
+	if err != nil {
+		return nil, err
+	}
+	listener, err := transport.Listen(listenIP, port)
 	if err != nil {
 		return nil, err
 	}
 
+	// Parse the local discovery configuration
+	var discovery *localDiscovery
+	if getOption(LocalDiscoveryOption, options, false).(bool) {
+		discovery, err = newLocalDiscovery(
+			getOption(LocalDiscoveryServiceNameOption, options, DefaultLocalDiscoveryServiceName).(string),
+			getOption(LocalDiscoveryIntervalOption, options, DefaultLocalDiscoveryInterval).(time.Duration),
+			getOption(LocalDiscoveryGroupOption, options, DefaultLocalDiscoveryGroup).(string),
+			getOption(LocalDiscoveryInterfaceOption, options, "").(string),
+		)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
 	// Create a new host
 	rpcHandlers := make(RPCHandlerFuncMap)
 	host := &Host{
-		listener,
-		table,
-		key,
-		rpcHandlers,
-		false,
-		maxPeers,
-		pingPeriod,
-		latencyPeriod,
-		concurrentRequests,
+		listener:           listener,
+		table:              table,
+		key:                key,
+		rpcHandlers:        rpcHandlers,
+		maxPeers:           maxPeers,
+		pingPeriod:         pingPeriod,
+		latencyPeriod:      latencyPeriod,
+		concurrentRequests: concurrentRequests,
+		handlerLimiter:     limiter,
+		connLimiter:        connLimiter,
+		headerReadTimeout:  headerReadTimeout,
+		rateLimiter:        rateLimiter,
+		filter:             filter,
+		networkKey:         networkKey,
+		replayCache:        replayCache,
+		puzzleDifficulty:   difficulty,
+		puzzleSolution:     solution,
+		disjointPaths:      disjointPaths,
+		subnetLimits:       diversity,
+		scores:             scores,
+		scoreThreshold:     scoreThreshold,
+		recordTTL:          recordTTL,
+		dialBack:           dialBack,
+		rpcVersions:        make(map[string]int),
+		agentVersion:       agentVersion,
+		observedAddrs:      newObservedAddrBook(ObservedAddressThreshold, ObservedAddressTTL),
+		listenIP:           listenIP,
+		announceAddrs:      announceAddrs,
+		excludedAddrs:      excludedAddrs,
+		nat:                newNATManager(portMapper),
+		relay:              relay,
+		relayReservations:  newRelayReservations(),
+		transport:          transport,
+		holePunching:       holePunching,
+		holePunches:        newHolePunchAttempts(HolePunchRetryPeriod),
+		localDiscovery:     discovery,
+		resolver:           resolver,
+		providers:          newProviderStore(ProviderTTL),
+		pubsub:             newPubSub(router, topicSizes, topicLimiter),
+		mailboxes:          newMailboxStore(MailboxTTL),
+		inbox:              newDirectInbox(DirectMessageBuffer),
+		streamHandlers:     make(map[string]StreamHandlerFunc),
+		blocks:             blocks,
 	}
 
 	// Register standard RPC methods
 	host.RegisterRPCMethod(PingMethod, PingHandler)
-	host.RegisterRPCMethod(FindNodeMethod, FindNodeHandler)
+	host.RegisterVersionedRPCMethod(FindNodeMethod, FindNodeRecordsVersion, FindNodeHandler)
+	host.RegisterRPCMethod(IdentifyMethod, IdentifyHandler)
+	host.RegisterRPCMethod(RelayReserveMethod, RelayReserveHandler)
+	host.RegisterRPCMethod(RelayConnectMethod, RelayConnectHandler)
+	host.RegisterRPCMethod(RelayAcceptMethod, RelayAcceptHandler)
+	host.RegisterRPCMethod(HolePunchMethod, HolePunchHandler)
+	host.RegisterRPCMethod(PexMethod, PexHandler)
+	host.RegisterRPCMethod(AddProviderMethod, AddProviderHandler)
+	host.RegisterRPCMethod(GetProvidersMethod, GetProvidersHandler)
+	host.RegisterRPCMethod(PubSubMethod, PubSubHandler)
+	host.RegisterRPCMethod(DirectMessageMethod, DirectMessageHandler)
+	host.RegisterRPCMethod(MailboxPutMethod, MailboxPutHandler)
+	host.RegisterRPCMethod(MailboxFetchMethod, MailboxFetchHandler)
+	host.RegisterRPCMethod(MailboxAckMethod, MailboxAckHandler)
+	host.RegisterRPCMethod(OpenStreamMethod, OpenStreamHandler)
+	host.RegisterStreamHandler(BlockProtocol, host.serveBlocks)
 
 	// Fire up long running services
 	go host.startPingService()
 	go host.startLatencyPruneService()
+	go host.startIdentifyService()
+	go host.startPexService()
+	go host.startProviderService()
+	go host.startPubSubService()
+	go host.startMailboxService()
+	if host.nat != nil {
+		go host.startPortMappingService()
+	}
+	if len(staticRelays) > 0 {
+		go host.startRelayReservationService(staticRelays)
+	}
+	if host.localDiscovery != nil {
+		go host.startLocalDiscoveryService()
+	}
+	for i := 0; i < DialBackWorkers; i++ {
+		go host.startDialBackService()
+	}
 
 	return host, nil
 }
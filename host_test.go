@@ -5,9 +5,21 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
 	"testing"
+	"time"
 )
 
+// Wait for inbound peers to be dialed back and inserted into a host's route table
+func waitForPeers(host *Host, count int) {
+	for i := 0; i < 100 && len(host.RouteTable().Peers()) < count; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
 func TestNewHost(t *testing.T) {
 	// Generate a key pair
 	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
@@ -74,9 +86,348 @@ func TestConnection(t *testing.T) {
 		t.Error(err)
 	}
 
+	// Host A learns about host B once it has been dialed back
+	waitForPeers(hostA, 1)
 	if len(hostA.RouteTable().Peers()) != 1 {
 		t.Errorf("Host A should have one peer")
 	} else if len(hostB.RouteTable().Peers()) != 1 {
 		t.Errorf("Host B should have one peer")
 	}
 }
+
+func TestInboundConnectionLimits(t *testing.T) {
+	host, err := NewHost(
+		MaxConnectionsPerIP(1),
+		HeaderReadTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go host.Listen()
+	defer host.Close()
+
+	port, err := host.Port()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	// Open a connection that never sends a request
+	slowConn, err := net.Dial("tcp4", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slowConn.Close()
+	for i := 0; i < 50 && host.InboundConnections() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if host.InboundConnections() != 1 {
+		t.Fatalf("host should be serving one connection")
+	}
+
+	// A second connection from the same ip should be dropped
+	extraConn, err := net.Dial("tcp4", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extraConn.Close()
+	extraConn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := extraConn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("expected the extra connection to be closed")
+	}
+
+	// The slow connection should be cut off by the header deadline
+	slowConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(slowConn); err != nil {
+		t.Errorf("expected the slow connection to be closed: %s", err)
+	}
+	for i := 0; i < 50 && host.InboundConnections() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if host.InboundConnections() != 0 {
+		t.Errorf("host should not be serving any connections")
+	}
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	networkKey := make([]byte, PrivateNetworkKeySize)
+	otherKey := make([]byte, PrivateNetworkKeySize)
+	if _, err := rand.Read(networkKey); err != nil {
+		t.Fatal(err)
+	} else if _, err := rand.Read(otherKey); err != nil {
+		t.Fatal(err)
+	}
+
+	hostA, err := NewHost(PrivateNetwork(networkKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostA.Listen()
+	defer hostA.Close()
+
+	hostB, err := NewHost(PrivateNetwork(networkKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostB.Listen()
+	defer hostB.Close()
+
+	outsider, err := NewHost(PrivateNetwork(otherKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outsider.Close()
+
+	public, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+
+	addrs, err := hostA.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Members of the network can talk
+	if err := hostB.Ping(addrs[0]); err != nil {
+		t.Error(err)
+	}
+
+	// Hosts with a different key or no key are dropped
+	if err := outsider.Ping(addrs[0]); err == nil {
+		t.Errorf("host with a different network key should be rejected")
+	}
+	if err := public.Ping(addrs[0]); err == nil {
+		t.Errorf("host outside the private network should be rejected")
+	}
+	waitForPeers(hostA, 1)
+	if len(hostA.RouteTable().Peers()) != 1 {
+		t.Errorf("only the network member should be in the route table")
+	}
+}
+
+func TestDialBack(t *testing.T) {
+	hostA, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostA.Listen()
+	defer hostA.Close()
+
+	hostB, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostB.Listen()
+	defer hostB.Close()
+
+	// Advertise a port nothing is listening on, as a peer behind a NAT would
+	closedListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closedListener.Addr().(*net.TCPAddr).Port
+	closedListener.Close()
+
+	hostAKey := hostA.PeerKey()
+	payload, err := hostB.prepareRequest(hostAKey[:], 1, PingMethod, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(payload[:Int64Len], Uint64ToBytes(uint64(closedPort)))
+
+	// The request is served without waiting for the dial back
+	if response := sendRawRequest(t, hostA, payload); !response.Success {
+		t.Fatalf("expected the request to succeed: %v", response.Data)
+	}
+
+	hostBKey := hostB.PeerKey()
+	for i := 0; i < 100 && hostA.Reachability(hostBKey[:]) == ReachabilityUnknown; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if reachability := hostA.Reachability(hostBKey[:]); reachability != ReachabilityPrivate {
+		t.Errorf("expected host B to be private, got %s", reachability)
+	}
+	if len(hostA.RouteTable().Peers()) != 0 {
+		t.Errorf("unreachable peers should not be inserted")
+	}
+
+	// Reachable peers are verified and inserted
+	addrs, err := hostA.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hostB.Ping(addrs[0]); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(hostA, 1)
+	if reachability := hostA.Reachability(hostBKey[:]); reachability != ReachabilityPublic {
+		t.Errorf("expected host B to be public, got %s", reachability)
+	}
+	if len(hostA.RouteTable().Peers()) != 1 {
+		t.Errorf("host B should have been inserted")
+	}
+	if reachability := hostB.Reachability(hostAKey[:]); reachability != ReachabilityPublic {
+		t.Errorf("expected host A to be public, got %s", reachability)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	hostA, err := NewHost(AgentVersion("test-agent/1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostA.Listen()
+	defer hostA.Close()
+
+	hostB, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostB.Listen()
+	defer hostB.Close()
+
+	addrs, err := hostA.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := hostB.Identify(addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if observedIP, _, err := net.SplitHostPort(info.ObservedAddress); err != nil || observedIP != "127.0.0.1" {
+		t.Errorf("unexpected observed address %s", info.ObservedAddress)
+	}
+	if len(info.ListenAddresses) != len(addrs) {
+		t.Errorf("expected host A's addresses")
+	}
+	if info.Methods[FindNodeMethod] != FindNodeRecordsVersion || info.Methods[PingMethod] != 1 {
+		t.Errorf("unexpected methods %v", info.Methods)
+	}
+	if info.AgentVersion != "test-agent/1.0" {
+		t.Errorf("unexpected agent version %s", info.AgentVersion)
+	}
+
+	// Methods can be registered while peers identify the host
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			hostA.RegisterRPCMethod(fmt.Sprintf("method_%d", i), PingHandler)
+		}
+	}()
+	if _, err := hostB.Identify(addrs[0]); err != nil {
+		t.Error(err)
+	}
+	<-done
+}
+
+func TestObservedAddresses(t *testing.T) {
+	book := newObservedAddrBook(2, time.Minute)
+	observerKey := func() []byte {
+		key := make([]byte, PeerKeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	// Private addresses are never confirmed
+	book.add("192.168.1.10", observerKey(), "10.0.0.1")
+	book.add("192.168.1.10", observerKey(), "10.0.0.2")
+	if len(book.confirmed()) != 0 {
+		t.Errorf("private addresses should not be confirmed")
+	}
+
+	// Observers on the same subnet count once
+	book.add("8.8.8.8", observerKey(), "1.2.3.4")
+	book.add("8.8.8.8", observerKey(), "1.2.3.5")
+	if len(book.confirmed()) != 0 {
+		t.Errorf("observers on the same subnet should count once")
+	}
+
+	book.add("8.8.8.8", observerKey(), "5.6.7.8")
+	if confirmed := book.confirmed(); len(confirmed) != 1 || confirmed[0] != "8.8.8.8" {
+		t.Errorf("expected the observed address to be confirmed, got %v", confirmed)
+	}
+}
+
+func TestAddressConfiguration(t *testing.T) {
+	// Announce addresses replace the interface addresses
+	host, err := NewHost(
+		ListenAddress("127.0.0.1"),
+		AnnounceAddresses("8.8.8.8:4000", "1.1.1.1"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	port, err := host.Port()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := host.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := host.PeerKey()
+	if len(addrs) != 2 {
+		t.Fatalf("expected the announce addresses, got %v", addrs)
+	}
+	if expected, _ := FormatNodeAddress(key[:], "8.8.8.8", 4000); addrs[0] != expected {
+		t.Errorf("expected %s, got %s", expected, addrs[0])
+	}
+	if expected, _ := FormatNodeAddress(key[:], "1.1.1.1", port); addrs[1] != expected {
+		t.Errorf("expected %s, got %s", expected, addrs[1])
+	}
+
+	if _, err := NewHost(AnnounceAddresses("not-an-ip")); err == nil {
+		t.Errorf("expected an invalid announce address to be rejected")
+	}
+
+	// A host bound to an ip address only advertises it
+	hostA, err := NewHost(ListenAddress("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostA.Listen()
+	defer hostA.Close()
+	if addrs, err := hostA.Addresses(); err != nil || len(addrs) != 1 {
+		t.Errorf("expected a single address, got %v", addrs)
+	}
+
+	// Excluded address classes are left out of addresses and find_node responses
+	hostB, err := NewHost(ListenAddress("127.0.0.1"), ExcludeAddresses(LoopbackAddress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostB.Listen()
+	defer hostB.Close()
+	if addrs, err := hostB.Addresses(); err != nil || len(addrs) != 0 {
+		t.Errorf("expected no addresses, got %v", addrs)
+	}
+
+	hostBPort, err := hostB.Port()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostBKey := hostB.PeerKey()
+	hostBAddr, err := FormatNodeAddress(hostBKey[:], "127.0.0.1", hostBPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hostA.Ping(hostBAddr); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(hostB, 1)
+	if len(hostB.RouteTable().Peers()) != 1 {
+		t.Fatalf("host B should know host A")
+	}
+	nodes, err := hostA.FindNode(hostBAddr, hostBKey[:])
+	if err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 0 {
+		t.Errorf("expected loopback peers to be left out, got %v", nodes)
+	}
+}
@@ -0,0 +1,209 @@
+package coalition
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// A host's signed addresses announced to the local network.
+// Queries ask the other hosts of the service to announce themselves in return.
+type localAnnouncement struct {
+	Service string      `json:"service"`
+	Query   bool        `json:"query"`
+	Record  *PeerRecord `json:"record"`
+}
+
+// Finds peers on the local network by announcing the host's addresses over udp multicast
+type localDiscovery struct {
+	mutex       sync.Mutex
+	serviceName string
+	interval    time.Duration
+	group       *net.UDPAddr
+	listener    *net.UDPConn
+	sender      *net.UDPConn
+	verifying   map[string]time.Time
+	lastAnswer  time.Time
+}
+
+// Returns true if the peer wasn't verified within the announcement interval
+func (discovery *localDiscovery) startVerifying(key []byte) bool {
+	discovery.mutex.Lock()
+	defer discovery.mutex.Unlock()
+
+	for hexKey, started := range discovery.verifying {
+		if time.Since(started) >= discovery.interval {
+			delete(discovery.verifying, hexKey)
+		}
+	}
+	hexKey := hex.EncodeToString(key)
+	if _, exists := discovery.verifying[hexKey]; exists {
+		return false
+	}
+	discovery.verifying[hexKey] = time.Now()
+	return true
+}
+
+// Returns true if the host may answer a query, queries are answered at most once a second
+func (discovery *localDiscovery) startAnswer() bool {
+	discovery.mutex.Lock()
+	defer discovery.mutex.Unlock()
+	if time.Since(discovery.lastAnswer) < time.Second {
+		return false
+	}
+	discovery.lastAnswer = time.Now()
+	return true
+}
+
+func (discovery *localDiscovery) close() {
+	if discovery == nil {
+		return
+	}
+	discovery.listener.Close()
+	discovery.sender.Close()
+}
+
+// Create a new local discovery service announcing over the multicast group address.
+// Announcements are sent and received on the named interface, or the system's default if empty.
+func newLocalDiscovery(serviceName string, interval time.Duration, group, ifaceName string) (*localDiscovery, error) {
+	if serviceName == "" {
+		return nil, fmt.Errorf("local discovery service name is required")
+	} else if interval <= 0 {
+		return nil, fmt.Errorf("local discovery interval must be > 0")
+	}
+	groupAddr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	} else if !groupAddr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", group)
+	}
+
+	// Send from the interface's address so announcements go out on the interface
+	var iface *net.Interface
+	senderAddr := &net.UDPAddr{}
+	if ifaceName != "" {
+		if iface, err = net.InterfaceByName(ifaceName); err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				senderAddr.IP = ipNet.IP
+				break
+			}
+		}
+		if senderAddr.IP == nil {
+			return nil, fmt.Errorf("interface %s has no ip4 address", ifaceName)
+		}
+	}
+
+	listener, err := net.ListenMulticastUDP("udp4", iface, groupAddr)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := net.ListenUDP("udp4", senderAddr)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	discovery := &localDiscovery{
+		serviceName: serviceName,
+		interval:    interval,
+		group:       groupAddr,
+		listener:    listener,
+		sender:      sender,
+		verifying:   make(map[string]time.Time),
+	}
+	return discovery, nil
+}
+
+// Announce the host's signed addresses to the local network
+func (host *Host) announceLocally(query bool) error {
+	record, err := host.PeerRecord()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&localAnnouncement{
+		Service: host.localDiscovery.serviceName,
+		Query:   query,
+		Record:  record,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = host.localDiscovery.sender.WriteToUDP(data, host.localDiscovery.group)
+	return err
+}
+
+// Ping a peer announced on the local network, which inserts it into the route table.
+// Only addresses on the ip address the announcement came from are tried,
+// so announcements can't point the host at other machines.
+func (host *Host) verifyLocalPeer(key []byte, record *PeerRecord, sourceIP string) {
+	if host.table.Get(key) != nil || !host.localDiscovery.startVerifying(key) {
+		return
+	}
+	for _, addr := range record.Addresses {
+		_, ip, _, err := ParseNodeAddress(addr)
+		if err != nil || ip != sourceIP {
+			continue
+		}
+		if err := host.Ping(addr); err == nil {
+			return
+		}
+	}
+}
+
+// Read announcements from the local network until the host is closed
+func (host *Host) serveLocalDiscovery() {
+	hostKey := host.PeerKey()
+	buffer := make([]byte, 64*1024)
+	for {
+		n, source, err := host.localDiscovery.listener.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+
+		// Only verified announcements for the host's service from other hosts are considered
+		var announcement localAnnouncement
+		if err := json.Unmarshal(buffer[:n], &announcement); err != nil {
+			continue
+		} else if announcement.Service != host.localDiscovery.serviceName || announcement.Record == nil {
+			continue
+		}
+		key, err := announcement.Record.Verify(host.recordTTL)
+		if err != nil || bytes.Equal(key, hostKey[:]) {
+			continue
+		} else if !host.filter.AllowsPeer(key, source.IP.String()) {
+			continue
+		}
+
+		if announcement.Query && host.localDiscovery.startAnswer() {
+			go host.announceLocally(false)
+		}
+		go host.verifyLocalPeer(key, announcement.Record, source.IP.String())
+	}
+}
+
+// A long running service that announces the host to the local network.
+// The first announcement queries the other hosts so they're found right away.
+func (host *Host) startLocalDiscoveryService() {
+	go host.serveLocalDiscovery()
+	query := true
+	for !host.closed.Load() {
+		if err := host.announceLocally(query); err == nil {
+			query = false
+		}
+		time.Sleep(host.localDiscovery.interval)
+	}
+}
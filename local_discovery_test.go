@@ -0,0 +1,58 @@
+package coalition
+
+import (
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLocalDiscovery(t *testing.T) {
+	// Announce on the loopback interface with a group port of the test's own
+	group := fmt.Sprintf("239.255.70.77:%d", 20000+mathrand.Intn(20000))
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface named lo")
+	}
+	groupAddr, _ := net.ResolveUDPAddr("udp4", group)
+	if conn, err := net.ListenMulticastUDP("udp4", loopback, groupAddr); err != nil {
+		t.Skipf("multicast is unavailable on the loopback interface: %s", err)
+	} else {
+		conn.Close()
+	}
+
+	newDiscoveryHost := func(serviceName string) *Host {
+		return newTestHost(t,
+			ListenAddress("127.0.0.1"),
+			EnableLocalDiscovery(),
+			LocalDiscoveryServiceName(serviceName),
+			LocalDiscoveryInterval(100*time.Millisecond),
+			LocalDiscoveryGroup(group),
+			LocalDiscoveryInterface("lo"),
+		)
+	}
+	hostA := newDiscoveryHost("test")
+	hostB := newDiscoveryHost("test")
+	other := newDiscoveryHost("other")
+
+	// Hosts of the same service find each other without any boot nodes
+	for i := 0; i < 100 && (len(hostA.RouteTable().Peers()) < 1 || len(hostB.RouteTable().Peers()) < 1); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	keyA, keyB, otherKey := hostA.PeerKey(), hostB.PeerKey(), other.PeerKey()
+	if hostA.RouteTable().Get(keyB[:]) == nil || hostB.RouteTable().Get(keyA[:]) == nil {
+		t.Fatal("expected the hosts to discover each other")
+	}
+
+	// Hosts of other services are ignored
+	time.Sleep(300 * time.Millisecond)
+	if hostA.RouteTable().Get(otherKey[:]) != nil || len(other.RouteTable().Peers()) != 0 {
+		t.Errorf("expected hosts of other services to be ignored")
+	}
+
+	// Group addresses must be multicast
+	if _, err := NewHost(EnableLocalDiscovery(), LocalDiscoveryGroup("127.0.0.1:6770")); err == nil {
+		t.Errorf("expected a unicast group address to be rejected")
+	}
+}
@@ -0,0 +1,359 @@
+package coalition
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// First port handed out to connections and listeners without a port
+const memoryEphemeralPort = 49152
+
+// An in-memory network of hosts for simulations and tests.
+// Hosts can be put behind simulated NATs that map outbound connections to an external
+// ip address and only let in connections from ip addresses the mapping was used to reach.
+type MemoryNetwork struct {
+	mutex     sync.Mutex
+	listeners map[string]*memoryListener
+	nats      map[string]*memoryNAT
+	external  map[string]*memoryNAT
+	ports     map[string]int
+}
+
+// A simulated NAT with endpoint independent mapping and address dependent filtering
+type memoryNAT struct {
+	externalIP string
+	mappings   map[int]*memoryNATMapping
+	ports      map[string]int
+}
+
+// An internal address mapped to an external port, with the ip addresses let in through it
+type memoryNATMapping struct {
+	internal  string
+	permitted map[string]bool
+}
+
+// Map the internal address to an external port, keeping the port if it's free
+func (nat *memoryNAT) mapAddress(internal string, port int) int {
+	if external, exists := nat.ports[internal]; exists {
+		return external
+	}
+	external := port
+	for nat.mappings[external] != nil {
+		external++
+	}
+	nat.mappings[external] = &memoryNATMapping{internal, make(map[string]bool)}
+	nat.ports[internal] = external
+	return external
+}
+
+// Put the internal ip addresses behind a NAT with the external ip address
+func (network *MemoryNetwork) AddNAT(externalIP string, internalIPs ...string) error {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	if net.ParseIP(externalIP).To4() == nil {
+		return fmt.Errorf("invalid ip4 address %s", externalIP)
+	} else if _, exists := network.external[externalIP]; exists {
+		return fmt.Errorf("nat with external ip address %s already exists", externalIP)
+	}
+	nat := &memoryNAT{
+		externalIP: externalIP,
+		mappings:   make(map[int]*memoryNATMapping),
+		ports:      make(map[string]int),
+	}
+	for _, ip := range internalIPs {
+		if net.ParseIP(ip).To4() == nil {
+			return fmt.Errorf("invalid ip4 address %s", ip)
+		} else if _, exists := network.nats[ip]; exists {
+			return fmt.Errorf("ip address %s is already behind a nat", ip)
+		}
+	}
+	for _, ip := range internalIPs {
+		network.nats[ip] = nat
+	}
+	network.external[externalIP] = nat
+	return nil
+}
+
+// Returns a transport for a host with the ip address on the network
+func (network *MemoryNetwork) Transport(ipAddress string) (Transport, error) {
+	if net.ParseIP(ipAddress).To4() == nil {
+		return nil, fmt.Errorf("invalid ip4 address %s", ipAddress)
+	}
+	return &memoryTransport{network, ipAddress}, nil
+}
+
+// Returns a free port on the ip address
+func (network *MemoryNetwork) freePort(ipAddress string) int {
+	port, exists := network.ports[ipAddress]
+	if !exists {
+		port = memoryEphemeralPort
+	}
+	for network.listeners[net.JoinHostPort(ipAddress, strconv.Itoa(port))] != nil {
+		port++
+	}
+	network.ports[ipAddress] = port + 1
+	return port
+}
+
+func (network *MemoryNetwork) listen(ipAddress string, port int) (net.Listener, error) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	if port == 0 {
+		port = network.freePort(ipAddress)
+	}
+	address := net.JoinHostPort(ipAddress, strconv.Itoa(port))
+	if _, exists := network.listeners[address]; exists {
+		return nil, fmt.Errorf("address %s already in use", address)
+	}
+	listener := &memoryListener{
+		network: network,
+		addr:    &net.TCPAddr{IP: net.ParseIP(ipAddress), Port: port},
+		conns:   make(chan net.Conn, 128),
+		closed:  make(chan struct{}),
+	}
+	network.listeners[address] = listener
+	return listener, nil
+}
+
+// Connect the source address to the destination address through any NATs in between
+func (network *MemoryNetwork) dial(srcIP string, srcPort int, dstIP string, dstPort int) (net.Conn, error) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	refused := fmt.Errorf("connection to %s refused", net.JoinHostPort(dstIP, strconv.Itoa(dstPort)))
+	if srcPort == 0 {
+		srcPort = network.freePort(srcIP)
+	}
+	localIP, localPort := srcIP, srcPort
+	dialedIP, dialedPort := dstIP, dstPort
+
+	// Addresses behind a NAT are only reachable from behind the same NAT
+	srcNAT := network.nats[srcIP]
+	if dstNAT, exists := network.nats[dstIP]; exists && dstNAT != srcNAT {
+		return nil, refused
+	}
+
+	// Outbound connections are mapped to the external ip address and let the destination in
+	if _, internal := network.nats[dstIP]; srcNAT != nil && !internal {
+		port := srcNAT.mapAddress(net.JoinHostPort(srcIP, strconv.Itoa(srcPort)), srcPort)
+		srcNAT.mappings[port].permitted[dstIP] = true
+		srcIP, srcPort = srcNAT.externalIP, port
+	}
+
+	// Inbound connections are only let through mappings used to reach the source
+	if nat, exists := network.external[dstIP]; exists {
+		mapping, exists := nat.mappings[dstPort]
+		if !exists || !mapping.permitted[srcIP] {
+			return nil, refused
+		}
+		host, port, _ := net.SplitHostPort(mapping.internal)
+		dstIP = host
+		dstPort, _ = strconv.Atoi(port)
+	}
+
+	listener, exists := network.listeners[net.JoinHostPort(dstIP, strconv.Itoa(dstPort))]
+	if !exists {
+		return nil, refused
+	}
+
+	toServer, toClient := newMemoryPipe(), newMemoryPipe()
+	client := &memoryConn{
+		reader: toClient,
+		writer: toServer,
+		local:  &net.TCPAddr{IP: net.ParseIP(localIP), Port: localPort},
+		remote: &net.TCPAddr{IP: net.ParseIP(dialedIP), Port: dialedPort},
+	}
+	server := &memoryConn{
+		reader: toServer,
+		writer: toClient,
+		local:  listener.addr,
+		remote: &net.TCPAddr{IP: net.ParseIP(srcIP), Port: srcPort},
+	}
+	select {
+	case listener.conns <- server:
+		return client, nil
+	default:
+		return nil, refused
+	}
+}
+
+// Create a new in-memory network
+func NewMemoryNetwork() *MemoryNetwork {
+	network := &MemoryNetwork{
+		listeners: make(map[string]*memoryListener),
+		nats:      make(map[string]*memoryNAT),
+		external:  make(map[string]*memoryNAT),
+		ports:     make(map[string]int),
+	}
+	return network
+}
+
+// A host's transport on an in-memory network
+type memoryTransport struct {
+	network   *MemoryNetwork
+	ipAddress string
+}
+
+func (transport *memoryTransport) Listen(ipAddress string, port int) (net.Listener, error) {
+	if ip := net.ParseIP(ipAddress); ip == nil || (!ip.IsUnspecified() && ipAddress != transport.ipAddress) {
+		return nil, fmt.Errorf("can't listen on %s from %s", ipAddress, transport.ipAddress)
+	}
+	return transport.network.listen(transport.ipAddress, port)
+}
+
+func (transport *memoryTransport) Dial(ipAddress string, port int, timeout time.Duration) (net.Conn, error) {
+	return transport.network.dial(transport.ipAddress, 0, ipAddress, port)
+}
+
+func (transport *memoryTransport) DialFrom(localPort int, ipAddress string, port int, timeout time.Duration) (net.Conn, error) {
+	return transport.network.dial(transport.ipAddress, localPort, ipAddress, port)
+}
+
+// Accepts connections dialed to an address on the in-memory network
+type memoryListener struct {
+	network *MemoryNetwork
+	addr    *net.TCPAddr
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (listener *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *memoryListener) Close() error {
+	listener.once.Do(func() {
+		listener.network.mutex.Lock()
+		defer listener.network.mutex.Unlock()
+		delete(listener.network.listeners, listener.addr.String())
+		close(listener.closed)
+	})
+	return nil
+}
+
+func (listener *memoryListener) Addr() net.Addr {
+	return listener.addr
+}
+
+// One direction of an in-memory connection, buffering writes until they're read
+type memoryPipe struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	buffer   bytes.Buffer
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func (pipe *memoryPipe) read(b []byte) (int, error) {
+	pipe.mutex.Lock()
+	defer pipe.mutex.Unlock()
+	for pipe.buffer.Len() == 0 {
+		if pipe.closed {
+			return 0, io.EOF
+		} else if !pipe.deadline.IsZero() && !time.Now().Before(pipe.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		pipe.cond.Wait()
+	}
+	return pipe.buffer.Read(b)
+}
+
+func (pipe *memoryPipe) write(b []byte) (int, error) {
+	pipe.mutex.Lock()
+	defer pipe.mutex.Unlock()
+	if pipe.closed {
+		return 0, io.ErrClosedPipe
+	}
+	defer pipe.cond.Broadcast()
+	return pipe.buffer.Write(b)
+}
+
+func (pipe *memoryPipe) close() {
+	pipe.mutex.Lock()
+	defer pipe.mutex.Unlock()
+	pipe.closed = true
+	pipe.cond.Broadcast()
+}
+
+// Wake blocked reads once the deadline passes
+func (pipe *memoryPipe) setDeadline(deadline time.Time) {
+	pipe.mutex.Lock()
+	defer pipe.mutex.Unlock()
+	pipe.deadline = deadline
+	if pipe.timer != nil {
+		pipe.timer.Stop()
+	}
+	if !deadline.IsZero() {
+		pipe.timer = time.AfterFunc(time.Until(deadline), func() {
+			pipe.mutex.Lock()
+			defer pipe.mutex.Unlock()
+			pipe.cond.Broadcast()
+		})
+	}
+	pipe.cond.Broadcast()
+}
+
+func newMemoryPipe() *memoryPipe {
+	pipe := &memoryPipe{}
+	pipe.cond = sync.NewCond(&pipe.mutex)
+	return pipe
+}
+
+// One end of an in-memory connection
+type memoryConn struct {
+	reader *memoryPipe
+	writer *memoryPipe
+	local  *net.TCPAddr
+	remote *net.TCPAddr
+}
+
+func (conn *memoryConn) Read(b []byte) (int, error) {
+	return conn.reader.read(b)
+}
+
+func (conn *memoryConn) Write(b []byte) (int, error) {
+	return conn.writer.write(b)
+}
+
+func (conn *memoryConn) Close() error {
+	conn.reader.close()
+	conn.writer.close()
+	return nil
+}
+
+func (conn *memoryConn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+func (conn *memoryConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *memoryConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+func (conn *memoryConn) SetReadDeadline(t time.Time) error {
+	conn.reader.setDeadline(t)
+	return nil
+}
+
+// Writes never block, so write deadlines have no effect
+func (conn *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,151 @@
+package coalition
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A port mapped on the gateway to the host
+type PortMapping struct {
+	ExternalIP   string
+	ExternalPort int
+	InternalPort int
+	Lifetime     time.Duration
+}
+
+// Maps tcp ports on a gateway to the host, such as with UPnP IGD, NAT-PMP or PCP
+type PortMapper interface {
+	// The port mapping protocol name
+	Name() string
+
+	// Map the internal port on the gateway for the lifetime.
+	// Mapping an already mapped port renews the mapping.
+	AddPortMapping(internalPort int, lifetime time.Duration) (*PortMapping, error)
+
+	// Remove a mapping from the gateway
+	DeletePortMapping(mapping *PortMapping) error
+}
+
+// Keeps the host's port mapped on the gateway
+type natManager struct {
+	mutex   sync.Mutex
+	mapper  PortMapper
+	mapping *PortMapping
+	closed  bool
+}
+
+// Returns the current port mapping, nil if the port isn't mapped
+func (manager *natManager) current() *PortMapping {
+	if manager == nil {
+		return nil
+	}
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	return manager.mapping
+}
+
+// Map or renew the mapping of the internal port.
+// Returns how long to wait before the mapping should be renewed.
+func (manager *natManager) renew(internalPort int) (time.Duration, error) {
+	mapping, err := manager.mapper.AddPortMapping(internalPort, PortMappingLifetime)
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if err != nil {
+		manager.mapping = nil
+		return PortMappingRetryPeriod, err
+	} else if manager.closed {
+		manager.mapper.DeletePortMapping(mapping)
+		return PortMappingRetryPeriod, fmt.Errorf("nat manager is closed")
+	}
+	manager.mapping = mapping
+
+	// Permanent mappings are still refreshed in case the gateway restarts
+	if mapping.Lifetime <= 0 {
+		return PortMappingLifetime / 2, nil
+	}
+	return mapping.Lifetime / 2, nil
+}
+
+// Remove the port mapping and stop renewing it
+func (manager *natManager) close() {
+	if manager == nil {
+		return
+	}
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	manager.closed = true
+	if manager.mapping != nil {
+		manager.mapper.DeletePortMapping(manager.mapping)
+		manager.mapping = nil
+	}
+}
+
+// Create a new nat manager, nil if there's no port mapper
+func newNATManager(mapper PortMapper) *natManager {
+	if mapper == nil {
+		return nil
+	}
+	return &natManager{mapper: mapper}
+}
+
+// Returns the ip4 address of the default gateway.
+// Only supported on linux, where the kernel routing table is exposed in /proc.
+func DefaultGateway() (string, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := hex.DecodeString(fields[2])
+		if err != nil || len(gateway) != 4 {
+			continue
+		}
+
+		// The gateway is stored in host byte order, which is little endian on supported platforms
+		ip := make([]byte, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gateway))
+		if binary.BigEndian.Uint32(ip) == 0 {
+			continue
+		}
+		return fmt.Sprintf("%d.%d.%d.%d", ip[0], ip[1], ip[2], ip[3]), nil
+	}
+	return "", fmt.Errorf("default gateway not found")
+}
+
+// Discover a port mapper on the local network.
+// UPnP gateways are searched for first, then the default gateway is tried with PCP and NAT-PMP.
+func DiscoverPortMapper(timeout time.Duration) (PortMapper, error) {
+	if mapper, err := DiscoverUPnPMapper(timeout); err == nil {
+		return mapper, nil
+	}
+
+	gateway, err := DefaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	if mapper, err := NewPCPMapper(gateway); err == nil && mapper.announce() == nil {
+		return mapper, nil
+	}
+	if mapper, err := NewNATPMPMapper(gateway); err == nil {
+		if _, err := mapper.externalAddress(); err == nil {
+			return mapper, nil
+		}
+	}
+	return nil, fmt.Errorf("no port mapper found")
+}
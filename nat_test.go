@@ -0,0 +1,249 @@
+package coalition
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fake NAT-PMP and PCP gateway mapping every port to the same external port
+type fakeGateway struct {
+	mutex      sync.Mutex
+	conn       net.PacketConn
+	externalIP net.IP
+	mappings   map[uint16]uint32
+}
+
+func (gateway *fakeGateway) serve() {
+	buffer := make([]byte, 1100)
+	for {
+		n, addr, err := gateway.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		request := buffer[:n]
+
+		var response []byte
+		switch {
+		case n == 2 && request[0] == natPMPVersion && request[1] == natPMPOpExternalAddress:
+			response = make([]byte, 12)
+			response[1] = natPMPOpExternalAddress | natResponseBit
+			copy(response[8:12], gateway.externalIP.To4())
+		case n == 12 && request[0] == natPMPVersion && request[1] == natPMPOpMapTCP:
+			port := binary.BigEndian.Uint16(request[4:6])
+			lifetime := binary.BigEndian.Uint32(request[8:12])
+			gateway.setMapping(port, lifetime)
+			response = make([]byte, 16)
+			response[1] = natPMPOpMapTCP | natResponseBit
+			copy(response[8:10], request[4:6])
+			copy(response[10:12], request[4:6])
+			binary.BigEndian.PutUint32(response[12:16], lifetime)
+		case n == 60 && request[0] == pcpVersion && request[1] == pcpOpMap:
+			port := binary.BigEndian.Uint16(request[40:42])
+			lifetime := binary.BigEndian.Uint32(request[4:8])
+			gateway.setMapping(port, lifetime)
+			response = make([]byte, 60)
+			response[0] = pcpVersion
+			response[1] = pcpOpMap | natResponseBit
+			copy(response[4:8], request[4:8])
+			copy(response[24:44], request[24:44])
+			copy(response[44:60], gateway.externalIP.To16())
+		default:
+			continue
+		}
+		gateway.conn.WriteTo(response, addr)
+	}
+}
+
+func (gateway *fakeGateway) setMapping(port uint16, lifetime uint32) {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	if lifetime == 0 {
+		delete(gateway.mappings, port)
+	} else {
+		gateway.mappings[port] = lifetime
+	}
+}
+
+func (gateway *fakeGateway) mapped(port int) bool {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	_, exists := gateway.mappings[uint16(port)]
+	return exists
+}
+
+func newFakeGateway(t *testing.T) *fakeGateway {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	gateway := &fakeGateway{
+		conn:       conn,
+		externalIP: net.ParseIP("203.0.113.7"),
+		mappings:   make(map[uint16]uint32),
+	}
+	go gateway.serve()
+	return gateway
+}
+
+func TestNATPMPPortMapping(t *testing.T) {
+	gateway := newFakeGateway(t)
+	mapper, err := NewNATPMPMapper(gateway.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, err := NewHost(ListenAddress("127.0.0.1"), NATPortMapping(mapper))
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := host.Port()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && host.PortMapping() == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	mapping := host.PortMapping()
+	if mapping == nil {
+		t.Fatal("expected the port to be mapped")
+	} else if mapping.ExternalIP != "203.0.113.7" || mapping.ExternalPort != port {
+		t.Errorf("unexpected mapping %+v", mapping)
+	} else if mapping.Lifetime != PortMappingLifetime {
+		t.Errorf("unexpected mapping lifetime %s", mapping.Lifetime)
+	}
+
+	// The external address is advertised
+	key := host.PeerKey()
+	external, err := FormatNodeAddress(key[:], "203.0.113.7", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := host.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, addr := range addrs {
+		found = found || addr == external
+	}
+	if !found {
+		t.Errorf("expected the external address in %v", addrs)
+	}
+
+	// Closing the host removes the mapping
+	host.Close()
+	if gateway.mapped(port) {
+		t.Errorf("expected the mapping to be removed")
+	}
+}
+
+func TestPCPPortMapping(t *testing.T) {
+	gateway := newFakeGateway(t)
+	mapper, err := NewPCPMapper(gateway.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapping, err := mapper.AddPortMapping(4000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.ExternalIP != "203.0.113.7" || mapping.ExternalPort != 4000 || mapping.Lifetime != time.Hour {
+		t.Errorf("unexpected mapping %+v", mapping)
+	}
+	if !gateway.mapped(4000) {
+		t.Errorf("expected the gateway to map the port")
+	}
+	if err := mapper.DeletePortMapping(mapping); err != nil {
+		t.Fatal(err)
+	} else if gateway.mapped(4000) {
+		t.Errorf("expected the mapping to be removed")
+	}
+}
+
+func TestUPnPPortMapping(t *testing.T) {
+	serviceType := "urn:schemas-upnp-org:service:WANIPConnection:1"
+	var mutex sync.Mutex
+	actions := make([]string, 0)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+	<device>
+		<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+		<deviceList>
+			<device>
+				<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+				<deviceList>
+					<device>
+						<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+						<serviceList>
+							<service>
+								<serviceType>%s</serviceType>
+								<controlURL>/ctl/IPConn</controlURL>
+							</service>
+						</serviceList>
+					</device>
+				</deviceList>
+			</device>
+		</deviceList>
+	</device>
+</root>`, serviceType)
+	})
+	mux.HandleFunc("/ctl/IPConn", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		action := strings.TrimPrefix(strings.Trim(r.Header.Get("SOAPAction"), `"`), serviceType+"#")
+		mutex.Lock()
+		actions = append(actions, action)
+		mutex.Unlock()
+
+		switch action {
+		case "GetExternalIPAddress":
+			fmt.Fprint(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+				`<u:GetExternalIPAddressResponse xmlns:u="`+serviceType+`"><NewExternalIPAddress>203.0.113.9</NewExternalIPAddress>`+
+				`</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		case "AddPortMapping":
+			if !strings.Contains(string(body), "<NewInternalPort>4000</NewInternalPort>") {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `<errorCode>402</errorCode>`)
+			}
+		case "DeletePortMapping":
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mapper, err := NewUPnPMapper(server.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping, err := mapper.AddPortMapping(4000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.ExternalIP != "203.0.113.9" || mapping.ExternalPort != 4000 {
+		t.Errorf("unexpected mapping %+v", mapping)
+	}
+	if err := mapper.DeletePortMapping(mapping); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	expected := []string{"GetExternalIPAddress", "AddPortMapping", "DeletePortMapping"}
+	if strings.Join(actions, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected soap actions %v", actions)
+	}
+}
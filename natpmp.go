@@ -0,0 +1,268 @@
+package coalition
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// NAT-PMP and PCP opcodes
+const (
+	natPMPOpExternalAddress = 0
+	natPMPOpMapTCP          = 2
+	pcpOpAnnounce           = 0
+	pcpOpMap                = 1
+	natResponseBit          = 0x80
+)
+
+// Protocol versions of NAT-PMP and PCP
+const (
+	natPMPVersion = 0
+	pcpVersion    = 2
+)
+
+// IANA protocol number of tcp
+const tcpProtocolNumber = 6
+
+// Appends the NAT-PMP port to a gateway ip address without a port
+func gatewayAddress(gateway string) (string, error) {
+	if _, _, err := net.SplitHostPort(gateway); err == nil {
+		return gateway, nil
+	}
+	if ip := net.ParseIP(gateway); ip == nil || ip.To4() == nil {
+		return "", fmt.Errorf("invalid gateway address %s", gateway)
+	}
+	return net.JoinHostPort(gateway, strconv.Itoa(NATPMPPort)), nil
+}
+
+// Send a request to a NAT-PMP or PCP gateway over udp, retrying with a doubling timeout.
+// Only responses of the expected version and opcode which pass the check are returned.
+func natGatewayRequest(
+	gateway string,
+	request []byte,
+	version byte,
+	opcode byte,
+	check func([]byte) bool,
+) ([]byte, error) {
+	conn, err := net.Dial("udp4", gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buffer := make([]byte, 1100)
+	timeout := 250 * time.Millisecond
+	deadline := time.Now().Add(PortMappingTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buffer)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			response := buffer[:n]
+			if n >= 4 && response[0] == version && response[1] == opcode|natResponseBit && check(response) {
+				return response, nil
+			}
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("gateway did not respond")
+}
+
+// Maps ports with NAT-PMP, RFC 6886
+type NATPMPMapper struct {
+	gateway string
+}
+
+func (mapper *NATPMPMapper) Name() string {
+	return "nat-pmp"
+}
+
+// Request the gateway's external ip address
+func (mapper *NATPMPMapper) externalAddress() (string, error) {
+	response, err := natGatewayRequest(
+		mapper.gateway,
+		[]byte{natPMPVersion, natPMPOpExternalAddress},
+		natPMPVersion,
+		natPMPOpExternalAddress,
+		func(response []byte) bool { return len(response) >= 12 },
+	)
+	if err != nil {
+		return "", err
+	} else if result := binary.BigEndian.Uint16(response[2:4]); result != 0 {
+		return "", fmt.Errorf("nat-pmp external address request failed with result %d", result)
+	}
+	return net.IP(response[8:12]).String(), nil
+}
+
+// Request a tcp mapping, a zero lifetime removes the mapping
+func (mapper *NATPMPMapper) mapPort(internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	request := make([]byte, 12)
+	request[0] = natPMPVersion
+	request[1] = natPMPOpMapTCP
+	binary.BigEndian.PutUint16(request[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(request[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(request[8:12], uint32(lifetime.Seconds()))
+
+	response, err := natGatewayRequest(
+		mapper.gateway,
+		request,
+		natPMPVersion,
+		natPMPOpMapTCP,
+		func(response []byte) bool {
+			return len(response) >= 16 && int(binary.BigEndian.Uint16(response[8:10])) == internalPort
+		},
+	)
+	if err != nil {
+		return 0, 0, err
+	} else if result := binary.BigEndian.Uint16(response[2:4]); result != 0 {
+		return 0, 0, fmt.Errorf("nat-pmp mapping request failed with result %d", result)
+	}
+	mappedPort := int(binary.BigEndian.Uint16(response[10:12]))
+	mappedLifetime := time.Duration(binary.BigEndian.Uint32(response[12:16])) * time.Second
+	return mappedPort, mappedLifetime, nil
+}
+
+func (mapper *NATPMPMapper) AddPortMapping(internalPort int, lifetime time.Duration) (*PortMapping, error) {
+	externalIP, err := mapper.externalAddress()
+	if err != nil {
+		return nil, err
+	}
+	externalPort, mappedLifetime, err := mapper.mapPort(internalPort, internalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	return &PortMapping{externalIP, externalPort, internalPort, mappedLifetime}, nil
+}
+
+func (mapper *NATPMPMapper) DeletePortMapping(mapping *PortMapping) error {
+	_, _, err := mapper.mapPort(mapping.InternalPort, 0, 0)
+	return err
+}
+
+// Create a NAT-PMP port mapper for the gateway's ip address, with an optional port
+func NewNATPMPMapper(gateway string) (*NATPMPMapper, error) {
+	address, err := gatewayAddress(gateway)
+	if err != nil {
+		return nil, err
+	}
+	return &NATPMPMapper{address}, nil
+}
+
+// Maps ports with PCP, RFC 6887
+type PCPMapper struct {
+	gateway string
+	nonce   []byte
+}
+
+func (mapper *PCPMapper) Name() string {
+	return "pcp"
+}
+
+// Returns the PCP common request header
+func pcpRequestHeader(opcode byte, lifetime time.Duration, clientIP net.IP) []byte {
+	header := make([]byte, 24)
+	header[0] = pcpVersion
+	header[1] = opcode
+	binary.BigEndian.PutUint32(header[4:8], uint32(lifetime.Seconds()))
+	copy(header[8:24], clientIP.To16())
+	return header
+}
+
+// Returns the local ip address used to reach the gateway
+func (mapper *PCPMapper) clientIP() (net.IP, error) {
+	conn, err := net.Dial("udp4", mapper.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// Check the gateway speaks PCP
+func (mapper *PCPMapper) announce() error {
+	clientIP, err := mapper.clientIP()
+	if err != nil {
+		return err
+	}
+	_, err = natGatewayRequest(
+		mapper.gateway,
+		pcpRequestHeader(pcpOpAnnounce, 0, clientIP),
+		pcpVersion,
+		pcpOpAnnounce,
+		func(response []byte) bool { return len(response) >= 24 },
+	)
+	return err
+}
+
+// Request a tcp mapping, a zero lifetime removes the mapping
+func (mapper *PCPMapper) mapPort(internalPort, externalPort int, lifetime time.Duration) (*PortMapping, error) {
+	clientIP, err := mapper.clientIP()
+	if err != nil {
+		return nil, err
+	}
+
+	request := pcpRequestHeader(pcpOpMap, lifetime, clientIP)
+	body := make([]byte, 36)
+	copy(body[0:12], mapper.nonce)
+	body[12] = tcpProtocolNumber
+	binary.BigEndian.PutUint16(body[16:18], uint16(internalPort))
+	binary.BigEndian.PutUint16(body[18:20], uint16(externalPort))
+	copy(body[20:36], net.IPv4zero.To16())
+	request = append(request, body...)
+
+	response, err := natGatewayRequest(
+		mapper.gateway,
+		request,
+		pcpVersion,
+		pcpOpMap,
+		func(response []byte) bool {
+			return len(response) >= 60 && bytes.Equal(response[24:36], mapper.nonce)
+		},
+	)
+	if err != nil {
+		return nil, err
+	} else if result := response[3]; result != 0 {
+		return nil, fmt.Errorf("pcp mapping request failed with result %d", result)
+	}
+	return &PortMapping{
+		ExternalIP:   net.IP(response[44:60]).String(),
+		ExternalPort: int(binary.BigEndian.Uint16(response[42:44])),
+		InternalPort: internalPort,
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(response[4:8])) * time.Second,
+	}, nil
+}
+
+func (mapper *PCPMapper) AddPortMapping(internalPort int, lifetime time.Duration) (*PortMapping, error) {
+	return mapper.mapPort(internalPort, internalPort, lifetime)
+}
+
+func (mapper *PCPMapper) DeletePortMapping(mapping *PortMapping) error {
+	_, err := mapper.mapPort(mapping.InternalPort, 0, 0)
+	return err
+}
+
+// Create a PCP port mapper for the gateway's ip address, with an optional port
+func NewPCPMapper(gateway string) (*PCPMapper, error) {
+	address, err := gatewayAddress(gateway)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &PCPMapper{address, nonce}, nil
+}
@@ -0,0 +1,77 @@
+package coalition
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tracks the public ip addresses remote peers observe the host's connections from.
+// An address is only trusted once enough peers from different subnets agree on it.
+type observedAddrBook struct {
+	mutex        sync.Mutex
+	threshold    int
+	ttl          time.Duration
+	observations map[string]map[string]time.Time
+}
+
+// Record an observation of the host's ip address by a peer.
+// Observers on the same public subnet count as a single observer.
+func (book *observedAddrBook) add(observedIP string, observerKey []byte, observerIP string) {
+	if IPAddressClass(observedIP) != PublicAddress {
+		return
+	}
+	observer := SubnetKey(observerIP)
+	if observer == "" {
+		observer = hex.EncodeToString(observerKey)
+	}
+
+	book.mutex.Lock()
+	defer book.mutex.Unlock()
+
+	book.prune()
+	if _, exists := book.observations[observedIP]; !exists {
+		book.observations[observedIP] = make(map[string]time.Time)
+	}
+	book.observations[observedIP][observer] = time.Now()
+}
+
+// Drop observations older than the ttl
+func (book *observedAddrBook) prune() {
+	for ip, observers := range book.observations {
+		for observer, observed := range observers {
+			if time.Since(observed) >= book.ttl {
+				delete(observers, observer)
+			}
+		}
+		if len(observers) == 0 {
+			delete(book.observations, ip)
+		}
+	}
+}
+
+// Returns the observed ip addresses confirmed by enough observers
+func (book *observedAddrBook) confirmed() []string {
+	book.mutex.Lock()
+	defer book.mutex.Unlock()
+
+	book.prune()
+	ips := make([]string, 0)
+	for ip, observers := range book.observations {
+		if len(observers) >= book.threshold {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// Create a new observed address book
+func newObservedAddrBook(threshold int, ttl time.Duration) *observedAddrBook {
+	return &observedAddrBook{
+		threshold:    threshold,
+		ttl:          ttl,
+		observations: make(map[string]map[string]time.Time),
+	}
+}
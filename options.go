@@ -1,6 +1,9 @@
 package coalition
 
-import "crypto/ed25519"
+import (
+	"crypto/ed25519"
+	"time"
+)
 
 type Option struct {
 	Name  string
@@ -17,6 +20,17 @@ func getOption(name string, opList []Option, defaultValue interface{}) interface
 	return defaultValue
 }
 
+// Quick helper to get all the values of a repeatable option within a list of options
+func getOptions(name string, opList []Option) []interface{} {
+	values := make([]interface{}, 0)
+	for i := 0; i < len(opList); i++ {
+		if opList[i].Name == name {
+			values = append(values, opList[i].Value)
+		}
+	}
+	return values
+}
+
 // The listening port to be used by the host
 func Port(port int) Option {
 	return Option{PortOption, port}
@@ -46,3 +60,221 @@ func PingPeriod(period int64) Option {
 func LatencyPeriod(period int64) Option {
 	return Option{LatencyPeriodOption, period}
 }
+
+// The max number of RPC handlers executing concurrently across all methods
+func MaxConcurrentHandlers(handlers int64) Option {
+	return Option{MaxConcurrentHandlersOption, handlers}
+}
+
+// The max number of concurrently executing handlers for an RPC method.
+// Can be specified multiple times for different methods.
+func MethodConcurrency(method string, handlers int64) Option {
+	return Option{MethodConcurrencyOption, methodLimit{method, handlers}}
+}
+
+// How long an RPC request is queued waiting for a free handler slot.
+// A zero timeout rejects requests immediately when the handlers are saturated.
+func HandlerQueueTimeout(timeout time.Duration) Option {
+	return Option{HandlerQueueTimeoutOption, timeout}
+}
+
+// The max number of inbound connections served at once
+func MaxInboundConnections(conns int64) Option {
+	return Option{MaxInboundConnectionsOption, conns}
+}
+
+// The max number of inbound connections served at once for a single remote ip address
+func MaxConnectionsPerIP(conns int64) Option {
+	return Option{MaxConnectionsPerIPOption, conns}
+}
+
+// How long a client has to send the request size header after connecting
+func HeaderReadTimeout(timeout time.Duration) Option {
+	return Option{HeaderReadTimeoutOption, timeout}
+}
+
+// Rate limit inbound calls of an RPC method per remote peer key.
+// Rate is in requests per second, use AnyMethod to limit all other methods.
+// Can be specified multiple times for different methods.
+func PeerRateLimit(method string, rate float64, burst int64) Option {
+	return Option{PeerRateLimitOption, methodRateLimit{method, RateLimit{rate, burst}}}
+}
+
+// Rate limit inbound calls of an RPC method per remote ip address.
+// Rate is in requests per second, use AnyMethod to limit all other methods.
+// Can be specified multiple times for different methods.
+func IPRateLimit(method string, rate float64, burst int64) Option {
+	return Option{IPRateLimitOption, methodRateLimit{method, RateLimit{rate, burst}}}
+}
+
+// The filter used to ban or allow peers by key and ip range
+func Filter(filter *PeerFilter) Option {
+	return Option{PeerFilterOption, filter}
+}
+
+// Join a private network secured by a 32 byte pre-shared key
+func PrivateNetwork(key []byte) Option {
+	return Option{PrivateNetworkOption, key}
+}
+
+// How far a signed request timestamp may drift from the host's clock before it's rejected
+func ReplayWindow(window time.Duration) Option {
+	return Option{ReplayWindowOption, window}
+}
+
+// The max number of request nonces remembered to detect replayed requests
+func ReplayCacheSize(size int64) Option {
+	return Option{ReplayCacheSizeOption, size}
+}
+
+// Require peer keys to solve the S/Kademlia static and dynamic crypto puzzles.
+// Difficulties are the number of leading zero bits required.
+func CryptoPuzzle(staticDifficulty, dynamicDifficulty int) Option {
+	return Option{CryptoPuzzleOption, puzzleDifficulty{staticDifficulty, dynamicDifficulty}}
+}
+
+// The host's solution to the dynamic crypto puzzle for it's identity
+func PuzzleSolution(solution []byte) Option {
+	return Option{PuzzleSolutionOption, solution}
+}
+
+// The number of disjoint paths used when looking up the closest nodes to a key.
+// A single path runs the classic merged kademlia lookup.
+func DisjointPaths(paths int) Option {
+	return Option{DisjointPathsOption, paths}
+}
+
+// The max number of peers from the same ip4 /24 or ip6 /48 subnet
+// in a kbucket and across the route table. Zero disables a limit.
+func SubnetLimits(perBucket, perTable int64) Option {
+	return Option{SubnetLimitsOption, subnetLimits{perBucket, perTable}}
+}
+
+// The half life of peer scores, scores decay towards zero over time
+func ScoreHalfLife(halfLife time.Duration) Option {
+	return Option{ScoreHalfLifeOption, halfLife}
+}
+
+// Peers scoring below the threshold are evicted first and skipped in lookups
+func ScoreThreshold(threshold float64) Option {
+	return Option{ScoreThresholdOption, threshold}
+}
+
+// How long a signed peer record is trusted after it was signed
+func PeerRecordTTL(ttl time.Duration) Option {
+	return Option{PeerRecordTTLOption, ttl}
+}
+
+// Limit the rate at which inbound peers are dialed back to check they're reachable.
+// Rate is in dials per second.
+func DialBackRateLimit(rate float64, burst int64) Option {
+	return Option{DialBackRateLimitOption, RateLimit{rate, burst}}
+}
+
+// Set how long the result of a dial back check is trusted
+func DialBackCacheTTL(ttl time.Duration) Option {
+	return Option{DialBackCacheTTLOption, ttl}
+}
+
+// Set the max number of peers waiting to be dialed back
+func DialBackQueueSize(size int64) Option {
+	return Option{DialBackQueueSizeOption, size}
+}
+
+// Set the user agent reported by the identify RPC method
+func AgentVersion(agent string) Option {
+	return Option{AgentVersionOption, agent}
+}
+
+// Listen on an ip4 address or the first ip4 address of a network interface
+func ListenAddress(address string) Option {
+	return Option{ListenAddressOption, address}
+}
+
+// Advertise the addresses instead of the host's interface addresses,
+// such as a load balancer or a public ip forwarding to the host.
+// Addresses are ip4 addresses with an optional port, the listening port is used if omitted.
+func AnnounceAddresses(addresses ...string) Option {
+	return Option{AnnounceAddressesOption, addresses}
+}
+
+// Leave addresses of the classes out of the host's addresses and find_node responses
+func ExcludeAddresses(classes ...AddressClass) Option {
+	return Option{ExcludeAddressesOption, classes}
+}
+
+// Map the host's port on the gateway with the port mapper and advertise the external address
+func NATPortMapping(mapper PortMapper) Option {
+	return Option{PortMapperOption, mapper}
+}
+
+// Serve as a circuit relay for peers that aren't publicly reachable, within the limits
+func EnableRelay(limits RelayLimits) Option {
+	return Option{RelayOption, limits}
+}
+
+// Keep a reservation on the relays and advertise the relayed addresses.
+// Relays are given by their node addresses.
+func StaticRelays(relays ...string) Option {
+	return Option{StaticRelaysOption, relays}
+}
+
+// Carry the host's connections over the transport instead of tcp
+func WithTransport(transport Transport) Option {
+	return Option{TransportOption, transport}
+}
+
+// Try to upgrade relayed connections to direct ones by hole punching through NATs
+func EnableHolePunching() Option {
+	return Option{HolePunchingOption, true}
+}
+
+// Find peers on the local network by announcing the host over udp multicast
+func EnableLocalDiscovery() Option {
+	return Option{LocalDiscoveryOption, true}
+}
+
+// Only discover local peers announcing the same service name
+func LocalDiscoveryServiceName(name string) Option {
+	return Option{LocalDiscoveryServiceNameOption, name}
+}
+
+// Period between the host's local announcements
+func LocalDiscoveryInterval(interval time.Duration) Option {
+	return Option{LocalDiscoveryIntervalOption, interval}
+}
+
+// Multicast group address and port local announcements are sent to
+func LocalDiscoveryGroup(address string) Option {
+	return Option{LocalDiscoveryGroupOption, address}
+}
+
+// Send and receive local announcements on the named network interface
+func LocalDiscoveryInterface(name string) Option {
+	return Option{LocalDiscoveryInterfaceOption, name}
+}
+
+// Resolve hostnames and dnsaddrs with the resolver instead of the system's
+func DNSResolver(resolver Resolver) Option {
+	return Option{ResolverOption, resolver}
+}
+
+// Spread published messages with the router, floodsub or gossipsub
+func PubSubRouter(router string) Option {
+	return Option{PubSubRouterOption, router}
+}
+
+// Max message data size of the topic, AnyTopic sets it for topics without their own
+func TopicMessageSize(topic string, size int) Option {
+	return Option{TopicMessageSizeOption, topicMessageSize{topic, size}}
+}
+
+// Rate limit of the messages each publisher sends to the topic, AnyTopic sets it for topics without their own
+func TopicRateLimit(topic string, rate float64, burst int64) Option {
+	return Option{TopicRateLimitOption, topicRateLimit{topic, RateLimit{rate, burst}}}
+}
+
+// Store the blocks of files with the block store, a file block store lets downloads resume after restarts
+func WithBlockStore(store BlockStore) Option {
+	return Option{BlockStoreOption, store}
+}
@@ -0,0 +1,317 @@
+package coalition
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A ban on a peer key or ip range.
+// A zero expiry means the ban is permanent.
+type Ban struct {
+	Target string    `json:"target"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// Returns true if the ban has lapsed
+func (ban Ban) Expired(now time.Time) bool {
+	return !ban.Expiry.IsZero() && now.After(ban.Expiry)
+}
+
+// The persisted bans of a peer filter
+type banFile struct {
+	Peers  []Ban `json:"peers"`
+	Ranges []Ban `json:"ranges"`
+}
+
+// Decides which peers the host accepts connections from, stores and dials.
+// Banned peer keys and ip ranges are always rejected.
+// In allowlist mode only allowed peer keys from allowed ip ranges are accepted,
+// an empty list rejects everyone so enabling the mode before adding entries doesn't open the host.
+type PeerFilter struct {
+	mutex         sync.RWMutex
+	banFilePath   string
+	bannedPeers   map[string]Ban
+	bannedRanges  map[string]Ban
+	allowlist     bool
+	allowedPeers  map[string]bool
+	allowedRanges map[string]*net.IPNet
+}
+
+// Parse a CIDR range or a single ip address into a network
+func parseIPRange(cidr string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(cidr); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(cidr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip range [%s]", cidr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Returns an expiry for a ban duration, zero durations never expire
+func banExpiry(duration time.Duration) time.Time {
+	if duration <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(duration)
+}
+
+// Write the bans to the ban file if one is configured
+func (filter *PeerFilter) save() error {
+	if filter.banFilePath == "" {
+		return nil
+	}
+
+	now := time.Now()
+	state := banFile{make([]Ban, 0), make([]Ban, 0)}
+	for _, ban := range filter.bannedPeers {
+		if !ban.Expired(now) {
+			state.Peers = append(state.Peers, ban)
+		}
+	}
+	for _, ban := range filter.bannedRanges {
+		if !ban.Expired(now) {
+			state.Ranges = append(state.Ranges, ban)
+		}
+	}
+	data, err := json.MarshalIndent(&state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a partial ban file
+	tmpFile, err := os.CreateTemp(filepath.Dir(filter.banFilePath), ".bans-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filter.banFilePath)
+}
+
+// Load the bans from the ban file if it exists
+func (filter *PeerFilter) load() error {
+	data, err := os.ReadFile(filter.banFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var state banFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, ban := range state.Peers {
+		if key, err := hex.DecodeString(ban.Target); err != nil || len(key) != PeerKeySize {
+			return fmt.Errorf("invalid banned peer key [%s]", ban.Target)
+		}
+		if !ban.Expired(now) {
+			filter.bannedPeers[ban.Target] = ban
+		}
+	}
+	for _, ban := range state.Ranges {
+		network, err := parseIPRange(ban.Target)
+		if err != nil {
+			return err
+		}
+		if !ban.Expired(now) {
+			filter.bannedRanges[network.String()] = Ban{network.String(), ban.Expiry}
+		}
+	}
+	return nil
+}
+
+// Ban a peer key for a duration, a zero duration bans the peer permanently
+func (filter *PeerFilter) BanPeer(key []byte, duration time.Duration) error {
+	if len(key) != PeerKeySize {
+		return fmt.Errorf("invalid peer key size")
+	}
+
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	target := hex.EncodeToString(key)
+	filter.bannedPeers[target] = Ban{target, banExpiry(duration)}
+	return filter.save()
+}
+
+// Lift the ban on a peer key
+func (filter *PeerFilter) UnbanPeer(key []byte) error {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	delete(filter.bannedPeers, hex.EncodeToString(key))
+	return filter.save()
+}
+
+// Ban a CIDR range or single ip address for a duration.
+// A zero duration bans the range permanently.
+func (filter *PeerFilter) BanRange(cidr string, duration time.Duration) error {
+	network, err := parseIPRange(cidr)
+	if err != nil {
+		return err
+	}
+
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	target := network.String()
+	filter.bannedRanges[target] = Ban{target, banExpiry(duration)}
+	return filter.save()
+}
+
+// Lift the ban on a CIDR range or single ip address
+func (filter *PeerFilter) UnbanRange(cidr string) error {
+	network, err := parseIPRange(cidr)
+	if err != nil {
+		return err
+	}
+
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	delete(filter.bannedRanges, network.String())
+	return filter.save()
+}
+
+// Returns the active bans on peer keys and ip ranges
+func (filter *PeerFilter) Bans() (peers []Ban, ranges []Ban) {
+	filter.mutex.RLock()
+	defer filter.mutex.RUnlock()
+
+	now := time.Now()
+	peers = make([]Ban, 0)
+	ranges = make([]Ban, 0)
+	for _, ban := range filter.bannedPeers {
+		if !ban.Expired(now) {
+			peers = append(peers, ban)
+		}
+	}
+	for _, ban := range filter.bannedRanges {
+		if !ban.Expired(now) {
+			ranges = append(ranges, ban)
+		}
+	}
+	return
+}
+
+// Only accept allowed peer keys from allowed ip ranges when enabled.
+// Allow the range 0.0.0.0/0 to accept allowed peer keys from any ip address.
+func (filter *PeerFilter) SetAllowlistOnly(enabled bool) {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	filter.allowlist = enabled
+}
+
+// Add a peer key to the allowlist
+func (filter *PeerFilter) AllowPeer(key []byte) error {
+	if len(key) != PeerKeySize {
+		return fmt.Errorf("invalid peer key size")
+	}
+
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	filter.allowedPeers[hex.EncodeToString(key)] = true
+	return nil
+}
+
+// Add a CIDR range or single ip address to the allowlist
+func (filter *PeerFilter) AllowRange(cidr string) error {
+	network, err := parseIPRange(cidr)
+	if err != nil {
+		return err
+	}
+
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	filter.allowedRanges[network.String()] = network
+	return nil
+}
+
+// Returns true if connections from/to the ip address are accepted.
+// Invalid ip addresses such as relayed hosts are always rejected in allowlist mode.
+func (filter *PeerFilter) AllowsIP(ipAddress string) bool {
+	filter.mutex.RLock()
+	defer filter.mutex.RUnlock()
+
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return !filter.allowlist
+	}
+
+	now := time.Now()
+	for target, ban := range filter.bannedRanges {
+		if ban.Expired(now) {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(target); err == nil && network.Contains(ip) {
+			return false
+		}
+	}
+
+	if !filter.allowlist {
+		return true
+	}
+	for _, network := range filter.allowedRanges {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the peer key at the ip address is accepted
+func (filter *PeerFilter) AllowsPeer(key []byte, ipAddress string) bool {
+	if !filter.AllowsIP(ipAddress) {
+		return false
+	}
+
+	filter.mutex.RLock()
+	defer filter.mutex.RUnlock()
+
+	target := hex.EncodeToString(key)
+	if ban, banned := filter.bannedPeers[target]; banned && !ban.Expired(time.Now()) {
+		return false
+	}
+	if !filter.allowlist {
+		return true
+	}
+	return filter.allowedPeers[target]
+}
+
+// Create a new peer filter.
+// If a ban file path is specified bans are loaded from and persisted to it.
+func NewPeerFilter(banFilePath string) (*PeerFilter, error) {
+	filter := &PeerFilter{
+		banFilePath:   banFilePath,
+		bannedPeers:   make(map[string]Ban),
+		bannedRanges:  make(map[string]Ban),
+		allowedPeers:  make(map[string]bool),
+		allowedRanges: make(map[string]*net.IPNet),
+	}
+	if banFilePath != "" {
+		if err := filter.load(); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
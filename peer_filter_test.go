@@ -0,0 +1,144 @@
+package coalition
+
+import (
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeerFilterBans(t *testing.T) {
+	banFile := filepath.Join(t.TempDir(), "bans.json")
+	filter, err := NewPeerFilter(banFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyA := make([]byte, PeerKeySize)
+	keyB := make([]byte, PeerKeySize)
+	if _, err := rand.Read(keyA); err != nil {
+		t.Fatal(err)
+	} else if _, err := rand.Read(keyB); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := filter.BanPeer(keyA, 0); err != nil {
+		t.Fatal(err)
+	} else if err := filter.BanPeer(keyB, time.Millisecond); err != nil {
+		t.Fatal(err)
+	} else if err := filter.BanRange("10.0.0.0/8", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if filter.AllowsPeer(keyA, "192.168.0.1") {
+		t.Errorf("banned peer should not be allowed")
+	} else if filter.AllowsIP("10.1.2.3") {
+		t.Errorf("banned range should not be allowed")
+	} else if !filter.AllowsIP("11.1.2.3") {
+		t.Errorf("ip outside banned range should be allowed")
+	}
+
+	// Timed bans should lapse
+	time.Sleep(5 * time.Millisecond)
+	if !filter.AllowsPeer(keyB, "192.168.0.1") {
+		t.Errorf("expired ban should not block the peer")
+	}
+
+	// Bans should survive a reload from the ban file
+	reloaded, err := NewPeerFilter(banFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, ranges := reloaded.Bans()
+	if len(peers) != 1 || len(ranges) != 1 {
+		t.Errorf("expected 1 peer and 1 range ban, got %d and %d", len(peers), len(ranges))
+	} else if reloaded.AllowsPeer(keyA, "192.168.0.1") {
+		t.Errorf("banned peer should not be allowed after reload")
+	}
+
+	if err := reloaded.UnbanPeer(keyA); err != nil {
+		t.Fatal(err)
+	} else if !reloaded.AllowsPeer(keyA, "192.168.0.1") {
+		t.Errorf("unbanned peer should be allowed")
+	}
+}
+
+func TestPeerFilterAllowlist(t *testing.T) {
+	filter, err := NewPeerFilter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	known := make([]byte, PeerKeySize)
+	unknown := make([]byte, PeerKeySize)
+	if _, err := rand.Read(known); err != nil {
+		t.Fatal(err)
+	} else if _, err := rand.Read(unknown); err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty allowlists reject everyone
+	filter.SetAllowlistOnly(true)
+	if filter.AllowsIP("127.0.0.1") || filter.AllowsPeer(known, "127.0.0.1") {
+		t.Errorf("an empty allowlist should reject everyone")
+	}
+	if err := filter.AllowPeer(known); err != nil {
+		t.Fatal(err)
+	} else if filter.AllowsPeer(known, "127.0.0.1") {
+		t.Errorf("an empty range allowlist should reject every ip address")
+	}
+	rangesOnly, err := NewPeerFilter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rangesOnly.SetAllowlistOnly(true)
+	if err := rangesOnly.AllowRange("127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	} else if rangesOnly.AllowsPeer(known, "127.0.0.1") {
+		t.Errorf("an empty peer allowlist should reject every peer")
+	}
+	if err := filter.AllowRange("127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !filter.AllowsPeer(known, "127.0.0.1") {
+		t.Errorf("known peer should be allowed")
+	} else if filter.AllowsPeer(unknown, "127.0.0.1") {
+		t.Errorf("unknown peer should not be allowed")
+	} else if filter.AllowsPeer(known, "8.8.8.8") {
+		t.Errorf("known peer outside the allowed range should not be allowed")
+	}
+}
+
+func TestBannedPeerConnection(t *testing.T) {
+	hostA, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostA.Listen()
+	defer hostA.Close()
+
+	hostB, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostB.Listen()
+	defer hostB.Close()
+
+	hostBKey := hostB.PeerKey()
+	if err := hostA.Filter().BanPeer(hostBKey[:], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := hostA.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hostB.Ping(addrs[0])
+	if rpcErr, ok := err.(*RPCError); !ok || rpcErr.Code != RPCCodeForbidden {
+		t.Errorf("expected a forbidden error, got %v", err)
+	}
+	if len(hostA.RouteTable().Peers()) != 0 {
+		t.Errorf("banned peer should not be in the route table")
+	}
+}
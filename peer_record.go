@@ -0,0 +1,126 @@
+package coalition
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Domain separation prefix for peer record signatures
+var peerRecordDomain = []byte("coalition-peer-record")
+
+// A peer's set of addresses signed by the peer's own key.
+// The sequence number is the unix time in nanoseconds when the record was signed,
+// newer records replace older ones.
+type PeerRecord struct {
+	PublicKey string   `json:"public_key"`
+	Addresses []string `json:"addresses"`
+	Seq       uint64   `json:"seq,string"`
+	Signature string   `json:"signature"`
+}
+
+// Returns the digest signed by the record's key
+func (record *PeerRecord) digest() []byte {
+	hash := sha256.New()
+	hash.Write(peerRecordDomain)
+	hash.Write([]byte(record.PublicKey))
+	hash.Write(Uint64ToBytes(record.Seq))
+	for _, address := range record.Addresses {
+		hash.Write(Uint64ToBytes(uint64(len(address))))
+		hash.Write([]byte(address))
+	}
+	return hash.Sum(nil)
+}
+
+// Returns the peer key of the record's public key
+func (record *PeerRecord) PeerKey() ([]byte, error) {
+	publicKey, err := hex.DecodeString(record.PublicKey)
+	if err != nil {
+		return nil, err
+	} else if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid peer record public key")
+	}
+	peerKey := sha1.Sum(publicKey)
+	return peerKey[:], nil
+}
+
+// Verify the record signature, that every address belongs to the record's key
+// and that the record was signed within the ttl. Returns the record's peer key.
+func (record *PeerRecord) Verify(ttl time.Duration) ([]byte, error) {
+	peerKey, err := record.PeerKey()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, _ := hex.DecodeString(record.PublicKey)
+	signature, err := hex.DecodeString(record.Signature)
+	if err != nil {
+		return nil, err
+	} else if !ed25519.Verify(publicKey, record.digest(), signature) {
+		return nil, fmt.Errorf("invalid peer record signature")
+	}
+
+	signedAt := time.Unix(0, int64(record.Seq))
+	if time.Since(signedAt) > ttl {
+		return nil, fmt.Errorf("peer record has expired")
+	} else if time.Until(signedAt) > PeerRecordClockDrift {
+		return nil, fmt.Errorf("peer record is from the future")
+	}
+
+	if len(record.Addresses) == 0 {
+		return nil, fmt.Errorf("peer record has no addresses")
+	}
+	for _, address := range record.Addresses {
+		key, _, _, err := ParsePeerAddress(address)
+		if err != nil {
+			return nil, err
+		} else if !bytes.Equal(key, peerKey) {
+			return nil, fmt.Errorf("peer record address belongs to another peer")
+		}
+	}
+	return peerKey, nil
+}
+
+// Pick the record address best suited for dialing from a referrer's ip address.
+// Direct addresses in the same class (loopback, link-local, private or public) as the referrer
+// are preferred, then other direct addresses and lastly relayed addresses.
+func (record *PeerRecord) PreferredAddress(referrerIP string) string {
+	referrerClass := IPAddressClass(referrerIP)
+	for _, address := range record.Addresses {
+		_, ip, _, err := ParseNodeAddress(address)
+		if err == nil && IPAddressClass(ip) == referrerClass {
+			return address
+		}
+	}
+	for _, address := range record.Addresses {
+		if !IsRelayAddress(address) {
+			return address
+		}
+	}
+	return record.Addresses[0]
+}
+
+// Create a new peer record for the addresses signed with the private key
+func NewPeerRecord(key ed25519.PrivateKey, addresses []string) (*PeerRecord, error) {
+	publicKey := key.Public().(ed25519.PublicKey)
+	record := &PeerRecord{
+		PublicKey: hex.EncodeToString(publicKey),
+		Addresses: addresses,
+		Seq:       uint64(time.Now().UnixNano()),
+	}
+	record.Signature = hex.EncodeToString(ed25519.Sign(key, record.digest()))
+	return record, nil
+}
+
+// Create a new peer from a verified peer record, dialed through the preferred address
+func NewPeerFromRecord(record *PeerRecord, referrerIP string) (*Peer, error) {
+	peer, err := NewPeerFromAddress(record.PreferredAddress(referrerIP))
+	if err != nil {
+		return nil, err
+	}
+	peer.record = record
+	return peer, nil
+}
@@ -0,0 +1,63 @@
+package coalition
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"testing"
+	"time"
+)
+
+func TestPeerRecordVerification(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey := sha1.Sum(publicKey)
+	address, err := FormatNodeAddress(peerKey[:], "8.8.8.8", 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := NewPeerRecord(privateKey, []string{address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := record.Verify(time.Hour); err != nil {
+		t.Errorf("expected a valid record: %s", err)
+	}
+
+	// Tampered addresses break the signature
+	otherAddress, err := FormatNodeAddress(peerKey[:], "9.9.9.9", 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := *record
+	tampered.Addresses = []string{otherAddress}
+	if _, err := tampered.Verify(time.Hour); err == nil {
+		t.Errorf("expected a tampered record to be rejected")
+	}
+
+	// Addresses must belong to the record's key
+	otherKey := make([]byte, PeerKeySize)
+	if _, err := rand.Read(otherKey); err != nil {
+		t.Fatal(err)
+	}
+	foreignAddress, err := FormatNodeAddress(otherKey, "8.8.8.8", 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := NewPeerRecord(privateKey, []string{foreignAddress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := foreign.Verify(time.Hour); err == nil {
+		t.Errorf("expected a record with another peer's address to be rejected")
+	}
+
+	// Old records expire
+	time.Sleep(5 * time.Millisecond)
+	if _, err := record.Verify(time.Millisecond); err == nil {
+		t.Errorf("expected an expired record to be rejected")
+	}
+}
@@ -0,0 +1,153 @@
+package coalition
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"time"
+)
+
+// Returns a random sample of the records of healthy peers in the host's route table.
+// Healthy peers have a valid record with an address the host advertises and a score
+// above the threshold. The sample is spread across subnets within the bucket diversity limit.
+func (host *Host) pexSample(exclude []byte) []*PeerRecord {
+	peers := host.table.Peers()
+	candidates := make([]*Peer, 0)
+	for _, index := range mathrand.Perm(len(peers)) {
+		peer := peers[index]
+		if bytes.Equal(peer.Key(), exclude) {
+			continue
+		} else if !host.filter.AllowsPeer(peer.Key(), peer.IPAddress()) {
+			continue
+		} else if host.scores.Value(peer.Key()) < host.scoreThreshold {
+			continue
+		} else if peer.Record() == nil {
+			continue
+		} else if _, err := peer.Record().Verify(host.recordTTL); err != nil {
+			continue
+		} else if !host.advertisesRecord(peer.Record()) {
+			continue
+		}
+		candidates = append(candidates, peer)
+	}
+
+	records := make([]*PeerRecord, 0)
+	for _, peer := range LimitPeersPerSubnet(candidates, host.subnetLimits.perBucket) {
+		if len(records) >= PexSampleSize {
+			break
+		}
+		records = append(records, peer.Record())
+	}
+	return records
+}
+
+// Parse a sample of peer records sent by a peer
+func parsePexSample(data interface{}) ([]*PeerRecord, error) {
+	serialized, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var records []*PeerRecord
+	if err := json.Unmarshal(serialized, &records); err != nil {
+		return nil, fmt.Errorf("expected an array of peer records")
+	}
+	return records, nil
+}
+
+// Queue the peers of a sample the host doesn't know yet to be dialed back,
+// which inserts them into the route table once they answer.
+// Invalid records count against the peer that sent them.
+// Returns the verified records.
+func (host *Host) acceptPexSample(senderKey []byte, senderIP string, records []*PeerRecord) []*PeerRecord {
+	if len(records) > PexSampleSize {
+		host.scores.Record(senderKey, ScoreEventMalformedResponse)
+		records = records[:PexSampleSize]
+	}
+
+	hostKey := host.PeerKey()
+	verified := make([]*PeerRecord, 0)
+	for _, record := range records {
+		if record == nil {
+			host.scores.Record(senderKey, ScoreEventMalformedResponse)
+			continue
+		}
+		key, err := record.Verify(host.recordTTL)
+		if err != nil {
+			host.scores.Record(senderKey, ScoreEventInvalidSignature)
+			continue
+		}
+		verified = append(verified, record)
+
+		if bytes.Equal(key, hostKey[:]) || host.table.Get(key) != nil {
+			continue
+		} else if host.scores.Value(key) < host.scoreThreshold {
+			continue
+		}
+
+		// Relayed peers can't be dialed back
+		peer, err := NewPeerFromRecord(record, senderIP)
+		if err != nil || peer.Relay() != "" {
+			continue
+		} else if !host.filter.AllowsPeer(peer.Key(), peer.IPAddress()) {
+			continue
+		}
+		host.dialBack.enqueue(peer.Key(), peer.IPAddress(), peer.Port())
+	}
+	return verified
+}
+
+// Swap samples of healthy peers with the peer at the address.
+// Returns the verified records of the peer's sample, whose peers are dialed and inserted in the background.
+func (host *Host) ExchangePeers(address string) ([]*PeerRecord, error) {
+	key, ip, _, err := ParsePeerAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	response, err := host.SendMessage(address, 1, PexMethod, host.pexSample(key))
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := parsePexSample(response)
+	if err != nil {
+		host.recordAddressEvent(address, ScoreEventMalformedResponse)
+		return nil, err
+	}
+	return host.acceptPexSample(key, ip, records), nil
+}
+
+// Handles pex requests which swap samples of healthy peers.
+// The caller's sample is taken in and a sample of the host's peers is returned.
+func PexHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	records, err := parsePexSample(req.Data)
+	if err != nil {
+		return nil, err
+	}
+	host.acceptPexSample(remotePeer.Key(), remotePeer.IPAddress(), records)
+	return host.pexSample(remotePeer.Key()), nil
+}
+
+// A long running service that swaps peer samples with random peers within it's route table
+func (host *Host) startPexService() {
+	for !host.closed.Load() {
+		peers := host.RouteTable().Peers()
+		for i, index := range mathrand.Perm(len(peers)) {
+			if i >= PexPeers {
+				break
+			}
+			peerAddr, err := peers[index].Address()
+			if err != nil {
+				continue
+			}
+			host.ExchangePeers(peerAddr)
+		}
+
+		// Exchange sooner while the route table is filling up
+		if len(peers) < PexSampleSize {
+			time.Sleep(PexPeriod / 10)
+		} else {
+			time.Sleep(PexPeriod)
+		}
+	}
+}
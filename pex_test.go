@@ -0,0 +1,74 @@
+package coalition
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func TestPeerExchange(t *testing.T) {
+	hub := newTestHost(t, ListenAddress("127.0.0.1"))
+	neighbours := make([]*Host, 3)
+	for i := range neighbours {
+		neighbours[i] = newTestHost(t, ListenAddress("127.0.0.1"))
+		if err := hub.Ping(testHostAddress(t, neighbours[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newcomer := newTestHost(t, ListenAddress("127.0.0.1"))
+
+	// The newcomer gets a sample of the hub's peers without itself in it
+	records, err := newcomer.ExchangePeers(testHostAddress(t, hub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newcomerKey := newcomer.PeerKey()
+	if len(records) != len(neighbours) {
+		t.Errorf("expected %d records, got %d", len(neighbours), len(records))
+	}
+	for _, record := range records {
+		if key, _ := record.PeerKey(); bytes.Equal(key, newcomerKey[:]) {
+			t.Errorf("expected the newcomer to be left out of it's own sample")
+		}
+	}
+
+	// The sampled peers are dialed and inserted into the newcomer's route table
+	waitForPeers(newcomer, len(neighbours)+1)
+	for _, neighbour := range neighbours {
+		key := neighbour.PeerKey()
+		if newcomer.RouteTable().Get(key[:]) == nil {
+			t.Errorf("expected the neighbour in the newcomer's route table")
+		}
+	}
+
+	// Invalid records count against the peer sending them
+	hubKey := hub.PeerKey()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := NewPeerRecord(key, []string{testHostAddress(t, neighbours[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.Addresses = []string{testHostAddress(t, hub)}
+	before := newcomer.Scores().Value(hubKey[:])
+	if verified := newcomer.acceptPexSample(hubKey[:], "127.0.0.1", []*PeerRecord{forged}); len(verified) != 0 {
+		t.Errorf("expected the forged record to be dropped")
+	}
+	if newcomer.Scores().Value(hubKey[:]) >= before {
+		t.Errorf("expected the forged record to count against the sender")
+	}
+
+	// Peers with a bad reputation are left out of samples
+	badKey := neighbours[0].PeerKey()
+	for hub.Scores().Value(badKey[:]) >= DefaultScoreThreshold {
+		hub.Scores().Record(badKey[:], ScoreEventInvalidSignature)
+	}
+	for _, record := range hub.pexSample(nil) {
+		if key, _ := record.PeerKey(); bytes.Equal(key, badKey[:]) {
+			t.Errorf("expected the badly scored peer to be left out")
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package coalition
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Size of the handshake nonces in bytes
+const pnetNonceSize = 32
+
+// Labels binding the handshake MACs and session keys to their purpose
+var (
+	pnetClientLabel   = []byte("coalition-pnet/client")
+	pnetServerLabel   = []byte("coalition-pnet/server")
+	pnetClientKeyInfo = []byte("coalition-pnet/client-to-server")
+	pnetServerKeyInfo = []byte("coalition-pnet/server-to-client")
+)
+
+// A connection within a private network.
+// Every write is sealed with AES-GCM under a session key derived from the pre-shared key.
+type pnetConn struct {
+	net.Conn
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+	sealer     cipher.AEAD
+	opener     cipher.AEAD
+	sealCount  uint64
+	openCount  uint64
+	plaintext  []byte
+}
+
+// Returns the GCM nonce for a frame counter
+func pnetFrameNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-Int64Len:], counter)
+	return nonce
+}
+
+// Seal and write the data in frames of at most PrivateNetworkFrameSize bytes
+func (conn *pnetConn) Write(data []byte) (int, error) {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	written := 0
+	for written < len(data) {
+		end := written + PrivateNetworkFrameSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		sealed := conn.sealer.Seal(nil, pnetFrameNonce(conn.sealer, conn.sealCount), data[written:end], nil)
+		conn.sealCount++
+
+		frame := make([]byte, 4, 4+len(sealed))
+		binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+		frame = append(frame, sealed...)
+		if _, err := conn.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// Read and open the next frame when the buffered plaintext has been consumed
+func (conn *pnetConn) Read(data []byte) (int, error) {
+	conn.readMutex.Lock()
+	defer conn.readMutex.Unlock()
+
+	for len(conn.plaintext) == 0 {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn.Conn, header); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > PrivateNetworkFrameSize+uint32(conn.opener.Overhead()) {
+			return 0, fmt.Errorf("private network frame exceeds max size")
+		}
+
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(conn.Conn, sealed); err != nil {
+			return 0, err
+		}
+		plaintext, err := conn.opener.Open(nil, pnetFrameNonce(conn.opener, conn.openCount), sealed, nil)
+		if err != nil {
+			return 0, fmt.Errorf("invalid private network frame")
+		}
+		conn.openCount++
+		conn.plaintext = plaintext
+	}
+
+	n := copy(data, conn.plaintext)
+	conn.plaintext = conn.plaintext[n:]
+	return n, nil
+}
+
+// Computes the HMAC-SHA256 of the data parts under the key
+func pnetMAC(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// Create an AES-GCM cipher from a session key
+func pnetCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Derive the session ciphers from the pre-shared key and both handshake nonces
+func newPnetConn(conn net.Conn, psk, clientNonce, serverNonce []byte, isClient bool) (*pnetConn, error) {
+	clientCipher, err := pnetCipher(pnetMAC(psk, pnetClientKeyInfo, clientNonce, serverNonce))
+	if err != nil {
+		return nil, err
+	}
+	serverCipher, err := pnetCipher(pnetMAC(psk, pnetServerKeyInfo, clientNonce, serverNonce))
+	if err != nil {
+		return nil, err
+	}
+
+	if isClient {
+		return &pnetConn{Conn: conn, sealer: clientCipher, opener: serverCipher}, nil
+	}
+	return &pnetConn{Conn: conn, sealer: serverCipher, opener: clientCipher}, nil
+}
+
+// Perform the client side of the private network handshake on a dialed connection
+func PrivateNetworkClient(conn net.Conn, psk []byte) (net.Conn, error) {
+	if len(psk) != PrivateNetworkKeySize {
+		return nil, fmt.Errorf("private network key must be %d bytes", PrivateNetworkKeySize)
+	}
+	conn.SetDeadline(time.Now().Add(TCPIODeadline))
+	defer conn.SetDeadline(time.Time{})
+
+	// Prove knowledge of the network key with a fresh nonce
+	clientNonce := make([]byte, pnetNonceSize)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return nil, err
+	}
+	hello := append(clientNonce, pnetMAC(psk, pnetClientLabel, clientNonce)...)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+
+	// Verify the server knows the network key too
+	reply := make([]byte, pnetNonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	serverNonce := reply[:pnetNonceSize]
+	expectedMAC := pnetMAC(psk, pnetServerLabel, clientNonce, serverNonce)
+	if !hmac.Equal(reply[pnetNonceSize:], expectedMAC) {
+		return nil, fmt.Errorf("private network key mismatch")
+	}
+
+	return newPnetConn(conn, psk, clientNonce, serverNonce, true)
+}
+
+// Perform the server side of the private network handshake on an accepted connection.
+// The client must complete its part of the handshake within the timeout.
+func PrivateNetworkServer(conn net.Conn, psk []byte, timeout time.Duration) (net.Conn, error) {
+	if len(psk) != PrivateNetworkKeySize {
+		return nil, fmt.Errorf("private network key must be %d bytes", PrivateNetworkKeySize)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// Verify the client knows the network key
+	hello := make([]byte, pnetNonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return nil, err
+	}
+	clientNonce := hello[:pnetNonceSize]
+	if !hmac.Equal(hello[pnetNonceSize:], pnetMAC(psk, pnetClientLabel, clientNonce)) {
+		return nil, fmt.Errorf("private network key mismatch")
+	}
+
+	// Prove knowledge of the network key, bound to the client's nonce
+	serverNonce := make([]byte, pnetNonceSize)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	reply := append(serverNonce, pnetMAC(psk, pnetServerLabel, clientNonce, serverNonce)...)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+
+	return newPnetConn(conn, psk, clientNonce, serverNonce, false)
+}
@@ -0,0 +1,302 @@
+package coalition
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A provider's signed record held until it expires
+type providerEntry struct {
+	record  *PeerRecord
+	expires time.Time
+}
+
+// Stores the peers providing keys on behalf of the network, and the keys the host provides itself
+type providerStore struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	providers map[string]map[string]providerEntry
+	provided  map[string][]byte
+}
+
+// Remove expired providers
+func (store *providerStore) prune() {
+	for key, providers := range store.providers {
+		for providerKey, entry := range providers {
+			if time.Now().After(entry.expires) {
+				delete(providers, providerKey)
+			}
+		}
+		if len(providers) == 0 {
+			delete(store.providers, key)
+		}
+	}
+}
+
+// Store the provider's record under the key, refreshing the entry of a known provider
+func (store *providerStore) add(key, providerKey []byte, record *PeerRecord) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.prune()
+
+	hexKey := hex.EncodeToString(key)
+	providers, exists := store.providers[hexKey]
+	if !exists {
+		if len(store.providers) >= MaxProviderKeys {
+			return fmt.Errorf("provider store is full")
+		}
+		providers = make(map[string]providerEntry)
+		store.providers[hexKey] = providers
+	}
+	hexProviderKey := hex.EncodeToString(providerKey)
+	if _, known := providers[hexProviderKey]; !known && len(providers) >= MaxProvidersPerKey {
+		return fmt.Errorf("too many providers for key")
+	}
+	providers[hexProviderKey] = providerEntry{record, time.Now().Add(store.ttl)}
+	return nil
+}
+
+// Returns the records of the key's providers
+func (store *providerStore) get(key []byte) []*PeerRecord {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.prune()
+
+	records := make([]*PeerRecord, 0)
+	for _, entry := range store.providers[hex.EncodeToString(key)] {
+		records = append(records, entry.record)
+	}
+	return records
+}
+
+// Track a key provided by the host so it's republished
+func (store *providerStore) provide(key []byte) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.provided[hex.EncodeToString(key)] = key
+}
+
+// Stop republishing a key provided by the host
+func (store *providerStore) stopProviding(key []byte) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.provided, hex.EncodeToString(key))
+}
+
+// Returns the keys provided by the host
+func (store *providerStore) providedKeys() [][]byte {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	keys := make([][]byte, 0, len(store.provided))
+	for _, key := range store.provided {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func newProviderStore(ttl time.Duration) *providerStore {
+	return &providerStore{
+		ttl:       ttl,
+		providers: make(map[string]map[string]providerEntry),
+		provided:  make(map[string][]byte),
+	}
+}
+
+// Parse a provider key sent as a hex string
+func parseProviderKey(data interface{}) ([]byte, error) {
+	hexKey, ok := data.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a hex encoded key")
+	}
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, err
+	} else if len(key) != PeerKeySize {
+		return nil, fmt.Errorf("invalid key length")
+	}
+	return key, nil
+}
+
+// Announce the host as a provider of the key to the nodes closest to it.
+// The host keeps republishing the key until it stops providing it.
+func (host *Host) Provide(key []byte) error {
+	if len(key) != PeerKeySize {
+		return fmt.Errorf("invalid key length")
+	}
+	host.providers.provide(key)
+	return host.publishProvider(key)
+}
+
+// Stop republishing the key, the closest nodes forget the host once it's provider records expire
+func (host *Host) StopProviding(key []byte) {
+	host.providers.stopProviding(key)
+}
+
+// Store the host as a provider of the key with the nodes closest to it
+func (host *Host) publishProvider(key []byte) error {
+	peers, err := host.FindClosestNodes(key)
+	if err != nil {
+		return err
+	}
+	if len(peers) > ProviderReplication {
+		peers = peers[:ProviderReplication]
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	stored := 0
+	for _, peer := range peers {
+		peerAddr, err := peer.Address()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(peerAddr string) {
+			defer wg.Done()
+			if _, err := host.SendMessage(peerAddr, 1, AddProviderMethod, hex.EncodeToString(key)); err != nil {
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			stored++
+		}(peerAddr)
+	}
+	wg.Wait()
+
+	if len(peers) > 0 && stored == 0 {
+		return fmt.Errorf("none of the closest nodes stored the provider")
+	}
+	return nil
+}
+
+// Asks a peer for the signed records of the providers of a key.
+// Records that fail verification are dropped and count against the peer.
+func (host *Host) GetProviders(address string, key []byte) ([]*PeerRecord, error) {
+	response, err := host.SendMessage(address, 1, GetProvidersMethod, hex.EncodeToString(key))
+	if err != nil {
+		return nil, err
+	}
+
+	// Malformed responses count against the peer
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	var records []*PeerRecord
+	if err := json.Unmarshal(data, &records); err != nil || len(records) > MaxProvidersPerKey {
+		host.recordAddressEvent(address, ScoreEventMalformedResponse)
+		return nil, fmt.Errorf("expected an array of provider records as response")
+	}
+
+	verified := make([]*PeerRecord, 0)
+	for _, record := range records {
+		if record == nil {
+			host.recordAddressEvent(address, ScoreEventMalformedResponse)
+			continue
+		} else if _, err := record.Verify(host.recordTTL); err != nil {
+			host.recordAddressEvent(address, ScoreEventInvalidSignature)
+			continue
+		}
+		verified = append(verified, record)
+	}
+	return verified, nil
+}
+
+// Find the signed records of peers providing the key from the nodes closest to it.
+// The host itself is left out.
+func (host *Host) FindProviders(key []byte) ([]*PeerRecord, error) {
+	if len(key) != PeerKeySize {
+		return nil, fmt.Errorf("invalid key length")
+	}
+	peers, err := host.FindClosestNodes(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(peers) > ProviderReplication {
+		peers = peers[:ProviderReplication]
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	hostKey := host.PeerKey()
+	known := make(map[string]bool)
+	records := make([]*PeerRecord, 0)
+	addRecords := func(found []*PeerRecord) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, record := range found {
+			providerKey, err := record.Verify(host.recordTTL)
+			if err != nil || bytes.Equal(providerKey, hostKey[:]) {
+				continue
+			} else if known[hex.EncodeToString(providerKey)] || len(records) >= MaxProvidersPerKey {
+				continue
+			}
+			known[hex.EncodeToString(providerKey)] = true
+			records = append(records, record)
+		}
+	}
+
+	addRecords(host.providers.get(key))
+	for _, peer := range peers {
+		peerAddr, err := peer.Address()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(peerAddr string) {
+			defer wg.Done()
+			found, err := host.GetProviders(peerAddr, key)
+			if err != nil {
+				return
+			}
+			addRecords(found)
+		}(peerAddr)
+	}
+	wg.Wait()
+	return records, nil
+}
+
+// Handles add_provider requests which store the caller as a provider of a key.
+// The caller's signed record is kept so peers looking the key up can reach it.
+func AddProviderHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	key, err := parseProviderKey(req.Data)
+	if err != nil {
+		return nil, err
+	}
+	if req.Record == nil {
+		return nil, fmt.Errorf("providers must send their peer record")
+	}
+	recordKey, err := req.Record.Verify(host.recordTTL)
+	if err != nil {
+		return nil, err
+	} else if !bytes.Equal(recordKey, remotePeer.Key()) {
+		return nil, fmt.Errorf("peer record belongs to another peer")
+	}
+	if err := host.providers.add(key, remotePeer.Key(), req.Record); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// Handles get_providers requests which return the records of a key's providers
+func GetProvidersHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	key, err := parseProviderKey(req.Data)
+	if err != nil {
+		return nil, err
+	}
+	return host.providers.get(key), nil
+}
+
+// A long running service that republishes the keys provided by the host before their records expire
+func (host *Host) startProviderService() {
+	for !host.closed.Load() {
+		time.Sleep(ProviderRepublishPeriod)
+		for _, key := range host.providers.providedKeys() {
+			host.publishProvider(key)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package coalition
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+)
+
+// Create hosts on the loopback address that know each other
+func newTestNetwork(t *testing.T, size int, options ...Option) []*Host {
+	hosts := make([]*Host, size)
+	for i := range hosts {
+		hosts[i] = newTestHost(t, append([]Option{ListenAddress("127.0.0.1")}, options...)...)
+	}
+	for i := range hosts {
+		for j := range hosts {
+			if i != j {
+				if err := hosts[i].Ping(testHostAddress(t, hosts[j])); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	for _, host := range hosts {
+		waitForPeers(host, size-1)
+	}
+	return hosts
+}
+
+func TestProviders(t *testing.T) {
+	hosts := newTestNetwork(t, 4)
+	key := sha1.Sum([]byte("content"))
+	if err := hosts[1].Provide(key[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Providers are found through the closest nodes, without the host itself
+	providerKey := hosts[1].PeerKey()
+	for i, host := range hosts {
+		records, err := host.FindProviders(key[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := 1
+		if i == 1 {
+			expected = 0
+		}
+		if len(records) != expected {
+			t.Fatalf("expected %d providers, got %d", expected, len(records))
+		}
+		if expected == 1 {
+			if recordKey, _ := records[0].PeerKey(); !bytes.Equal(recordKey, providerKey[:]) {
+				t.Errorf("expected the provider's record")
+			}
+		}
+	}
+
+	// Unknown keys have no providers and invalid keys are rejected
+	unknown := sha1.Sum([]byte("unknown"))
+	if records, err := hosts[0].GetProviders(testHostAddress(t, hosts[2]), unknown[:]); err != nil {
+		t.Fatal(err)
+	} else if len(records) != 0 {
+		t.Errorf("expected no providers of an unknown key")
+	}
+	if _, err := hosts[0].SendMessage(testHostAddress(t, hosts[2]), 1, AddProviderMethod, "abcd"); err == nil {
+		t.Errorf("expected invalid keys to be rejected")
+	}
+
+	// Keys the host stops providing are no longer republished
+	hosts[1].StopProviding(key[:])
+	if len(hosts[1].providers.providedKeys()) != 0 {
+		t.Errorf("expected no provided keys")
+	}
+}
@@ -0,0 +1,709 @@
+package coalition
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"sync"
+	"time"
+)
+
+// Domain separation prefixes for pubsub message signatures and topic keys
+var pubSubMessageDomain = []byte("coalition-pubsub-message")
+var pubSubTopicDomain = []byte("coalition-pubsub-topic")
+
+// A message published to a topic and signed by it's publisher.
+// The publisher's key and sequence number identify the message.
+type PubSubMessage struct {
+	From      string `json:"from"`
+	Seqno     uint64 `json:"seqno,string"`
+	Topic     string `json:"topic"`
+	Data      []byte `json:"data"`
+	Signature string `json:"signature"`
+}
+
+// Returns the message id
+func (message *PubSubMessage) ID() string {
+	return fmt.Sprintf("%s:%d", message.From, message.Seqno)
+}
+
+// Returns the digest signed by the publisher
+func (message *PubSubMessage) digest() []byte {
+	hash := sha256.New()
+	hash.Write(pubSubMessageDomain)
+	hash.Write([]byte(message.From))
+	hash.Write(Uint64ToBytes(message.Seqno))
+	hash.Write(Uint64ToBytes(uint64(len(message.Topic))))
+	hash.Write([]byte(message.Topic))
+	hash.Write(message.Data)
+	return hash.Sum(nil)
+}
+
+// Verify the publisher's signature, returns the publisher's peer key
+func (message *PubSubMessage) Verify() ([]byte, error) {
+	signature, err := hex.DecodeString(message.Signature)
+	if err != nil {
+		return nil, err
+	}
+	peerKey, err := RecoverPeerKeyFromPeerSignature(signature, message.digest())
+	if err != nil {
+		return nil, err
+	} else if hex.EncodeToString(peerKey) != message.From {
+		return nil, fmt.Errorf("message was signed by another peer")
+	}
+	return peerKey, nil
+}
+
+// Returns the DHT key the subscribers of a topic provide
+func PubSubTopicKey(topic string) []byte {
+	key := sha1.Sum(append(append([]byte{}, pubSubTopicDomain...), []byte(topic)...))
+	return key[:]
+}
+
+// A local subscription receiving the messages published to a topic.
+// Messages are dropped while the subscription's buffer is full.
+type Subscription struct {
+	host     *Host
+	topic    string
+	messages chan *PubSubMessage
+}
+
+// Returns the subscribed topic
+func (sub *Subscription) Topic() string {
+	return sub.topic
+}
+
+// Returns the channel messages are delivered on, closed when the subscription is cancelled
+func (sub *Subscription) Messages() <-chan *PubSubMessage {
+	return sub.messages
+}
+
+// Cancel the subscription, the host leaves the topic once it's last subscription is cancelled
+func (sub *Subscription) Cancel() {
+	sub.host.unsubscribe(sub)
+}
+
+// A topic the host subscribes or recently published to
+type pubSubTopic struct {
+	subscriptions map[*Subscription]bool
+	peers         map[string]string
+	mesh          map[string]bool
+	lastPublished time.Time
+	lastDiscovery time.Time
+}
+
+// Returns true if the host subscribes to the topic
+func (topic *pubSubTopic) subscribed() bool {
+	return len(topic.subscriptions) > 0
+}
+
+func newPubSubTopic() *pubSubTopic {
+	return &pubSubTopic{
+		subscriptions: make(map[*Subscription]bool),
+		peers:         make(map[string]string),
+		mesh:          make(map[string]bool),
+	}
+}
+
+// Pubsub state of the host.
+// Recent messages are cached in windows shifted every heartbeat to answer IWANT requests.
+type pubSub struct {
+	mutex        sync.Mutex
+	router       string
+	topics       map[string]*pubSubTopic
+	seen         map[string]time.Time
+	cache        map[string]*PubSubMessage
+	history      [][]string
+	seqno        uint64
+	validators   map[string]TopicValidator
+	messageSizes map[string]int
+	limiter      *RateLimiter
+}
+
+// Mark the message as seen and cache it, returns false if it was already seen
+func (ps *pubSub) markSeen(message *PubSubMessage) bool {
+	id := message.ID()
+	if _, seen := ps.seen[id]; seen {
+		return false
+	}
+	ps.seen[id] = time.Now()
+	ps.cache[id] = message
+	ps.history[0] = append(ps.history[0], id)
+	return true
+}
+
+// Deliver a message to the host's subscriptions of it's topic
+func (ps *pubSub) deliver(message *PubSubMessage) {
+	topic, exists := ps.topics[message.Topic]
+	if !exists {
+		return
+	}
+	for sub := range topic.subscriptions {
+		select {
+		case sub.messages <- message:
+		default:
+		}
+	}
+}
+
+// Returns the ids of the topic's messages within the gossip windows
+func (ps *pubSub) gossipIDs(topic string) []string {
+	ids := make([]string, 0)
+	for i := 0; i < GossipSubHistoryGossip && i < len(ps.history); i++ {
+		for _, id := range ps.history[i] {
+			if message, cached := ps.cache[id]; cached && message.Topic == topic && len(ids) < MaxPubSubIDs {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// Shift the message cache windows, dropping the oldest, and forget expired message ids
+func (ps *pubSub) shift() {
+	for _, id := range ps.history[len(ps.history)-1] {
+		delete(ps.cache, id)
+	}
+	copy(ps.history[1:], ps.history[:len(ps.history)-1])
+	ps.history[0] = make([]string, 0)
+
+	for id, seenAt := range ps.seen {
+		if time.Since(seenAt) > PubSubSeenTTL {
+			delete(ps.seen, id)
+		}
+	}
+}
+
+// Remove the peer from every topic
+func (ps *pubSub) removePeer(hexKey string) {
+	for _, topic := range ps.topics {
+		delete(topic.peers, hexKey)
+		delete(topic.mesh, hexKey)
+	}
+}
+
+func newPubSub(router string, messageSizes map[string]int, limiter *RateLimiter) *pubSub {
+	return &pubSub{
+		router:       router,
+		topics:       make(map[string]*pubSubTopic),
+		seen:         make(map[string]time.Time),
+		cache:        make(map[string]*PubSubMessage),
+		history:      make([][]string, GossipSubHistoryLength),
+		seqno:        uint64(time.Now().UnixNano()),
+		validators:   make(map[string]TopicValidator),
+		messageSizes: messageSizes,
+		limiter:      limiter,
+	}
+}
+
+// A subscription change announced to a peer
+type pubSubSubscription struct {
+	Topic     string `json:"topic"`
+	Subscribe bool   `json:"subscribe"`
+}
+
+// Ids of recent messages of a topic gossiped to peers outside the mesh
+type pubSubIHave struct {
+	Topic string   `json:"topic"`
+	IDs   []string `json:"ids"`
+}
+
+// Pubsub requests and responses, carrying subscriptions, messages and gossipsub control messages
+type pubSubRPC struct {
+	Subscriptions []pubSubSubscription `json:"subscriptions,omitempty"`
+	Messages      []*PubSubMessage     `json:"messages,omitempty"`
+	IHave         []pubSubIHave        `json:"ihave,omitempty"`
+	IWant         []string             `json:"iwant,omitempty"`
+	Graft         []string             `json:"graft,omitempty"`
+	Prune         []string             `json:"prune,omitempty"`
+}
+
+// Returns true if the rpc carries nothing
+func (rpc *pubSubRPC) empty() bool {
+	return len(rpc.Subscriptions) == 0 && len(rpc.Messages) == 0 && len(rpc.IHave) == 0 &&
+		len(rpc.IWant) == 0 && len(rpc.Graft) == 0 && len(rpc.Prune) == 0
+}
+
+// Parse a pubsub rpc sent by a peer
+func parsePubSubRPC(data interface{}) (*pubSubRPC, error) {
+	serialized, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var rpc pubSubRPC
+	if err := json.Unmarshal(serialized, &rpc); err != nil {
+		return nil, fmt.Errorf("expected a pubsub rpc")
+	}
+	return &rpc, nil
+}
+
+// Returns a random order of the keys of the peers
+func shufflePeerKeys(peers map[string]string) []string {
+	keys := make([]string, 0, len(peers))
+	for key := range peers {
+		keys = append(keys, key)
+	}
+	mathrand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	return keys
+}
+
+// Send a pubsub rpc to the peer at the address and handle the peer's response.
+// Whatever the response calls for is sent back to the peer in turn, for at most
+// MaxPubSubReplyRounds rounds so peers can't keep the exchange going, the heartbeat handles the rest.
+// Peers that can't be reached are dropped from every topic.
+func (host *Host) sendPubSub(address string, rpc *pubSubRPC) error {
+	key, _, _, err := ParsePeerAddress(address)
+	if err != nil {
+		return err
+	}
+	for round := 0; ; round++ {
+		response, err := host.SendMessage(address, 1, PubSubMethod, rpc)
+		if err != nil {
+			host.pubsub.mutex.Lock()
+			host.pubsub.removePeer(hex.EncodeToString(key))
+			host.pubsub.mutex.Unlock()
+			return err
+		}
+
+		// Malformed responses count against the peer
+		responseRPC, err := parsePubSubRPC(response)
+		if err != nil {
+			host.scores.Record(key, ScoreEventMalformedResponse)
+			return err
+		}
+		reply := host.handlePubSub(key, address, responseRPC, false)
+		if reply.empty() || round >= MaxPubSubReplyRounds {
+			return nil
+		}
+		rpc = reply
+	}
+}
+
+// Handle a pubsub rpc from the peer at the address, returns what to send back to the peer.
+// Subscribers answer subscription requests with their own subscriptions, responses
+// are only answered when they announce a peer the host didn't know, so exchanges end.
+func (host *Host) handlePubSub(peerKey []byte, address string, rpc *pubSubRPC, request bool) *pubSubRPC {
+	ps := host.pubsub
+	reply := &pubSubRPC{}
+	hexKey := hex.EncodeToString(peerKey)
+
+	ps.mutex.Lock()
+	for i, sub := range rpc.Subscriptions {
+		if i >= MaxPubSubTopics {
+			break
+		}
+		topic, exists := ps.topics[sub.Topic]
+		if !exists {
+			continue
+		} else if !sub.Subscribe {
+			delete(topic.peers, hexKey)
+			delete(topic.mesh, hexKey)
+			continue
+		}
+		_, known := topic.peers[hexKey]
+		if !known && len(topic.peers) >= MaxPubSubTopicPeers {
+			continue
+		}
+		topic.peers[hexKey] = address
+		if topic.subscribed() && (request || !known) {
+			reply.Subscriptions = append(reply.Subscriptions, pubSubSubscription{sub.Topic, true})
+		}
+	}
+
+	// Grafts are pruned right away when the host isn't in the topic's mesh or it's mesh is full
+	for i, name := range rpc.Graft {
+		if i >= MaxPubSubTopics {
+			break
+		}
+		topic, exists := ps.topics[name]
+		if !exists || !topic.subscribed() || ps.router != GossipSubRouter || len(topic.mesh) >= GossipSubDhi {
+			reply.Prune = append(reply.Prune, name)
+			continue
+		}
+		if _, known := topic.peers[hexKey]; !known && len(topic.peers) >= MaxPubSubTopicPeers {
+			reply.Prune = append(reply.Prune, name)
+			continue
+		}
+		topic.peers[hexKey] = address
+		topic.mesh[hexKey] = true
+	}
+	for i, name := range rpc.Prune {
+		if i >= MaxPubSubTopics {
+			break
+		}
+		if topic, exists := ps.topics[name]; exists {
+			delete(topic.mesh, hexKey)
+		}
+	}
+
+	// Answer IWANT with cached messages and IHAVE with the ids the host hasn't seen
+	for i, id := range rpc.IWant {
+		if i >= MaxPubSubIDs {
+			break
+		}
+		if message, cached := ps.cache[id]; cached {
+			reply.Messages = append(reply.Messages, message)
+		}
+	}
+	wanted := make(map[string]bool)
+	for i, ihave := range rpc.IHave {
+		if i >= MaxPubSubTopics {
+			break
+		}
+		if topic, exists := ps.topics[ihave.Topic]; !exists || !topic.subscribed() {
+			continue
+		}
+		for _, id := range ihave.IDs {
+			if _, seen := ps.seen[id]; !seen && !wanted[id] && len(reply.IWant) < MaxPubSubIDs {
+				wanted[id] = true
+				reply.IWant = append(reply.IWant, id)
+			}
+		}
+	}
+	ps.mutex.Unlock()
+
+	for i, message := range rpc.Messages {
+		if i >= MaxPubSubMessages {
+			host.scores.Record(peerKey, ScoreEventMalformedResponse)
+			break
+		}
+		host.receivePubSubMessage(peerKey, message)
+	}
+	return reply
+}
+
+// Validate, deliver and forward a message received from a peer.
+// Floodsub forwards messages to every peer of the topic, gossipsub to the topic's mesh.
+// Messages with invalid signatures or rejected by validation count against the peer and are dropped.
+func (host *Host) receivePubSubMessage(peerKey []byte, message *PubSubMessage) {
+	ps := host.pubsub
+	if message == nil || message.Topic == "" {
+		host.scores.Record(peerKey, ScoreEventMalformedResponse)
+		return
+	}
+
+	ps.mutex.Lock()
+	_, seen := ps.seen[message.ID()]
+	ps.mutex.Unlock()
+	if seen {
+		return
+	}
+	publisherKey, err := message.Verify()
+	if err != nil {
+		host.scores.Record(peerKey, ScoreEventInvalidSignature)
+		return
+	}
+
+	// Dropped messages are remembered so they aren't validated again
+	switch host.validatePubSubMessage(peerKey, publisherKey, message) {
+	case ValidationReject:
+		host.scores.Record(peerKey, ScoreEventRejectedMessage)
+		fallthrough
+	case ValidationIgnore:
+		ps.mutex.Lock()
+		ps.seen[message.ID()] = time.Now()
+		ps.mutex.Unlock()
+		return
+	}
+
+	ps.mutex.Lock()
+	if !ps.markSeen(message) {
+		ps.mutex.Unlock()
+		return
+	}
+	ps.deliver(message)
+	targets := make([]string, 0)
+	if topic, exists := ps.topics[message.Topic]; exists && topic.subscribed() {
+		for hexKey, address := range topic.peers {
+			if ps.router == GossipSubRouter && !topic.mesh[hexKey] {
+				continue
+			}
+			key, _ := hex.DecodeString(hexKey)
+			if bytes.Equal(key, peerKey) || bytes.Equal(key, publisherKey) {
+				continue
+			}
+			targets = append(targets, address)
+		}
+	}
+	ps.mutex.Unlock()
+
+	for _, address := range targets {
+		go host.sendPubSub(address, &pubSubRPC{Messages: []*PubSubMessage{message}})
+	}
+}
+
+// Subscribe to a topic.
+// The first subscription to a topic provides the topic's key in the DHT and
+// announces the subscription to the topic's subscribers found there.
+func (host *Host) Subscribe(topic string) (*Subscription, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("topic can't be empty")
+	}
+	ps := host.pubsub
+	sub := &Subscription{host, topic, make(chan *PubSubMessage, PubSubSubscriptionBuffer)}
+
+	ps.mutex.Lock()
+	entry, exists := ps.topics[topic]
+	if !exists {
+		entry = newPubSubTopic()
+		ps.topics[topic] = entry
+	}
+	entry.subscriptions[sub] = true
+	joined := len(entry.subscriptions) == 1
+	ps.mutex.Unlock()
+
+	if joined {
+		if err := host.Provide(PubSubTopicKey(topic)); err != nil {
+			sub.Cancel()
+			return nil, err
+		}
+		host.discoverTopic(topic)
+	}
+	return sub, nil
+}
+
+// Cancel a subscription, leaving the topic if it was the last one
+func (host *Host) unsubscribe(sub *Subscription) {
+	ps := host.pubsub
+	ps.mutex.Lock()
+	entry, exists := ps.topics[sub.topic]
+	if !exists || !entry.subscriptions[sub] {
+		ps.mutex.Unlock()
+		return
+	}
+	delete(entry.subscriptions, sub)
+	close(sub.messages)
+	if entry.subscribed() {
+		ps.mutex.Unlock()
+		return
+	}
+	delete(ps.topics, sub.topic)
+	ps.mutex.Unlock()
+
+	host.StopProviding(PubSubTopicKey(sub.topic))
+	leave := &pubSubRPC{Subscriptions: []pubSubSubscription{{sub.topic, false}}}
+	for _, address := range entry.peers {
+		go host.sendPubSub(address, leave)
+	}
+}
+
+// Publish data to a topic, the host doesn't need to subscribe to it.
+// Messages are sent to every known subscriber of the topic and the host's own subscriptions.
+func (host *Host) Publish(topic string, data []byte) error {
+	if topic == "" {
+		return fmt.Errorf("topic can't be empty")
+	}
+	ps := host.pubsub
+	hostKey := host.PeerKey()
+
+	ps.mutex.Lock()
+	ps.seqno++
+	message := &PubSubMessage{
+		From:  hex.EncodeToString(hostKey[:]),
+		Seqno: ps.seqno,
+		Topic: topic,
+		Data:  data,
+	}
+	ps.mutex.Unlock()
+	signature, err := host.Sign(message.digest())
+	if err != nil {
+		return err
+	}
+	message.Signature = hex.EncodeToString(signature[:])
+	if err := host.validateOwnPubSubMessage(message); err != nil {
+		return err
+	}
+
+	// Topics the host doesn't subscribe to are kept as fanout for a while after publishing
+	ps.mutex.Lock()
+	ps.markSeen(message)
+	ps.deliver(message)
+	entry, exists := ps.topics[topic]
+	if !exists {
+		entry = newPubSubTopic()
+		ps.topics[topic] = entry
+	}
+	entry.lastPublished = time.Now()
+	discover := len(entry.peers) == 0
+	ps.mutex.Unlock()
+	if discover {
+		host.discoverTopic(topic)
+	}
+
+	ps.mutex.Lock()
+	targets := make([]string, 0)
+	if entry, exists := ps.topics[topic]; exists {
+		for _, address := range entry.peers {
+			targets = append(targets, address)
+		}
+	}
+	ps.mutex.Unlock()
+	for _, address := range targets {
+		go host.sendPubSub(address, &pubSubRPC{Messages: []*PubSubMessage{message}})
+	}
+	return nil
+}
+
+// Find the subscribers of a topic in the DHT and add them to the topic's peers.
+// The host's subscription is announced to subscribers it didn't know.
+func (host *Host) discoverTopic(topic string) {
+	records, err := host.FindProviders(PubSubTopicKey(topic))
+	ps := host.pubsub
+
+	ps.mutex.Lock()
+	entry, exists := ps.topics[topic]
+	if !exists || err != nil {
+		ps.mutex.Unlock()
+		return
+	}
+	entry.lastDiscovery = time.Now()
+	announce := make([]string, 0)
+	for _, record := range records {
+		key, err := record.PeerKey()
+		if err != nil {
+			continue
+		}
+		hexKey := hex.EncodeToString(key)
+		if _, known := entry.peers[hexKey]; known || len(entry.peers) >= MaxPubSubTopicPeers {
+			continue
+		}
+		address := record.PreferredAddress("")
+		entry.peers[hexKey] = address
+		announce = append(announce, address)
+	}
+	subscribed := entry.subscribed()
+	ps.mutex.Unlock()
+	if !subscribed {
+		return
+	}
+
+	var wg sync.WaitGroup
+	join := &pubSubRPC{Subscriptions: []pubSubSubscription{{topic, true}}}
+	for _, address := range announce {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			host.sendPubSub(address, join)
+		}(address)
+	}
+	wg.Wait()
+}
+
+// Maintain the meshes of subscribed topics, gossip recent message ids to peers
+// outside of them, expire fanout topics and look up topics that are due.
+func (host *Host) pubSubHeartbeat() {
+	ps := host.pubsub
+	sends := make(map[string]*pubSubRPC)
+	rpcTo := func(address string) *pubSubRPC {
+		if _, exists := sends[address]; !exists {
+			sends[address] = &pubSubRPC{}
+		}
+		return sends[address]
+	}
+
+	ps.mutex.Lock()
+	discover := make([]string, 0)
+	for name, topic := range ps.topics {
+		if !topic.subscribed() && time.Since(topic.lastPublished) > PubSubFanoutTTL {
+			delete(ps.topics, name)
+			continue
+		}
+		sinceDiscovery := time.Since(topic.lastDiscovery)
+		if sinceDiscovery > PubSubDiscoveryPeriod || (len(topic.peers) < GossipSubDlo && sinceDiscovery > PubSubDiscoveryPeriod/10) {
+			topic.lastDiscovery = time.Now()
+			discover = append(discover, name)
+		}
+		if !topic.subscribed() || ps.router != GossipSubRouter {
+			continue
+		}
+
+		// Graft peers while the mesh is too small and prune it when too large
+		for hexKey := range topic.mesh {
+			if _, exists := topic.peers[hexKey]; !exists {
+				delete(topic.mesh, hexKey)
+			}
+		}
+		keys := shufflePeerKeys(topic.peers)
+		if len(topic.mesh) < GossipSubDlo {
+			for _, hexKey := range keys {
+				if len(topic.mesh) >= GossipSubD {
+					break
+				} else if !topic.mesh[hexKey] {
+					topic.mesh[hexKey] = true
+					rpc := rpcTo(topic.peers[hexKey])
+					rpc.Graft = append(rpc.Graft, name)
+				}
+			}
+		} else if len(topic.mesh) > GossipSubDhi {
+			for _, hexKey := range keys {
+				if len(topic.mesh) <= GossipSubD {
+					break
+				} else if topic.mesh[hexKey] {
+					delete(topic.mesh, hexKey)
+					rpc := rpcTo(topic.peers[hexKey])
+					rpc.Prune = append(rpc.Prune, name)
+				}
+			}
+		}
+
+		// Gossip the ids of recent messages to peers outside the mesh
+		ids := ps.gossipIDs(name)
+		if len(ids) == 0 {
+			continue
+		}
+		gossiped := 0
+		for _, hexKey := range keys {
+			if gossiped >= GossipSubDlazy {
+				break
+			} else if !topic.mesh[hexKey] {
+				rpc := rpcTo(topic.peers[hexKey])
+				rpc.IHave = append(rpc.IHave, pubSubIHave{name, ids})
+				gossiped++
+			}
+		}
+	}
+	ps.shift()
+	ps.mutex.Unlock()
+
+	for address, rpc := range sends {
+		go host.sendPubSub(address, rpc)
+	}
+	for _, topic := range discover {
+		go host.discoverTopic(topic)
+	}
+}
+
+// Returns the address to reach the peer that sent a request at, from the peer's record if it sent one
+func (host *Host) requestPeerAddress(remotePeer *Peer, record *PeerRecord) (string, error) {
+	if record != nil {
+		if key, err := record.Verify(host.recordTTL); err == nil && bytes.Equal(key, remotePeer.Key()) {
+			return record.PreferredAddress(remotePeer.IPAddress()), nil
+		}
+	}
+	return remotePeer.Address()
+}
+
+// Handles pubsub requests carrying subscriptions, messages and gossipsub control messages
+func PubSubHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	rpc, err := parsePubSubRPC(req.Data)
+	if err != nil {
+		return nil, err
+	}
+	address, err := host.requestPeerAddress(remotePeer, req.Record)
+	if err != nil {
+		return nil, err
+	}
+	return host.handlePubSub(remotePeer.Key(), address, rpc, true), nil
+}
+
+// A long running service running the pubsub heartbeat
+func (host *Host) startPubSubService() {
+	for !host.closed.Load() {
+		time.Sleep(GossipSubHeartbeat)
+		host.pubSubHeartbeat()
+	}
+}
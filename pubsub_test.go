@@ -0,0 +1,268 @@
+package coalition
+
+import (
+	"encoding/hex"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Wait for a message on the subscription
+func nextTestMessage(t *testing.T, sub *Subscription) *PubSubMessage {
+	select {
+	case message := <-sub.Messages():
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a message on %s", sub.Topic())
+	}
+	return nil
+}
+
+// Fail if a message arrives on the subscription within a short while
+func expectNoTestMessage(t *testing.T, sub *Subscription) {
+	select {
+	case message := <-sub.Messages():
+		t.Errorf("unexpected message %s", message.ID())
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// Create a message published by the host without sending it
+func newTestPubSubMessage(t *testing.T, host *Host, topic string, data []byte) *PubSubMessage {
+	key := host.PeerKey()
+	message := &PubSubMessage{
+		From:  hex.EncodeToString(key[:]),
+		Seqno: uint64(time.Now().UnixNano()),
+		Topic: topic,
+		Data:  data,
+	}
+	signature, err := host.Sign(message.digest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	message.Signature = hex.EncodeToString(signature[:])
+	return message
+}
+
+func TestPubSub(t *testing.T) {
+	for _, router := range []string{FloodSubRouter, GossipSubRouter} {
+		hosts := newTestNetwork(t, 5, PubSubRouter(router))
+		subs := make([]*Subscription, 0)
+		for _, host := range hosts[1:] {
+			sub, err := host.Subscribe("news")
+			if err != nil {
+				t.Fatal(err)
+			}
+			subs = append(subs, sub)
+		}
+
+		// Subscribers find each other through the DHT
+		for _, host := range hosts[1:] {
+			host.pubsub.mutex.Lock()
+			peers := len(host.pubsub.topics["news"].peers)
+			host.pubsub.mutex.Unlock()
+			if peers != len(subs)-1 {
+				t.Errorf("%s: expected %d topic peers, got %d", router, len(subs)-1, peers)
+			}
+		}
+
+		// Every subscriber gets a message once, publishers don't need to subscribe
+		if err := hosts[0].Publish("news", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		for _, sub := range subs {
+			if message := nextTestMessage(t, sub); string(message.Data) != "hello" {
+				t.Errorf("%s: unexpected message data %s", router, message.Data)
+			}
+			expectNoTestMessage(t, sub)
+		}
+
+		// Messages sent to one subscriber are forwarded to the rest
+		if router == GossipSubRouter {
+			time.Sleep(GossipSubHeartbeat * 2)
+		}
+		outsider := newTestHost(t, ListenAddress("127.0.0.1"))
+		forwarded := newTestPubSubMessage(t, outsider, "news", []byte("forwarded"))
+		if err := hosts[0].sendPubSub(testHostAddress(t, hosts[1]), &pubSubRPC{Messages: []*PubSubMessage{forwarded}}); err != nil {
+			t.Fatal(err)
+		}
+		for _, sub := range subs {
+			if message := nextTestMessage(t, sub); message.ID() != forwarded.ID() {
+				t.Errorf("%s: expected the forwarded message", router)
+			}
+			expectNoTestMessage(t, sub)
+		}
+
+		// Messages with invalid signatures are dropped and count against the sender
+		senderKey := hosts[0].PeerKey()
+		before := hosts[1].Scores().Value(senderKey[:])
+		tampered := newTestPubSubMessage(t, outsider, "news", []byte("original"))
+		tampered.Data = []byte("tampered")
+		if err := hosts[0].sendPubSub(testHostAddress(t, hosts[1]), &pubSubRPC{Messages: []*PubSubMessage{tampered}}); err != nil {
+			t.Fatal(err)
+		}
+		expectNoTestMessage(t, subs[0])
+		if hosts[1].Scores().Value(senderKey[:]) >= before {
+			t.Errorf("%s: expected the tampered message to count against the sender", router)
+		}
+
+		// Cancelled subscriptions are closed and announced
+		subs[3].Cancel()
+		if _, open := <-subs[3].Messages(); open {
+			t.Errorf("%s: expected the cancelled subscription to be closed", router)
+		}
+		time.Sleep(300 * time.Millisecond)
+		hosts[1].pubsub.mutex.Lock()
+		if len(hosts[1].pubsub.topics["news"].peers) != len(subs)-2 {
+			t.Errorf("%s: expected the unsubscribed peer to be dropped", router)
+		}
+		hosts[1].pubsub.mutex.Unlock()
+	}
+}
+
+func TestGossipSub(t *testing.T) {
+	hosts := newTestNetwork(t, 3)
+	subs := make([]*Subscription, len(hosts))
+	for i, host := range hosts {
+		sub, err := host.Subscribe("gossip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs[i] = sub
+	}
+
+	// Subscribers graft each other into their meshes
+	time.Sleep(GossipSubHeartbeat * 2)
+	for _, host := range hosts {
+		host.pubsub.mutex.Lock()
+		if len(host.pubsub.topics["gossip"].mesh) != len(hosts)-1 {
+			t.Errorf("expected every subscriber in the mesh")
+		}
+		host.pubsub.mutex.Unlock()
+	}
+
+	// Messages a peer only has ids of are requested with IWANT
+	message := newTestPubSubMessage(t, hosts[0], "gossip", []byte("gossiped"))
+	hosts[0].pubsub.mutex.Lock()
+	hosts[0].pubsub.markSeen(message)
+	hosts[0].pubsub.mutex.Unlock()
+	ihave := &pubSubRPC{IHave: []pubSubIHave{{"gossip", []string{message.ID()}}}}
+	if err := hosts[0].sendPubSub(testHostAddress(t, hosts[1]), ihave); err != nil {
+		t.Fatal(err)
+	}
+	if received := nextTestMessage(t, subs[1]); received.ID() != message.ID() {
+		t.Errorf("expected the gossiped message")
+	}
+	if received := nextTestMessage(t, subs[2]); received.ID() != message.ID() {
+		t.Errorf("expected the gossiped message to be forwarded")
+	}
+	expectNoTestMessage(t, subs[0])
+
+	// Grafts to topics the host isn't subscribed to are pruned
+	hostKey := hosts[0].PeerKey()
+	reply := hosts[1].handlePubSub(hostKey[:], testHostAddress(t, hosts[0]), &pubSubRPC{Graft: []string{"other"}}, true)
+	if len(reply.Prune) != 1 || reply.Prune[0] != "other" {
+		t.Errorf("expected the graft to be pruned")
+	}
+
+	// Peers answering every rpc with fresh gossip can't keep the exchange going
+	var rounds int32
+	chatty := newTestHost(t)
+	chatty.RegisterRPCMethod(PubSubMethod, func(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+		round := atomic.AddInt32(&rounds, 1)
+		id := newTestPubSubMessage(t, host, "gossip", []byte{byte(round)}).ID()
+		return &pubSubRPC{IHave: []pubSubIHave{{"gossip", []string{id}}}}, nil
+	})
+	if err := hosts[0].sendPubSub(testHostAddress(t, chatty), ihave); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&rounds) != MaxPubSubReplyRounds+1 {
+		t.Errorf("expected %d rpcs, got %d", MaxPubSubReplyRounds+1, rounds)
+	}
+}
+
+func TestTopicValidation(t *testing.T) {
+	hosts := newTestNetwork(t, 2, TopicMessageSize("small", 4), TopicRateLimit("limited", 0.001, 2))
+	publisher, subscriber := hosts[0], hosts[1]
+	publisherKey := publisher.PeerKey()
+	subscriberAddr := testHostAddress(t, subscriber)
+	send := func(message *PubSubMessage) {
+		if err := publisher.sendPubSub(subscriberAddr, &pubSubRPC{Messages: []*PubSubMessage{message}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subscriber.RegisterTopicValidator("checked", func(peerKey []byte, message *PubSubMessage) ValidationResult {
+		switch string(message.Data) {
+		case "reject":
+			return ValidationReject
+		case "ignore":
+			return ValidationIgnore
+		}
+		return ValidationAccept
+	})
+	checked, err := subscriber.Subscribe("checked")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Accepted messages are delivered
+	send(newTestPubSubMessage(t, publisher, "checked", []byte("accept")))
+	if message := nextTestMessage(t, checked); string(message.Data) != "accept" {
+		t.Errorf("expected the accepted message")
+	}
+
+	// Ignored messages are dropped without penalty
+	before := subscriber.Scores().Value(publisherKey[:])
+	send(newTestPubSubMessage(t, publisher, "checked", []byte("ignore")))
+	expectNoTestMessage(t, checked)
+	if subscriber.Scores().Value(publisherKey[:]) < before-1 {
+		t.Errorf("expected ignored messages not to count against the sender")
+	}
+
+	// Rejected messages are dropped and count against the sender
+	before = subscriber.Scores().Value(publisherKey[:])
+	send(newTestPubSubMessage(t, publisher, "checked", []byte("reject")))
+	expectNoTestMessage(t, checked)
+	if subscriber.Scores().Value(publisherKey[:]) >= before {
+		t.Errorf("expected rejected messages to count against the sender")
+	}
+
+	// Hosts validate the messages they publish themselves
+	publisher.RegisterTopicValidator("checked", func(peerKey []byte, message *PubSubMessage) ValidationResult {
+		return ValidationReject
+	})
+	if err := publisher.Publish("checked", []byte("accept")); err == nil {
+		t.Errorf("expected own rejected messages to fail")
+	}
+	publisher.UnregisterTopicValidator("checked")
+
+	// Messages above the topic's size limit are rejected
+	small, err := subscriber.Subscribe("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := subscriber.Publish("small", []byte("12345")); err == nil {
+		t.Errorf("expected oversized messages to fail")
+	}
+	before = subscriber.Scores().Value(publisherKey[:])
+	send(newTestPubSubMessage(t, publisher, "small", []byte("12345")))
+	expectNoTestMessage(t, small)
+	if subscriber.Scores().Value(publisherKey[:]) >= before {
+		t.Errorf("expected oversized messages to count against the sender")
+	}
+	send(newTestPubSubMessage(t, publisher, "small", []byte("1234")))
+	nextTestMessage(t, small)
+
+	// Publishers above the topic's rate limit are ignored
+	limited, err := subscriber.Subscribe("limited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		send(newTestPubSubMessage(t, publisher, "limited", []byte("flood")))
+	}
+	nextTestMessage(t, limited)
+	nextTestMessage(t, limited)
+	expectNoTestMessage(t, limited)
+}
@@ -0,0 +1,107 @@
+package coalition
+
+import (
+	"fmt"
+	"log"
+)
+
+// Outcome of validating a pubsub message
+type ValidationResult int
+
+const (
+	// Deliver and forward the message
+	ValidationAccept ValidationResult = iota
+	// Drop the message and count it against the peer that sent it
+	ValidationReject
+	// Drop the message without penalty
+	ValidationIgnore
+)
+
+// Validates the messages of a topic before they're delivered and forwarded.
+// The peer key is of the peer that sent the message, which isn't always it's publisher.
+type TopicValidator func(peerKey []byte, message *PubSubMessage) ValidationResult
+
+// A max message size for a single topic
+type topicMessageSize struct {
+	topic string
+	size  int
+}
+
+// A message rate limit for a single topic
+type topicRateLimit struct {
+	topic string
+	limit RateLimit
+}
+
+// Registers a validator for the topic or replaces an existing one
+func (host *Host) RegisterTopicValidator(topic string, validator TopicValidator) {
+	host.pubsub.mutex.Lock()
+	defer host.pubsub.mutex.Unlock()
+	host.pubsub.validators[topic] = validator
+}
+
+// Removes the validator of the topic
+func (host *Host) UnregisterTopicValidator(topic string) {
+	host.pubsub.mutex.Lock()
+	defer host.pubsub.mutex.Unlock()
+	delete(host.pubsub.validators, topic)
+}
+
+// Returns the max message size of the topic
+func (ps *pubSub) messageSize(topic string) int {
+	if size, exists := ps.messageSizes[topic]; exists {
+		return size
+	}
+	return ps.messageSizes[AnyTopic]
+}
+
+// Validate a message received from a peer.
+// Messages above the topic's size limit are rejected, messages of publishers above
+// the topic's rate limit are ignored and the rest go through the topic's validator.
+func (host *Host) validatePubSubMessage(peerKey, publisherKey []byte, message *PubSubMessage) ValidationResult {
+	ps := host.pubsub
+	ps.mutex.Lock()
+	size := ps.messageSize(message.Topic)
+	validator := ps.validators[message.Topic]
+	ps.mutex.Unlock()
+
+	if len(message.Data) > size {
+		return ValidationReject
+	} else if !ps.limiter.Allow(message.Topic, publisherKey, "") {
+		return ValidationIgnore
+	} else if validator == nil {
+		return ValidationAccept
+	}
+	return callTopicValidator(validator, peerKey, message)
+}
+
+// Validate a message published by the host itself
+func (host *Host) validateOwnPubSubMessage(message *PubSubMessage) error {
+	ps := host.pubsub
+	ps.mutex.Lock()
+	size := ps.messageSize(message.Topic)
+	validator := ps.validators[message.Topic]
+	ps.mutex.Unlock()
+
+	if len(message.Data) > size {
+		return fmt.Errorf("message exceeds max size of %d bytes", size)
+	} else if validator == nil {
+		return nil
+	}
+	hostKey := host.PeerKey()
+	if result := callTopicValidator(validator, hostKey[:], message); result != ValidationAccept {
+		return fmt.Errorf("message failed validation")
+	}
+	return nil
+}
+
+// Run a topic validator, ignoring the message if the validator panics
+func callTopicValidator(validator TopicValidator, peerKey []byte, message *PubSubMessage) (result ValidationResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("validator for topic [%s] panicked: %v", message.Topic, r)
+			result = ValidationIgnore
+		}
+	}()
+	return validator(peerKey, message)
+}
@@ -0,0 +1,109 @@
+package coalition
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"math/bits"
+)
+
+// S/Kademlia crypto puzzle difficulties
+type puzzleDifficulty struct {
+	static  int
+	dynamic int
+}
+
+// Count the number of leading zero bits in a byte slice
+func CountLeadingZeroBits(data []byte) int {
+	count := 0
+	for _, b := range data {
+		if b != 0 {
+			return count + bits.LeadingZeros8(b)
+		}
+		count += 8
+	}
+	return count
+}
+
+// Returns true if the peer key solves the static puzzle.
+// The static puzzle requires sha1(peer key) to have difficulty leading zero bits,
+// forcing an attacker to generate many key pairs to get one usable key.
+func VerifyStaticPuzzle(peerKey []byte, difficulty int) bool {
+	if difficulty <= 0 {
+		return true
+	}
+	hash := sha1.Sum(peerKey)
+	return CountLeadingZeroBits(hash[:]) >= difficulty
+}
+
+// Returns true if the solution solves the dynamic puzzle for the peer key.
+// The dynamic puzzle requires sha1(peer key XOR solution) to have difficulty leading zero bits.
+func VerifyDynamicPuzzle(peerKey, solution []byte, difficulty int) bool {
+	if difficulty <= 0 {
+		return true
+	} else if len(solution) != PeerKeySize || len(peerKey) != PeerKeySize {
+		return false
+	}
+	hash := sha1.Sum(XORBytes(peerKey, solution))
+	return CountLeadingZeroBits(hash[:]) >= difficulty
+}
+
+// Returns an error if the puzzle difficulty is negative or above MaxPuzzleDifficulty
+func validatePuzzleDifficulty(difficulty int) error {
+	if difficulty < 0 || difficulty > MaxPuzzleDifficulty {
+		return fmt.Errorf("crypto puzzle difficulty must be between 0 and %d", MaxPuzzleDifficulty)
+	}
+	return nil
+}
+
+// Max attempts a solver makes before giving up on a puzzle
+func puzzleAttempts(difficulty int) uint64 {
+	return uint64(PuzzleAttemptsFactor) << difficulty
+}
+
+// Search for a solution to the dynamic puzzle for a peer key
+func SolveDynamicPuzzle(peerKey []byte, difficulty int) ([]byte, error) {
+	if len(peerKey) != PeerKeySize {
+		return nil, fmt.Errorf("invalid peer key size")
+	} else if err := validatePuzzleDifficulty(difficulty); err != nil {
+		return nil, err
+	}
+	solution := make([]byte, PeerKeySize)
+	for attempt := uint64(0); attempt < puzzleAttempts(difficulty); attempt++ {
+		if _, err := rand.Read(solution); err != nil {
+			return nil, err
+		}
+		if VerifyDynamicPuzzle(peerKey, solution, difficulty) {
+			return solution, nil
+		}
+	}
+	return nil, fmt.Errorf("no dynamic crypto puzzle solution found")
+}
+
+// Generate a private key whose peer key solves the static puzzle,
+// along with a solution to the dynamic puzzle for it
+func GenerateIdentity(staticDifficulty, dynamicDifficulty int) (ed25519.PrivateKey, []byte, error) {
+	if err := validatePuzzleDifficulty(staticDifficulty); err != nil {
+		return nil, nil, err
+	} else if err := validatePuzzleDifficulty(dynamicDifficulty); err != nil {
+		return nil, nil, err
+	}
+	for attempt := uint64(0); attempt < puzzleAttempts(staticDifficulty); attempt++ {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		peerKey := sha1.Sum(publicKey)
+		if !VerifyStaticPuzzle(peerKey[:], staticDifficulty) {
+			continue
+		}
+
+		solution, err := SolveDynamicPuzzle(peerKey[:], dynamicDifficulty)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateKey, solution, nil
+	}
+	return nil, nil, fmt.Errorf("no identity solving the static crypto puzzle found")
+}
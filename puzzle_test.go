@@ -0,0 +1,86 @@
+package coalition
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"testing"
+)
+
+func TestGenerateIdentity(t *testing.T) {
+	privKey, solution, err := GenerateIdentity(8, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peerKey := sha1.Sum(privKey.Public().(ed25519.PublicKey))
+	if !VerifyStaticPuzzle(peerKey[:], 8) {
+		t.Errorf("generated identity should solve the static puzzle")
+	} else if !VerifyDynamicPuzzle(peerKey[:], solution, 8) {
+		t.Errorf("generated solution should solve the dynamic puzzle")
+	} else if VerifyDynamicPuzzle(peerKey[:], make([]byte, PeerKeySize), 64) {
+		t.Errorf("an empty solution should not solve a hard dynamic puzzle")
+	}
+}
+
+func TestCryptoPuzzleConnection(t *testing.T) {
+	hostA, err := NewHost(CryptoPuzzle(8, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostA.Listen()
+	defer hostA.Close()
+
+	hostB, err := NewHost(CryptoPuzzle(8, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostB.Listen()
+	defer hostB.Close()
+
+	addrs, err := hostA.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compliant hosts can talk
+	if err := hostB.Ping(addrs[0]); err != nil {
+		t.Error(err)
+	}
+
+	// Find a host whose key doesn't solve the static puzzle
+	var weakHost *Host
+	for weakHost == nil {
+		candidate, err := NewHost()
+		if err != nil {
+			t.Fatal(err)
+		}
+		candidateKey := candidate.PeerKey()
+		if VerifyStaticPuzzle(candidateKey[:], 8) {
+			candidate.Close()
+			continue
+		}
+		weakHost = candidate
+	}
+	defer weakHost.Close()
+
+	err = weakHost.Ping(addrs[0])
+	if rpcErr, ok := err.(*RPCError); !ok || rpcErr.Code != RPCCodeForbidden {
+		t.Errorf("expected a forbidden error, got %v", err)
+	}
+	waitForPeers(hostA, 1)
+	if len(hostA.RouteTable().Peers()) != 1 {
+		t.Errorf("only the compliant host should be in the route table")
+	}
+}
+
+func TestInvalidPuzzleDifficulty(t *testing.T) {
+	for _, difficulty := range [][2]int{{-1, 0}, {0, -1}, {MaxPuzzleDifficulty + 1, 0}, {0, PeerKeySize*8 + 1}} {
+		if host, err := NewHost(CryptoPuzzle(difficulty[0], difficulty[1])); err == nil {
+			host.Close()
+			t.Errorf("expected difficulties %v to be rejected", difficulty)
+		}
+	}
+	if _, err := SolveDynamicPuzzle(make([]byte, PeerKeySize), PeerKeySize*8+1); err == nil {
+		t.Errorf("expected an unsolvable difficulty to be rejected")
+	}
+}
@@ -0,0 +1,206 @@
+package coalition
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rate limiter scopes
+const (
+	PeerRateLimitScope = "peer"
+	IPRateLimitScope   = "ip"
+)
+
+// A token bucket rate limit.
+// Rate is the number of tokens refilled per second and burst is the bucket capacity.
+type RateLimit struct {
+	Rate  float64
+	Burst int64
+}
+
+// A rate limit for a single RPC method
+type methodRateLimit struct {
+	method string
+	limit  RateLimit
+}
+
+// A token bucket
+type tokenBucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated time.Time
+}
+
+// Refill the bucket for the time elapsed since the last update
+func (bucket *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.tokens = math.Min(
+		float64(bucket.limit.Burst),
+		bucket.tokens+elapsed*bucket.limit.Rate,
+	)
+	bucket.updated = now
+}
+
+// Take a token from the bucket if one is available
+func (bucket *tokenBucket) take(now time.Time) bool {
+	bucket.refill(now)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Returns true if the bucket has refilled to capacity by now
+func (bucket *tokenBucket) full(now time.Time) bool {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	return bucket.tokens+elapsed*bucket.limit.Rate >= float64(bucket.limit.Burst)
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit, float64(limit.Burst), now}
+}
+
+// A snapshot of a single rate limiter bucket
+type RateLimiterState struct {
+	Scope   string
+	Method  string
+	Key     string
+	Tokens  float64
+	Updated time.Time
+}
+
+// Token bucket rate limiter for inbound RPCs keyed by remote peer key and ip address
+type RateLimiter struct {
+	mutex      sync.Mutex
+	limits     map[string]map[string]RateLimit
+	buckets    map[string]map[string]map[string]*tokenBucket
+	lastPruned time.Time
+}
+
+// Find the limit that applies to a method within a scope
+func (limiter *RateLimiter) limitFor(scope, method string) (RateLimit, string, bool) {
+	if limit, exists := limiter.limits[scope][method]; exists {
+		return limit, method, true
+	}
+	if limit, exists := limiter.limits[scope][AnyMethod]; exists {
+		return limit, AnyMethod, true
+	}
+	return RateLimit{}, "", false
+}
+
+// Get or create the bucket for a key within a scope
+func (limiter *RateLimiter) bucket(scope, method, key string, now time.Time) *tokenBucket {
+	limit, bucketMethod, limited := limiter.limitFor(scope, method)
+	if !limited {
+		return nil
+	}
+	if _, exists := limiter.buckets[scope][bucketMethod]; !exists {
+		limiter.buckets[scope][bucketMethod] = make(map[string]*tokenBucket)
+	}
+	bucket, exists := limiter.buckets[scope][bucketMethod][key]
+	if !exists {
+		bucket = newTokenBucket(limit, now)
+		limiter.buckets[scope][bucketMethod][key] = bucket
+	}
+	return bucket
+}
+
+// Drop buckets that have refilled to capacity, they're identical to new buckets
+func (limiter *RateLimiter) prune(now time.Time) {
+	if now.Sub(limiter.lastPruned) < time.Minute {
+		return
+	}
+	for _, methods := range limiter.buckets {
+		for _, keys := range methods {
+			for key, bucket := range keys {
+				if bucket.full(now) {
+					delete(keys, key)
+				}
+			}
+		}
+	}
+	limiter.lastPruned = now
+}
+
+// Returns true if a call to the method is allowed for the peer key and ip address.
+// A token is only consumed if the call is allowed in every scope.
+func (limiter *RateLimiter) Allow(method string, peerKey []byte, ip string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	limiter.prune(now)
+
+	buckets := make([]*tokenBucket, 0)
+	if bucket := limiter.bucket(PeerRateLimitScope, method, fmt.Sprintf("%x", peerKey), now); bucket != nil {
+		buckets = append(buckets, bucket)
+	}
+	if bucket := limiter.bucket(IPRateLimitScope, method, ip, now); bucket != nil {
+		buckets = append(buckets, bucket)
+	}
+
+	for _, bucket := range buckets {
+		bucket.refill(now)
+		if bucket.tokens < 1 {
+			return false
+		}
+	}
+	for _, bucket := range buckets {
+		bucket.take(now)
+	}
+	return true
+}
+
+// Returns a snapshot of all active buckets for debugging
+func (limiter *RateLimiter) State() []RateLimiterState {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	states := make([]RateLimiterState, 0)
+	for scope, methods := range limiter.buckets {
+		for method, keys := range methods {
+			for key, bucket := range keys {
+				bucket.refill(now)
+				states = append(states, RateLimiterState{
+					Scope:   scope,
+					Method:  method,
+					Key:     key,
+					Tokens:  bucket.tokens,
+					Updated: bucket.updated,
+				})
+			}
+		}
+	}
+	return states
+}
+
+// Create a new rate limiter from per method peer and ip limits
+func NewRateLimiter(peerLimits, ipLimits map[string]RateLimit) (*RateLimiter, error) {
+	limits := map[string]map[string]RateLimit{
+		PeerRateLimitScope: peerLimits,
+		IPRateLimitScope:   ipLimits,
+	}
+	for scope, methods := range limits {
+		for method, limit := range methods {
+			if limit.Rate <= 0 {
+				return nil, fmt.Errorf("%s rate limit for [%s] must be > 0", scope, method)
+			} else if limit.Burst < 1 {
+				return nil, fmt.Errorf("%s rate limit burst for [%s] must be >= 1", scope, method)
+			}
+		}
+	}
+
+	limiter := &RateLimiter{
+		limits: limits,
+		buckets: map[string]map[string]map[string]*tokenBucket{
+			PeerRateLimitScope: make(map[string]map[string]*tokenBucket),
+			IPRateLimitScope:   make(map[string]map[string]*tokenBucket),
+		},
+		lastPruned: time.Now(),
+	}
+	return limiter, nil
+}
@@ -0,0 +1,141 @@
+package coalition
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Whether a peer accepts RPC requests on it's advertised address
+type Reachability int
+
+const (
+	ReachabilityUnknown Reachability = iota
+	ReachabilityPublic
+	ReachabilityPrivate
+)
+
+func (reachability Reachability) String() string {
+	switch reachability {
+	case ReachabilityPublic:
+		return "public"
+	case ReachabilityPrivate:
+		return "private"
+	}
+	return "unknown"
+}
+
+// A peer waiting to be dialed back
+type dialBackRequest struct {
+	key       []byte
+	ipAddress string
+	port      int
+}
+
+// The result of dialing a peer back on an address
+type dialBackResult struct {
+	ipAddress    string
+	port         int
+	reachability Reachability
+	checked      time.Time
+}
+
+// Dials inbound peers back on their advertised address, off the request path.
+// Dials are rate limited and their results cached by peer key.
+type dialBackService struct {
+	mutex   sync.Mutex
+	queue   chan dialBackRequest
+	pending map[string]bool
+	results map[string]dialBackResult
+	bucket  *tokenBucket
+	ttl     time.Duration
+}
+
+// Returns the cached reachability of a peer at an address and if the result is still fresh
+func (service *dialBackService) lookup(key []byte, ipAddress string, port int) (Reachability, bool) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	result, exists := service.results[hex.EncodeToString(key)]
+	if !exists || result.ipAddress != ipAddress || result.port != port {
+		return ReachabilityUnknown, false
+	}
+	return result.reachability, time.Since(result.checked) < service.ttl
+}
+
+// Returns the last known reachability of a peer
+func (service *dialBackService) status(key []byte) Reachability {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	return service.results[hex.EncodeToString(key)].reachability
+}
+
+// Queue a peer to be dialed back.
+// Returns false if the peer is already queued, the queue is full or the rate limit was hit.
+func (service *dialBackService) enqueue(key []byte, ipAddress string, port int) bool {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	hexKey := hex.EncodeToString(key)
+	if service.pending[hexKey] || !service.bucket.take(time.Now()) {
+		return false
+	}
+
+	select {
+	case service.queue <- dialBackRequest{key, ipAddress, port}:
+		service.pending[hexKey] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Cache the reachability of a peer at an address
+func (service *dialBackService) record(key []byte, ipAddress string, port int, reachability Reachability) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	hexKey := hex.EncodeToString(key)
+	delete(service.pending, hexKey)
+	service.prune()
+	service.results[hexKey] = dialBackResult{ipAddress, port, reachability, time.Now()}
+}
+
+// Drop expired results once too many results are cached
+func (service *dialBackService) prune() {
+	if len(service.results) < MaxDialBackResults {
+		return
+	}
+	for key, result := range service.results {
+		if time.Since(result.checked) >= service.ttl {
+			delete(service.results, key)
+		}
+	}
+	for key := range service.results {
+		if len(service.results) < MaxDialBackResults {
+			break
+		}
+		delete(service.results, key)
+	}
+}
+
+// Create a new dial back service
+func newDialBackService(limit RateLimit, ttl time.Duration, queueSize int64) (*dialBackService, error) {
+	if limit.Rate <= 0 || limit.Burst < 1 {
+		return nil, fmt.Errorf("dial back rate must be > 0 and burst >= 1")
+	} else if ttl <= 0 {
+		return nil, fmt.Errorf("dial back cache ttl must be > 0")
+	} else if queueSize < 1 {
+		return nil, fmt.Errorf("dial back queue size must be >= 1")
+	}
+
+	service := &dialBackService{
+		queue:   make(chan dialBackRequest, queueSize),
+		pending: make(map[string]bool),
+		results: make(map[string]dialBackResult),
+		bucket:  newTokenBucket(limit, time.Now()),
+		ttl:     ttl,
+	}
+	return service, nil
+}
@@ -0,0 +1,568 @@
+package coalition
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits on the resources a relay spends on relayed peers
+type RelayLimits struct {
+	// Max number of peers holding a reservation at once
+	MaxReservations int64
+
+	// Max number of connections relayed at once
+	MaxCircuits int64
+
+	// How long a reservation lasts before the peer has to reserve again
+	ReservationTTL time.Duration
+
+	// Max lifetime of a relayed connection
+	MaxCircuitDuration time.Duration
+
+	// Max bytes relayed in each direction of a relayed connection
+	MaxCircuitBytes int64
+
+	// Max bytes per second relayed in each direction of a relayed connection
+	CircuitBandwidth int64
+}
+
+// A relay's response to a reservation
+type RelayReservationInfo struct {
+	// Milliseconds until the reservation expires
+	TTL int64 `json:"ttl"`
+
+	// The ip address and port the relay sees the reserving peer on
+	ObservedAddress string `json:"observed_address"`
+}
+
+// Details of a circuit a relayed peer accepted
+type RelayCircuitInfo struct {
+	ID string `json:"id"`
+
+	// The ip address and port the relay sees the peer that opened the circuit on
+	ObservedAddress string `json:"observed_address"`
+}
+
+// A connection tunneled through a relay, with the relay's node address and
+// the address the relay sees the peer at the other end on
+type relayedConn struct {
+	net.Conn
+	relay           string
+	observedAddress string
+}
+
+// A peer's reservation on the relay.
+// Circuit ids are forwarded to the peer over the reservation's connection.
+type relayReservation struct {
+	key      []byte
+	circuits chan string
+	closed   chan struct{}
+}
+
+// A relayed connection waiting for, or spliced with, the relayed peer
+type relayCircuit struct {
+	id          string
+	observed    string
+	reservation *relayReservation
+	accepted    chan net.Conn
+	done        chan struct{}
+	taken       bool
+	once        sync.Once
+}
+
+// Relays connections to peers holding a reservation
+type relayService struct {
+	mutex        sync.Mutex
+	limits       RelayLimits
+	reservations map[string]*relayReservation
+	circuits     map[string]*relayCircuit
+}
+
+// Returns an error if the peer can't reserve a slot on the relay
+func (service *relayService) canReserve(key []byte) error {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	return service.checkReservation(key)
+}
+
+func (service *relayService) checkReservation(key []byte) error {
+	if _, exists := service.reservations[hex.EncodeToString(key)]; exists {
+		return nil
+	} else if int64(len(service.reservations)) >= service.limits.MaxReservations {
+		return fmt.Errorf("relay has no free reservations")
+	}
+	return nil
+}
+
+// Reserve a slot for the peer, replacing the peer's previous reservation
+func (service *relayService) reserve(key []byte) (*relayReservation, error) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	// The limit is checked under the same lock as the insert so concurrent reservers can't exceed it
+	if err := service.checkReservation(key); err != nil {
+		return nil, err
+	}
+
+	hexKey := hex.EncodeToString(key)
+	if previous, exists := service.reservations[hexKey]; exists {
+		close(previous.closed)
+	}
+	reservation := &relayReservation{
+		key:      key,
+		circuits: make(chan string, 16),
+		closed:   make(chan struct{}),
+	}
+	service.reservations[hexKey] = reservation
+	return reservation, nil
+}
+
+// Forward circuits to the reserving peer over the connection until the reservation ends
+func (service *relayService) serveReservation(reservation *relayReservation, conn net.Conn) {
+	defer func() {
+		service.mutex.Lock()
+		defer service.mutex.Unlock()
+		hexKey := hex.EncodeToString(reservation.key)
+		if service.reservations[hexKey] == reservation {
+			delete(service.reservations, hexKey)
+		}
+	}()
+
+	// The reservation ends when the peer hangs up or it expires
+	conn.SetReadDeadline(time.Now().Add(service.limits.ReservationTTL))
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	for {
+		select {
+		case id := <-reservation.circuits:
+			if err := WriteToConn(conn, []byte(id)); err != nil {
+				return
+			}
+		case <-reservation.closed:
+			return
+		case <-gone:
+			return
+		}
+	}
+}
+
+// Open a circuit to a reserved peer and notify the peer of it
+func (service *relayService) openCircuit(key []byte, observedAddress string) (*relayCircuit, error) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	reservation, exists := service.reservations[hex.EncodeToString(key)]
+	if !exists {
+		return nil, fmt.Errorf("peer has no reservation on the relay")
+	} else if int64(len(service.circuits)) >= service.limits.MaxCircuits {
+		return nil, fmt.Errorf("relay has no free circuits")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	circuit := &relayCircuit{
+		id:          hex.EncodeToString(id),
+		observed:    observedAddress,
+		reservation: reservation,
+		accepted:    make(chan net.Conn),
+		done:        make(chan struct{}),
+	}
+	select {
+	case reservation.circuits <- circuit.id:
+	default:
+		return nil, fmt.Errorf("relayed peer is busy")
+	}
+	service.circuits[circuit.id] = circuit
+	return circuit, nil
+}
+
+// Take a pending circuit for the reserved peer accepting it
+func (service *relayService) takeCircuit(id string, key []byte) (*relayCircuit, error) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	circuit, exists := service.circuits[id]
+	if !exists || circuit.taken || !bytes.Equal(circuit.reservation.key, key) {
+		return nil, fmt.Errorf("unknown relay circuit")
+	}
+	circuit.taken = true
+	return circuit, nil
+}
+
+// Release a circuit's slot and signal both ends that it's done
+func (service *relayService) closeCircuit(circuit *relayCircuit) {
+	circuit.once.Do(func() {
+		service.mutex.Lock()
+		defer service.mutex.Unlock()
+		delete(service.circuits, circuit.id)
+		close(circuit.done)
+	})
+}
+
+// Copy data between both ends of a circuit within the circuit limits
+func (service *relayService) splice(a, b net.Conn) {
+	deadline := time.Now().Add(service.limits.MaxCircuitDuration)
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+
+	var wg sync.WaitGroup
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		service.copyLimited(dst, src)
+
+		// Either end hanging up or hitting a limit closes the circuit
+		a.Close()
+		b.Close()
+	}
+	wg.Add(2)
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+}
+
+// Copy from src to dst until the byte limit is reached, throttled to the circuit bandwidth
+func (service *relayService) copyLimited(dst, src net.Conn) {
+	buffer := make([]byte, 32*1024)
+	start := time.Now()
+	total := int64(0)
+	for total < service.limits.MaxCircuitBytes {
+		chunk := buffer
+		if remaining := service.limits.MaxCircuitBytes - total; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := src.Read(chunk)
+		if n > 0 {
+			if _, err := dst.Write(chunk[:n]); err != nil {
+				return
+			}
+			total += int64(n)
+
+			// Hold back until the bytes copied are within the bandwidth
+			if service.limits.CircuitBandwidth > 0 {
+				expected := time.Duration(float64(total) / float64(service.limits.CircuitBandwidth) * float64(time.Second))
+				if wait := expected - time.Since(start); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Create a new relay service
+func newRelayService(limits RelayLimits) (*relayService, error) {
+	if limits.MaxReservations < 1 || limits.MaxCircuits < 1 {
+		return nil, fmt.Errorf("relay reservations and circuits must be >= 1")
+	} else if limits.ReservationTTL <= 0 || limits.MaxCircuitDuration <= 0 {
+		return nil, fmt.Errorf("relay reservation ttl and circuit duration must be > 0")
+	} else if limits.MaxCircuitBytes < 1 {
+		return nil, fmt.Errorf("relay circuit bytes must be >= 1")
+	}
+
+	service := &relayService{
+		limits:       limits,
+		reservations: make(map[string]*relayReservation),
+		circuits:     make(map[string]*relayCircuit),
+	}
+	return service, nil
+}
+
+// Handles relay_reserve requests which reserves a slot on the relay for the peer.
+// The connection is kept open to notify the peer of incoming circuits.
+func RelayReserveHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	if host.relay == nil {
+		return nil, fmt.Errorf("relay is disabled")
+	} else if err := host.relay.canReserve(remotePeer.Key()); err != nil {
+		return nil, err
+	}
+
+	response := &HijackedResponse{
+		Data: RelayReservationInfo{
+			TTL:             host.relay.limits.ReservationTTL.Milliseconds(),
+			ObservedAddress: remotePeer.ObservedAddress(),
+		},
+		Handler: func(conn net.Conn) {
+			reservation, err := host.relay.reserve(remotePeer.Key())
+			if err != nil {
+				return
+			}
+			host.relay.serveReservation(reservation, conn)
+		},
+	}
+	return response, nil
+}
+
+// Handles relay_connect requests which opens a circuit to a peer holding a reservation.
+// Once the relayed peer accepts, the connection is spliced with the relayed peer's.
+func RelayConnectHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	if host.relay == nil {
+		return nil, fmt.Errorf("relay is disabled")
+	}
+	keyHex, ok := req.Data.(string)
+	if !ok {
+		return nil, fmt.Errorf("peer key not found in request body")
+	}
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, err
+	}
+
+	circuit, err := host.relay.openCircuit(key, remotePeer.ObservedAddress())
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case peerConn := <-circuit.accepted:
+		response := &HijackedResponse{
+			Data: circuit.id,
+			Handler: func(conn net.Conn) {
+				defer host.relay.closeCircuit(circuit)
+				host.relay.splice(conn, peerConn)
+			},
+		}
+		return response, nil
+	case <-time.After(RelayAcceptTimeout):
+		host.relay.closeCircuit(circuit)
+		return nil, fmt.Errorf("relayed peer did not accept the circuit")
+	}
+}
+
+// Handles relay_accept requests from a reserved peer accepting a circuit.
+// The connection is handed to the circuit once the response is written.
+func RelayAcceptHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	if host.relay == nil {
+		return nil, fmt.Errorf("relay is disabled")
+	}
+	id, ok := req.Data.(string)
+	if !ok {
+		return nil, fmt.Errorf("circuit id not found in request body")
+	}
+	circuit, err := host.relay.takeCircuit(id, remotePeer.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	response := &HijackedResponse{
+		Data: RelayCircuitInfo{ID: id, ObservedAddress: circuit.observed},
+		Handler: func(conn net.Conn) {
+			defer host.relay.closeCircuit(circuit)
+			select {
+			case circuit.accepted <- conn:
+			case <-circuit.done:
+				return
+			}
+
+			// Keep the connection open until the circuit is done
+			select {
+			case <-circuit.done:
+			case <-time.After(host.relay.limits.MaxCircuitDuration + RelayAcceptTimeout):
+			}
+		},
+	}
+	return response, nil
+}
+
+// A reservation the host holds on a relay
+type heldReservation struct {
+	conn       net.Conn
+	observedIP string
+}
+
+// The reservations the host holds on relays, by the relays' node addresses
+type relayReservations struct {
+	mutex sync.Mutex
+	conns map[string]*heldReservation
+}
+
+// Returns the node addresses of the relays the host holds reservations on
+func (reservations *relayReservations) relays() []string {
+	reservations.mutex.Lock()
+	defer reservations.mutex.Unlock()
+
+	relays := make([]string, 0)
+	for relay := range reservations.conns {
+		relays = append(relays, relay)
+	}
+	sort.Strings(relays)
+	return relays
+}
+
+// Returns the ip addresses the relays see the host on
+func (reservations *relayReservations) observedIPs() []string {
+	reservations.mutex.Lock()
+	defer reservations.mutex.Unlock()
+
+	ips := make([]string, 0)
+	for _, reservation := range reservations.conns {
+		if reservation.observedIP != "" {
+			ips = append(ips, reservation.observedIP)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func (reservations *relayReservations) add(relay string, conn net.Conn, observedIP string) {
+	reservations.mutex.Lock()
+	defer reservations.mutex.Unlock()
+	if previous, exists := reservations.conns[relay]; exists {
+		previous.conn.Close()
+	}
+	reservations.conns[relay] = &heldReservation{conn, observedIP}
+}
+
+func (reservations *relayReservations) remove(relay string, conn net.Conn) {
+	reservations.mutex.Lock()
+	defer reservations.mutex.Unlock()
+	if reservation, exists := reservations.conns[relay]; exists && reservation.conn == conn {
+		delete(reservations.conns, relay)
+	}
+}
+
+// Give up all reservations
+func (reservations *relayReservations) close() {
+	reservations.mutex.Lock()
+	defer reservations.mutex.Unlock()
+	for relay, reservation := range reservations.conns {
+		reservation.conn.Close()
+		delete(reservations.conns, relay)
+	}
+}
+
+func newRelayReservations() *relayReservations {
+	return &relayReservations{conns: make(map[string]*heldReservation)}
+}
+
+// Reserve a slot on the relay at the node address.
+// While the reservation lasts the host is reachable through the relay,
+// and the relayed address is advertised in the host's addresses.
+func (host *Host) ReserveRelay(relayAddress string) error {
+	if IsRelayAddress(relayAddress) {
+		return fmt.Errorf("relays must be reserved on direct addresses")
+	}
+	response, conn, err := host.sendRequest(relayAddress, 1, RelayReserveMethod, nil)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	var info RelayReservationInfo
+	if err := json.Unmarshal(data, &info); err != nil || info.TTL <= 0 {
+		conn.Close()
+		return fmt.Errorf("expected the reservation info as response")
+	}
+	ttl := time.Duration(info.TTL) * time.Millisecond
+	observedIP, _, err := net.SplitHostPort(info.ObservedAddress)
+	if err != nil || net.ParseIP(observedIP) == nil {
+		observedIP = ""
+	}
+
+	_, relayIP, _, _ := ParseNodeAddress(relayAddress)
+	host.relayReservations.add(relayAddress, conn, observedIP)
+	go func() {
+		defer conn.Close()
+		defer host.relayReservations.remove(relayAddress, conn)
+
+		// Accept the circuits the relay opens to the host until the reservation ends.
+		// Circuits count against the inbound connection limits under the relay's address.
+		for {
+			payload, err := ReadFromConnWithTimeouts(conn, ttl, TCPIODeadline)
+			if err != nil {
+				return
+			}
+			if !host.filter.AllowsIP(relayIP) || !host.connLimiter.acquire(relayAddress) {
+				continue
+			}
+			go func(id string) {
+				defer host.connLimiter.release(relayAddress)
+				host.acceptRelayCircuit(relayAddress, id)
+			}(string(payload))
+		}
+	}()
+	return nil
+}
+
+// Accept a circuit on the relay and serve the RPC request tunneled through it
+func (host *Host) acceptRelayCircuit(relayAddress, id string) {
+	response, conn, err := host.sendRequest(relayAddress, 1, RelayAcceptMethod, id)
+	if err != nil {
+		return
+	}
+	var info RelayCircuitInfo
+	if data, err := json.Marshal(response); err == nil {
+		json.Unmarshal(data, &info)
+	}
+	HandleRPCConnection(host, &relayedConn{conn, relayAddress, info.ObservedAddress})
+}
+
+// Open a circuit to the peer through the relay.
+// Within a private network the circuit is secured end to end with the peer.
+func (host *Host) dialRelayed(relayAddress string, key []byte) (net.Conn, error) {
+	_, conn, err := host.sendRequest(relayAddress, 1, RelayConnectMethod, hex.EncodeToString(key))
+	if err != nil {
+		return nil, err
+	}
+	if host.networkKey == nil {
+		return conn, nil
+	}
+
+	privateConn, err := PrivateNetworkClient(conn, host.networkKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return privateConn, nil
+}
+
+// Returns the host's relayed addresses on the relays it holds reservations on
+func (host *Host) relayedAddresses() ([]string, error) {
+	key := host.PeerKey()
+	addrs := make([]string, 0)
+	for _, relay := range host.relayReservations.relays() {
+		_, ip, _, err := ParseNodeAddress(relay)
+		if err != nil || !host.advertises(ip) {
+			continue
+		}
+		addr, err := FormatRelayAddress(relay, key[:])
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// A long running service that keeps reservations on the static relays
+func (host *Host) startRelayReservationService(relays []string) {
+	for !host.closed.Load() {
+		reserved := make(map[string]bool)
+		for _, relay := range host.relayReservations.relays() {
+			reserved[relay] = true
+		}
+		for _, relay := range relays {
+			if !reserved[relay] {
+				host.ReserveRelay(relay)
+			}
+		}
+		time.Sleep(RelayReservePeriod)
+	}
+}
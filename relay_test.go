@@ -0,0 +1,240 @@
+package coalition
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Reserve a slot for the host on the relay and return the host's relayed address
+func reserveTestRelay(t *testing.T, host, relay *Host) string {
+	if err := host.ReserveRelay(testHostAddress(t, relay)); err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := host.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if IsRelayAddress(addr) {
+			return addr
+		}
+	}
+	t.Fatal("expected a relayed address")
+	return ""
+}
+
+func TestRelay(t *testing.T) {
+	relay := newTestHost(t, EnableRelay(DefaultRelayLimits))
+	target := newTestHost(t)
+	client := newTestHost(t)
+
+	relayedAddr := reserveTestRelay(t, target, relay)
+	relayAddr, targetKey, err := ParseRelayAddress(relayedAddr)
+	if err != nil {
+		t.Fatal(err)
+	} else if relayAddr != testHostAddress(t, relay) {
+		t.Errorf("expected the relayed address to be on the relay")
+	} else if key := target.PeerKey(); !bytes.Equal(targetKey, key[:]) {
+		t.Errorf("expected the relayed address to be for the target")
+	}
+
+	// Requests are tunneled through the relay to the target
+	if err := client.Ping(relayedAddr); err != nil {
+		t.Fatal(err)
+	}
+	peer := client.RouteTable().Get(targetKey)
+	if peer == nil {
+		t.Fatal("expected the target in the route table")
+	} else if peer.Relay() != relayAddr {
+		t.Errorf("expected the target to be reached through the relay")
+	} else if addr, err := peer.Address(); err != nil || addr != relayedAddr {
+		t.Errorf("expected the target's relayed address, got %s", addr)
+	}
+	if client.Reachability(targetKey) != ReachabilityPrivate {
+		t.Errorf("relayed peers should not be public")
+	}
+
+	// Relayed peers are returned in find_node records
+	records, err := relay.FindNodeRecords(testHostAddress(t, client), targetKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, record := range records {
+		recordKey, _ := record.PeerKey()
+		found = found || bytes.Equal(recordKey, targetKey)
+	}
+	if !found {
+		t.Errorf("expected the target's record")
+	}
+
+	// Peers without a reservation can't be reached
+	unreserved := make([]byte, PeerKeySize)
+	if _, err := rand.Read(unreserved); err != nil {
+		t.Fatal(err)
+	}
+	unreservedAddr, err := FormatRelayAddress(relayAddr, unreserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(unreservedAddr); err == nil {
+		t.Errorf("expected peers without a reservation to be unreachable")
+	}
+
+	// Closing the target gives up the reservation
+	target.Close()
+	reservations := func() int {
+		relay.relay.mutex.Lock()
+		defer relay.relay.mutex.Unlock()
+		return len(relay.relay.reservations)
+	}
+	for i := 0; i < 100 && reservations() > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := client.Ping(relayedAddr); err == nil {
+		t.Errorf("expected the closed target to be unreachable")
+	}
+}
+
+func TestRelayLimits(t *testing.T) {
+	limits := DefaultRelayLimits
+	limits.MaxCircuitBytes = 64
+	relay := newTestHost(t, EnableRelay(limits))
+	target := newTestHost(t)
+	client := newTestHost(t)
+
+	// Circuits are cut off once the byte limit is reached
+	relayedAddr := reserveTestRelay(t, target, relay)
+	if err := client.Ping(relayedAddr); err == nil {
+		t.Errorf("expected the circuit to be cut off")
+	}
+
+	// Hosts that aren't relays refuse reservations
+	if err := client.ReserveRelay(testHostAddress(t, target)); err == nil {
+		t.Errorf("expected the reservation to be refused")
+	}
+
+	// Invalid addresses fail instead of panicking
+	if err := client.Ping("invalid address"); err == nil {
+		t.Errorf("expected an invalid address to fail")
+	}
+
+	// Concurrent reservers can't exceed the reservation limit
+	limits.MaxReservations = 4
+	service, err := newRelayService(limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var reserved int32
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := make([]byte, PeerKeySize)
+			rand.Read(key)
+			if _, err := service.reserve(key); err == nil {
+				atomic.AddInt32(&reserved, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 4 {
+		t.Errorf("expected 4 reservations, got %d", reserved)
+	}
+}
+
+// Create a host on the in-memory network with the ip address
+func newMemoryTestHost(t *testing.T, network *MemoryNetwork, ip string, options ...Option) *Host {
+	transport, err := network.Transport(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options = append(options, WithTransport(transport), ListenAddress(ip))
+	return newTestHost(t, options...)
+}
+
+func TestHolePunching(t *testing.T) {
+	network := NewMemoryNetwork()
+	if err := network.AddNAT("203.0.113.1", "10.0.0.2", "10.0.0.3"); err != nil {
+		t.Fatal(err)
+	} else if err := network.AddNAT("203.0.113.2", "10.0.1.2"); err != nil {
+		t.Fatal(err)
+	}
+	relay := newMemoryTestHost(t, network, "198.51.100.1", EnableRelay(DefaultRelayLimits))
+	target := newMemoryTestHost(t, network, "10.0.0.2", EnableHolePunching(), ExcludeAddresses(PrivateAddress), PeerRateLimit(HolePunchMethod, 10, 10))
+	client := newMemoryTestHost(t, network, "10.0.1.2", EnableHolePunching(), ExcludeAddresses(PrivateAddress))
+
+	// Both hosts are behind NATs and only reachable through the relay
+	relayedAddr := reserveTestRelay(t, target, relay)
+	reserveTestRelay(t, client, relay)
+	targetKey := target.PeerKey()
+	targetPort, err := target.Port()
+	if err != nil {
+		t.Fatal(err)
+	}
+	directAddr, err := FormatNodeAddress(targetKey[:], "203.0.113.1", targetPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(directAddr); err == nil {
+		t.Fatal("expected the target to be unreachable before hole punching")
+	}
+
+	// Reaching the target through the relay punches a direct connection in the background
+	if err := client.Ping(relayedAddr); err != nil {
+		t.Fatal(err)
+	}
+	upgraded := func() bool {
+		peer := client.RouteTable().Get(targetKey[:])
+		return peer != nil && peer.Relay() == ""
+	}
+	for i := 0; i < 250 && !upgraded(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !upgraded() {
+		t.Fatal("expected the target to be upgraded to a direct connection")
+	}
+	if addr, err := client.RouteTable().Get(targetKey[:]).Address(); err != nil || addr != directAddr {
+		t.Errorf("expected the target's direct address, got %s", addr)
+	}
+	if client.Reachability(targetKey[:]) != ReachabilityPublic {
+		t.Errorf("expected the target to be directly reachable")
+	}
+	if err := client.Ping(directAddr); err != nil {
+		t.Error(err)
+	}
+
+	// Peers can't make the host dial arbitrary addresses
+	clientKey := client.PeerKey()
+	arbitrary, err := FormatNodeAddress(clientKey[:], "192.0.2.55", 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SendMessage(directAddr, 1, HolePunchMethod, []string{arbitrary}); err == nil {
+		t.Errorf("expected hole punching requests off relays to be refused")
+	}
+	if _, err := client.SendMessage(relayedAddr, 1, HolePunchMethod, []string{arbitrary}); err == nil || !strings.Contains(err.Error(), "verified") {
+		t.Errorf("expected unverified addresses to be refused, got %v", err)
+	}
+
+	// Peers are punched at most once per retry period
+	if _, err := client.HolePunch(relayedAddr); err == nil {
+		t.Errorf("expected repeated hole punching to be refused")
+	}
+
+	// Hosts without hole punching enabled stay relayed
+	other := newMemoryTestHost(t, network, "10.0.0.3", ExcludeAddresses(PrivateAddress))
+	otherAddr := reserveTestRelay(t, other, relay)
+	if _, err := client.HolePunch(otherAddr); err == nil {
+		t.Errorf("expected hole punching to be refused")
+	}
+	if _, err := client.HolePunch(directAddr); err == nil {
+		t.Errorf("expected direct addresses to be refused")
+	}
+}
@@ -0,0 +1,118 @@
+package coalition
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A request nonce remembered by the replay cache
+type replayEntry struct {
+	id        string
+	timestamp int64
+}
+
+// A bounded cache of recently seen request nonces.
+// When full the oldest nonces are evicted and the timestamp floor is raised,
+// requests at or below the floor are rejected so evicted nonces can't be replayed.
+// Requests from the future are rejected so the floor never passes the host's clock.
+type replayCache struct {
+	mutex    sync.Mutex
+	window   time.Duration
+	capacity int
+	seen     map[string]bool
+	entries  []replayEntry
+	floor    int64
+}
+
+// Forget nonces whose timestamps have fallen out of the window
+func (cache *replayCache) expire(now int64) {
+	cutoff := now - cache.window.Milliseconds()
+	expired := 0
+	for expired < len(cache.entries) && cache.entries[expired].timestamp < cutoff {
+		delete(cache.seen, cache.entries[expired].id)
+		expired++
+	}
+	cache.entries = cache.entries[expired:]
+}
+
+// Evict the oldest nonces until there's space for a new one
+func (cache *replayCache) evict(now int64) {
+	for len(cache.entries) >= cache.capacity {
+		oldest := cache.entries[0]
+		delete(cache.seen, oldest.id)
+		floor := oldest.timestamp
+		if floor > now {
+			floor = now
+		}
+		if floor > cache.floor {
+			cache.floor = floor
+		}
+		cache.entries = cache.entries[1:]
+	}
+}
+
+// Verify a signed request is addressed to this host, fresh and not a duplicate.
+// The request nonce is remembered if the request is accepted.
+func (cache *replayCache) check(peerKey []byte, request RPCRequest, hostKey []byte) error {
+	recipient, err := hex.DecodeString(request.Recipient)
+	if err != nil || !bytes.Equal(recipient, hostKey) {
+		return fmt.Errorf("request is addressed to another peer")
+	}
+	nonce, err := hex.DecodeString(request.Nonce)
+	if err != nil || len(nonce) != RequestNonceSize {
+		return fmt.Errorf("invalid request nonce")
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	now := time.Now().UnixMilli()
+	if request.Timestamp > now {
+		return fmt.Errorf("request is from the future")
+	} else if now-request.Timestamp > cache.window.Milliseconds() || request.Timestamp <= cache.floor {
+		return fmt.Errorf("stale request")
+	}
+
+	id := hex.EncodeToString(peerKey) + request.Nonce
+	if cache.seen[id] {
+		return fmt.Errorf("duplicate request")
+	}
+
+	cache.expire(now)
+	cache.evict(now)
+	cache.seen[id] = true
+	cache.entries = insertReplayEntry(cache.entries, replayEntry{id, request.Timestamp})
+	return nil
+}
+
+// Insert an entry keeping the entries ordered by timestamp
+func insertReplayEntry(entries []replayEntry, entry replayEntry) []replayEntry {
+	index := len(entries)
+	for index > 0 && entries[index-1].timestamp > entry.timestamp {
+		index--
+	}
+	entries = append(entries, replayEntry{})
+	copy(entries[index+1:], entries[index:])
+	entries[index] = entry
+	return entries
+}
+
+// Create a new replay cache
+func newReplayCache(window time.Duration, capacity int64) (*replayCache, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("replay window must be > 0")
+	} else if capacity < 1 {
+		return nil, fmt.Errorf("replay cache size must be >= 1")
+	}
+
+	cache := &replayCache{
+		window:   window,
+		capacity: int(capacity),
+		seen:     make(map[string]bool),
+		entries:  make([]replayEntry, 0),
+	}
+	return cache, nil
+}
@@ -0,0 +1,23 @@
+//go:build linux
+
+package coalition
+
+import "syscall"
+
+// SO_REUSEPORT isn't exported by the syscall package on linux
+const soReusePort = 0xf
+
+// Share the listening port with the host's hole punching connections
+func reusePort(network, address string, conn syscall.RawConn) error {
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if sockErr == nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
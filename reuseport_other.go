@@ -0,0 +1,10 @@
+//go:build !linux
+
+package coalition
+
+import "syscall"
+
+// Port sharing isn't supported, so hole punching over tcp fails and peers stay relayed
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return nil
+}
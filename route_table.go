@@ -5,6 +5,8 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/big"
+	"net"
+	"sync"
 	"time"
 )
 
@@ -14,6 +16,15 @@ type Peer struct {
 	ipAddress string
 	port      int
 	lastSeen  int64
+	scores    *Scoreboard
+	record    *PeerRecord
+
+	// The ip:port an inbound peer's connection was observed from
+	observedAddress string
+
+	// The node address of the relay the peer is reached through, the peer's ip address and
+	// port are the relay's
+	relay string
 }
 
 // Return the peer key
@@ -31,8 +42,16 @@ func (peer *Peer) Port() int {
 	return peer.port
 }
 
-// Return the peer address
+// Return the node address of the relay the peer is reached through, empty for direct peers
+func (peer *Peer) Relay() string {
+	return peer.relay
+}
+
+// Return the peer address, a relayed address for peers reached through a relay
 func (peer *Peer) Address() (string, error) {
+	if peer.relay != "" {
+		return FormatRelayAddress(peer.relay, peer.key)
+	}
 	return FormatNodeAddress(peer.key, peer.ipAddress, peer.port)
 }
 
@@ -41,38 +60,69 @@ func (peer *Peer) LastSeen() int64 {
 	return peer.lastSeen
 }
 
+// Return the peer's signed peer record if one is known
+func (peer *Peer) Record() *PeerRecord {
+	return peer.record
+}
+
+// Return the ip:port the peer's connection was observed from, only known for inbound peers
+func (peer *Peer) ObservedAddress() string {
+	return peer.observedAddress
+}
+
+// Return the peer's reputation score, zero if the peer isn't scored
+func (peer *Peer) Score() float64 {
+	if peer.scores == nil {
+		return 0
+	}
+	return peer.scores.Value(peer.key)
+}
+
 // Create a new peer from the peer details
 func NewPeer(key []byte, ipAddress string, port int) *Peer {
 	return &Peer{
-		key,
-		ipAddress,
-		port,
-		time.Now().Unix(),
+		key:       key,
+		ipAddress: ipAddress,
+		port:      port,
+		lastSeen:  time.Now().Unix(),
 	}
 }
 
-// Create a new peer from a peer address
+// Create a new peer from a direct or relayed peer address
 func NewPeerFromAddress(address string) (*Peer, error) {
-	key, ip4Address, port, err := ParseNodeAddress(address)
+	key, ip4Address, port, err := ParsePeerAddress(address)
 	if err != nil {
 		return nil, err
+	} else if net.ParseIP(ip4Address) == nil {
+		return nil, fmt.Errorf("peer addresses must have an ip address")
 	}
-	peer := &Peer{
-		key,
-		ip4Address,
-		port,
-		time.Now().Unix(),
+	peer := NewPeer(key, ip4Address, port)
+	if IsRelayAddress(address) {
+		peer.relay, _, _ = ParseRelayAddress(address)
 	}
 	return peer, nil
 }
 
-// The route table manages an optimized kbucket of network peers
+// Diversity limits on the number of peers from the same subnet
+type subnetLimits struct {
+	perBucket int64
+	perTable  int64
+}
+
+// The route table manages an optimized kbucket of network peers.
+// It's safe for concurrent use, peers in the table are never modified in place
+// so peers returned by the table can be read without holding it's lock.
 type RouteTable struct {
+	mutex         sync.RWMutex
 	locusKey      []byte
 	maxPeers      int64
 	latencyPeriod int64
 	peers         []*Peer
 	kbucket       map[string][][]byte
+	staticPuzzle  int
+	subnetLimits  subnetLimits
+	scores        *Scoreboard
+	minScore      float64
 }
 
 // Calculate the KBucket key for a peer as an hex value
@@ -96,9 +146,46 @@ func (table *RouteTable) calculateKBucketKey(key []byte) (string, error) {
 	return hex.EncodeToString([]byte{0}), nil
 }
 
+// Returns true if a peer at the ip address can join the kbucket without
+// exceeding the subnet diversity limits. The excluded peer key is not counted.
+func (table *RouteTable) allowsSubnet(ipAddress string, bucketKey string, exclude []byte) bool {
+	subnet := SubnetKey(ipAddress)
+	if subnet == "" {
+		return true
+	}
+
+	inTable, inBucket := int64(0), int64(0)
+	for _, peer := range table.peers {
+		if bytes.Equal(peer.key, exclude) || SubnetKey(peer.ipAddress) != subnet {
+			continue
+		}
+		inTable++
+		for _, key := range table.kbucket[bucketKey] {
+			if bytes.Equal(key, peer.key) {
+				inBucket++
+				break
+			}
+		}
+	}
+
+	limits := table.subnetLimits
+	if limits.perTable > 0 && inTable >= limits.perTable {
+		return false
+	} else if limits.perBucket > 0 && inBucket >= limits.perBucket {
+		return false
+	}
+	return true
+}
+
 // Sort the peers in the route table
 // From recently seen to least recently seen peer
 func (table *RouteTable) SortPeersByLastSeen() []*Peer {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.sortPeersByLastSeen()
+}
+
+func (table *RouteTable) sortPeersByLastSeen() []*Peer {
 	peers := MergeSortPeers(
 		table.peers,
 		make([]*Peer, 0),
@@ -112,11 +199,17 @@ func (table *RouteTable) SortPeersByLastSeen() []*Peer {
 // Sort the peers in the route table by proximity to a certain key
 // From closest to farthest
 func (table *RouteTable) SortPeersByProximity(key []byte) []*Peer {
-	return SortPeersByClosest(table.peers, key)
+	return SortPeersByClosest(table.Peers(), key)
 }
 
 // Remove a peer from the route table
 func (table *RouteTable) Remove(key []byte) error {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	return table.remove(key)
+}
+
+func (table *RouteTable) remove(key []byte) error {
 	// Get the peer index in the peer list
 	peerIndex := -1
 	for index, peer := range table.peers {
@@ -176,11 +269,19 @@ func (table *RouteTable) Insert(
 	ipAddress string,
 	port int,
 ) (bool, error) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
 	// Skip inserts for the same node
 	if bytes.Equal(key, table.locusKey) {
 		return false, nil
 	}
 
+	// Skip keys that don't solve the static crypto puzzle
+	if !VerifyStaticPuzzle(key, table.staticPuzzle) {
+		return false, nil
+	}
+
 	// If the peer is already in the table
 	peerIndex := -1
 	for index, peer := range table.peers {
@@ -191,15 +292,32 @@ func (table *RouteTable) Insert(
 	}
 	if peerIndex != -1 {
 		peer := table.peers[peerIndex]
-		peer.ipAddress = ipAddress
-		peer.port = port
-		peer.lastSeen = time.Now().Unix()
+
+		// Moving to another subnet must respect the diversity limits
+		if SubnetKey(ipAddress) != SubnetKey(peer.ipAddress) {
+			bucketKey, err := table.calculateKBucketKey(peer.key)
+			if err != nil {
+				return false, err
+			}
+			if !table.allowsSubnet(ipAddress, bucketKey, peer.key) {
+				return false, nil
+			}
+		}
+
+		updated := *peer
+		updated.ipAddress = ipAddress
+		updated.port = port
+		updated.lastSeen = time.Now().Unix()
+		table.peers[peerIndex] = &updated
 		return true, nil
 	}
 
 	// Create new peer and calculate it's bucket key
 	// Create the bucket entry if it does not exist yet
 	peer := NewPeer(key, ipAddress, port)
+	if table.scores != nil {
+		peer.scores = table.scores
+	}
 	bucketKey, err := table.calculateKBucketKey(peer.key)
 	if err != nil {
 		return false, err
@@ -208,6 +326,11 @@ func (table *RouteTable) Insert(
 		table.kbucket[bucketKey] = make([][]byte, 0)
 	}
 
+	// Skip peers from subnets that already have their share of the bucket or table
+	if !table.allowsSubnet(ipAddress, bucketKey, nil) {
+		return false, nil
+	}
+
 	// If the table is not full, append the new entry
 	if len(table.peers) < int(table.maxPeers) {
 		table.peers = append(table.peers, peer)
@@ -225,9 +348,16 @@ func (table *RouteTable) Insert(
 				continue
 			}
 
-			// Remove the last peer in the entry
+			// Remove the lowest scoring peer in the entry, the last one on ties
 			entryPeerKey := entries[len(entries)-1]
-			if err := table.Remove(entryPeerKey); err != nil {
+			lowestScore := table.get(entryPeerKey).Score()
+			for i := len(entries) - 2; i >= 0; i-- {
+				if score := table.get(entries[i]).Score(); score < lowestScore {
+					entryPeerKey = entries[i]
+					lowestScore = score
+				}
+			}
+			if err := table.remove(entryPeerKey); err != nil {
 				return false, err
 			}
 			pruned = true
@@ -243,10 +373,26 @@ func (table *RouteTable) Insert(
 	}
 
 	// If the least recently seen peer hasn't been seen in over ping period seconds replace it
-	peers := table.SortPeersByLastSeen()
+	peers := table.sortPeersByLastSeen()
 	leastSeenPeer := peers[len(peers)-1]
 	if time.Now().Unix()-leastSeenPeer.lastSeen > table.latencyPeriod {
-		if err := table.Remove(leastSeenPeer.key); err != nil {
+		if err := table.remove(leastSeenPeer.key); err != nil {
+			return false, err
+		}
+		table.peers = append(table.peers, peer)
+		table.kbucket[bucketKey] = append(table.kbucket[bucketKey], peer.key)
+		return true, nil
+	}
+
+	// If the lowest scoring peer has sunk below the score threshold replace it
+	lowestPeer := peers[0]
+	for _, candidate := range peers[1:] {
+		if candidate.Score() < lowestPeer.Score() {
+			lowestPeer = candidate
+		}
+	}
+	if lowestPeer.Score() < table.minScore && lowestPeer.Score() < peer.Score() {
+		if err := table.remove(lowestPeer.key); err != nil {
 			return false, err
 		}
 		table.peers = append(table.peers, peer)
@@ -257,19 +403,95 @@ func (table *RouteTable) Insert(
 	return false, nil
 }
 
-// Gets a peer by it's key if it exists
-func (table *RouteTable) Get(key []byte) *Peer {
-	for _, peer := range table.peers {
+// Only accept peer keys that solve the static crypto puzzle with the difficulty
+func (table *RouteTable) RequireStaticPuzzle(difficulty int) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.staticPuzzle = difficulty
+}
+
+// Limit the number of peers from the same ip4 /24 or ip6 /48 subnet
+// in each kbucket and across the table. Zero disables a limit.
+func (table *RouteTable) SetSubnetLimits(perBucket, perTable int64) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.subnetLimits = subnetLimits{perBucket, perTable}
+}
+
+// Track peer scores on the scoreboard.
+// Peers scoring below the threshold are evicted in favour of new peers when the table is full.
+func (table *RouteTable) SetScoreboard(scores *Scoreboard, threshold float64) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.scores = scores
+	table.minScore = threshold
+}
+
+// Attach a verified peer record to a peer in the table.
+// Older records never replace newer ones.
+// Returns true if the record was stored.
+func (table *RouteTable) SetRecord(key []byte, record *PeerRecord) bool {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	index := table.index(key)
+	if index == -1 {
+		return false
+	}
+	peer := table.peers[index]
+	if peer.record != nil && peer.record.Seq >= record.Seq {
+		return false
+	}
+	updated := *peer
+	updated.record = record
+	table.peers[index] = &updated
+	return true
+}
+
+// Sets the relay a peer is reached through, an empty relay marks the peer as direct
+func (table *RouteTable) SetRelay(key []byte, relay string) bool {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	index := table.index(key)
+	if index == -1 {
+		return false
+	}
+	updated := *table.peers[index]
+	updated.relay = relay
+	table.peers[index] = &updated
+	return true
+}
+
+// Returns the index of a peer in the peer list, -1 if it's not in the table
+func (table *RouteTable) index(key []byte) int {
+	for index, peer := range table.peers {
 		if bytes.Equal(peer.key, key) {
-			return peer
+			return index
 		}
 	}
+	return -1
+}
+
+// Gets a peer by it's key if it exists
+func (table *RouteTable) Get(key []byte) *Peer {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.get(key)
+}
+
+func (table *RouteTable) get(key []byte) *Peer {
+	if index := table.index(key); index != -1 {
+		return table.peers[index]
+	}
 	return nil
 }
 
 // Get a the list of stored peers
 func (table *RouteTable) Peers() []*Peer {
-	return table.peers
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return append([]*Peer{}, table.peers...)
 }
 
 // locusKey: the host node's peer key
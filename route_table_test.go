@@ -3,6 +3,7 @@ package coalition
 import (
 	"bytes"
 	"crypto/rand"
+	"fmt"
 	"testing"
 	"time"
 )
@@ -105,3 +106,47 @@ func TestRouteTableRemove(t *testing.T) {
 		t.Errorf("bucket entry not deleted")
 	}
 }
+
+func TestRouteTableSubnetLimits(t *testing.T) {
+	locusKey := make([]byte, PeerKeySize)
+	if _, err := rand.Read(locusKey); err != nil {
+		t.Error(err)
+	}
+	store, err := NewRouteTable(locusKey, 20, int64(time.Hour.Seconds()))
+	if err != nil {
+		t.Error(err)
+	}
+	store.SetSubnetLimits(2, 3)
+
+	// Flood the table from a single /24
+	for i := 0; i < 10; i++ {
+		key := make([]byte, PeerKeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Error(err)
+		}
+		if _, err := store.Insert(key, fmt.Sprintf("8.8.8.%d", i), 3000); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(store.Peers()) > 3 {
+		t.Errorf("table should have at most 3 peers from the subnet")
+	}
+	for bucketKey, keys := range store.kbucket {
+		if len(keys) > 2 {
+			t.Errorf("bucket [%s] should have at most 2 peers from the subnet", bucketKey)
+		}
+	}
+
+	// Other subnets and loopback addresses are unaffected
+	for _, ip := range []string{"9.9.9.9", "127.0.0.1", "127.0.0.1"} {
+		key := make([]byte, PeerKeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Error(err)
+		}
+		if _, err := store.Insert(key, ip, 3000); err != nil {
+			t.Error(err)
+		} else if store.Get(key) == nil {
+			t.Errorf("peer from [%s] should be inserted", ip)
+		}
+	}
+}
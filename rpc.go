@@ -3,20 +3,54 @@ package coalition
 import (
 	"crypto/sha256"
 	"encoding/json"
-	"fmt"
+	"log"
 	"net"
+	"runtime/debug"
 	"time"
 )
 
 type RPCRequest struct {
-	Version int         `json:"version"`
-	Method  string      `json:"method"`
-	Data    interface{} `json:"data"`
+	Version   int         `json:"version"`
+	Method    string      `json:"method"`
+	Data      interface{} `json:"data"`
+	Nonce     string      `json:"nonce"`
+	Timestamp int64       `json:"timestamp"`
+	Recipient string      `json:"recipient"`
+	Puzzle    string      `json:"puzzle,omitempty"`
+	Record    *PeerRecord `json:"record,omitempty"`
 }
 
 type RPCResponse struct {
 	Success bool        `json:"success"`
+	Code    int         `json:"code,omitempty"`
 	Data    interface{} `json:"data"`
+	Puzzle  string      `json:"puzzle,omitempty"`
+	Record  *PeerRecord `json:"record,omitempty"`
+}
+
+// Mark the response as failed with an error code and message
+func (response *RPCResponse) fail(code int, message string) {
+	response.Success = false
+	response.Code = code
+	response.Data = message
+}
+
+// An error response returned by a remote peer
+type RPCError struct {
+	Code    int
+	Message string
+}
+
+func (err *RPCError) Error() string {
+	return err.Message
+}
+
+// Returned by RPC handlers that take over the connection after responding.
+// The handler is called once a successful response has been written
+// and owns the connection and the request's handler slot until it returns.
+type HijackedResponse struct {
+	Data    interface{}
+	Handler func(net.Conn)
 }
 
 type RPCHandlerFunc func(
@@ -28,13 +62,43 @@ type RPCHandlerFunc func(
 type RPCHandlerFuncMap map[string]RPCHandlerFunc
 
 func HandleRPCConnection(host *Host, conn net.Conn) {
+	// Connections tunneled through a relay come from the relay's address
+	relayConn, relayed := conn.(*relayedConn)
+
+	// Drop connections from outside the private network without a response
+	if host.networkKey != nil {
+		privateConn, err := PrivateNetworkServer(conn, host.networkKey, host.headerReadTimeout)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		conn = privateConn
+	}
+
+	var hijacked func(net.Conn)
+	var releaseSlot func()
 	response := RPCResponse{
 		Success: false,
+		Puzzle:  host.puzzleSolutionHex(),
 	}
 
 	// Serialize the response to the connection after execution
 	defer func() {
 		defer conn.Close()
+		if releaseSlot != nil {
+			defer releaseSlot()
+		}
+
+		// Never let a failing request take down the host
+		if r := recover(); r != nil {
+			log.Printf("rpc connection panicked: %v\n%s", r, debug.Stack())
+			response.fail(RPCCodeInternalError, "Internal server error")
+		}
+
+		// Only authenticated, successful requests get the host's record, building it lists the interfaces
+		if response.Success {
+			response.Record, _ = host.PeerRecord()
+		}
 
 		// Serialize the peer response
 		serializedResponse, err := json.Marshal(&response)
@@ -54,17 +118,19 @@ func HandleRPCConnection(host *Host, conn net.Conn) {
 		payload = append(payload, responseSignature[:]...)
 		payload = append(payload, serializedResponse...)
 
-		// Return the response
-		WriteToConn(conn, payload)
+		// Return the response and hand the connection over to hijacking handlers
+		if err := WriteToConn(conn, payload); err == nil && response.Success && hijacked != nil {
+			hijacked(conn)
+		}
 	}()
 
 	// Read the payload from the connection
-	payload, err := ReadFromConn(conn)
+	payload, err := ReadFromConnWithTimeouts(conn, host.headerReadTimeout, TCPIODeadline)
 	if err != nil {
-		response.Data = err.Error()
+		response.fail(RPCCodeBadRequest, err.Error())
 		return
 	} else if len(payload) <= Int64Len+PeerSignatureSize {
-		response.Data = "Incomplete request body"
+		response.fail(RPCCodeBadRequest, "Incomplete request body")
 		return
 	}
 
@@ -77,58 +143,106 @@ func HandleRPCConnection(host *Host, conn net.Conn) {
 	requestHash := sha256.Sum256(peerRequest)
 	peerKey, err := RecoverPeerKeyFromPeerSignature(peerSignature, requestHash[:])
 	if err != nil {
-		response.Data = err.Error()
+		response.fail(RPCCodeBadRequest, err.Error())
 		return
 	}
 
 	// Parse the remote peer details
 	peer := &Peer{
-		peerKey[:],
-		conn.RemoteAddr().(*net.TCPAddr).IP.To4().String(),
-		int(peerPort),
-		int64(time.Now().Unix()),
+		key:       peerKey[:],
+		ipAddress: conn.RemoteAddr().(*net.TCPAddr).IP.To4().String(),
+		port:      int(peerPort),
+		lastSeen:  int64(time.Now().Unix()),
+		scores:    host.scores,
+
+		observedAddress: conn.RemoteAddr().String(),
+	}
+	if relayed {
+		peer.relay = relayConn.relay
+		peer.observedAddress = relayConn.observedAddress
+	}
+
+	// Reject filtered peers before doing any work for them
+	if !host.filter.AllowsPeer(peer.Key(), peer.IPAddress()) {
+		response.fail(RPCCodeForbidden, "Peer not allowed")
+		return
+	}
+
+	// Parse the RPC request from the payload
+	var request RPCRequest
+	if err := json.Unmarshal(peerRequest, &request); err != nil {
+		host.scores.RecordTracked(peer.Key(), ScoreEventMalformedRequest)
+		response.fail(RPCCodeBadRequest, err.Error())
+		return
+	}
+
+	// Reject peers whose keys don't solve the crypto puzzles
+	if err := host.verifyPeerPuzzles(peer.Key(), request.Puzzle); err != nil {
+		response.fail(RPCCodeForbidden, err.Error())
+		return
+	}
+
+	// Throttle peers calling the method too often, before their nonces take up the replay cache
+	if !host.rateLimiter.Allow(request.Method, peer.Key(), peer.IPAddress()) {
+		host.scores.RecordTracked(peer.Key(), ScoreEventRateLimited)
+		response.fail(RPCCodeRateLimited, "Rate limit exceeded")
+		return
 	}
 
-	// Attempt to connect to the peer to ensure the peer can accept RPC requests
-	tmpConn, err := net.Dial("tcp4", fmt.Sprintf("%s:%d", peer.IPAddress(), peer.Port()))
-	if err == nil {
-		tmpConn.Close()
+	// Reject replayed, stale or misdirected requests
+	hostKey := host.PeerKey()
+	if err := host.replayCache.check(peer.Key(), request, hostKey[:]); err != nil {
+		response.fail(RPCCodeReplayRejected, err.Error())
+		return
+	}
 
-		// Update the host's peer store
-		_, err := host.RouteTable().Insert(
+	// Only insert peers known to accept RPC requests on their advertised port.
+	// Unknown peers are dialed back in the background, relayed peers can't be dialed back.
+	reachability, fresh := host.dialBack.lookup(peer.Key(), peer.IPAddress(), peer.Port())
+	if !relayed && !fresh {
+		host.dialBack.enqueue(peer.Key(), peer.IPAddress(), peer.Port())
+	} else if !relayed && reachability == ReachabilityPublic {
+		_, err := host.insertPeer(
 			peer.Key(),
 			peer.IPAddress(),
 			peer.Port(),
+			"",
 		)
 		if err != nil {
-			response.Data = err.Error()
+			response.fail(RPCCodeInternalError, err.Error())
 			return
 		}
+		host.storePeerRecord(peer.Key(), request.Record)
 	}
 
-	// Parse the RPC request from the payload
-	var request RPCRequest
-	if err := json.Unmarshal(peerRequest, &request); err != nil {
-		response.Data = err.Error()
+	// Get the registered handler for the RPC request
+	handler, exists := host.rpcHandler(request.Method)
+	if !exists {
+		response.fail(RPCCodeUnknownMethod, "Unknown RPC method")
 		return
 	}
 
-	// Get the registered handler for the RPC request
-	handler, exists := host.rpcHandlers[request.Method]
-	if !exists {
-		response.Data = "Unknown RPC method"
+	// Wait for a free handler slot
+	if !host.handlerLimiter.acquire(request.Method) {
+		response.fail(RPCCodeBusy, "Server busy")
 		return
 	}
+	releaseSlot = func() { host.handlerLimiter.release(request.Method) }
 
 	// Handle the RPC request
-	response.Data, err = handler(
+	response.Data, err = callRPCHandler(
+		handler,
 		host,
 		peer,
 		request,
 	)
 	if err != nil {
-		response.Data = err.Error()
+		response.fail(RPCCodeHandlerError, err.Error())
 		return
 	}
+	if hijack, ok := response.Data.(*HijackedResponse); ok {
+		response.Data = hijack.Data
+		hijacked = hijack.Handler
+	}
 	response.Success = true
 }
@@ -10,8 +10,36 @@ func PingHandler(*Host, *Peer, RPCRequest) (interface{}, error) {
 	return PingResponse, nil
 }
 
+// A peer's response to an identify request
+type IdentifyInfo struct {
+	ObservedAddress string         `json:"observed_address"`
+	ListenAddresses []string       `json:"listen_addresses"`
+	Methods         map[string]int `json:"methods"`
+	AgentVersion    string         `json:"agent_version"`
+}
+
+// Handles identify requests which returns the caller's observed ip:port,
+// the host's addresses, it's RPC methods with their versions and it's user agent
+func IdentifyHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	addrs, err := host.Addresses()
+	if err != nil {
+		return nil, err
+	}
+	info := IdentifyInfo{
+		ObservedAddress: remotePeer.ObservedAddress(),
+		ListenAddresses: addrs,
+		Methods:         host.RPCMethods(),
+		AgentVersion:    host.agentVersion,
+	}
+	return info, nil
+}
+
 // Handles find_node requests which finds nodes near a key
 // The nodes are sorted from closest to farthest from the key
+// From version 2 the nodes are returned as signed peer records,
+// peers that haven't shared a valid record are left out.
+// Peers without an address outside the host's excluded address classes are left out,
+// as are relayed peers from version 1 responses.
 func FindNodeHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
 	keyHex, ok := req.Data.(string)
 	if !ok {
@@ -21,8 +49,32 @@ func FindNodeHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{},
 	if err != nil {
 		return nil, err
 	}
+	if req.Version >= FindNodeRecordsVersion {
+		records := make([]*PeerRecord, 0)
+		for _, peer := range host.table.SortPeersByProximity(key) {
+			if !host.filter.AllowsPeer(peer.Key(), peer.IPAddress()) {
+				continue
+			} else if peer.Record() == nil {
+				continue
+			} else if _, err := peer.Record().Verify(host.recordTTL); err != nil {
+				continue
+			} else if !host.advertisesRecord(peer.Record()) {
+				continue
+			}
+			records = append(records, peer.Record())
+		}
+		return records, nil
+	}
+
 	addrs := make([]string, 0)
 	for _, peer := range host.table.SortPeersByProximity(key) {
+		if !host.filter.AllowsPeer(peer.Key(), peer.IPAddress()) {
+			continue
+		} else if !host.advertises(peer.IPAddress()) {
+			continue
+		} else if peer.Relay() != "" {
+			continue
+		}
 		peerAddr, err := peer.Address()
 		if err != nil {
 			return nil, err
@@ -0,0 +1,118 @@
+package coalition
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// A concurrency limit for a single RPC method
+type methodLimit struct {
+	method   string
+	handlers int64
+}
+
+// Bounds the number of RPC handlers executing at once, globally and per method
+type handlerLimiter struct {
+	global       chan struct{}
+	methods      map[string]chan struct{}
+	queueTimeout time.Duration
+}
+
+// Wait for a slot on the semaphore until the deadline channel fires.
+// A nil deadline channel makes the attempt non blocking.
+func acquireSlot(semaphore chan struct{}, deadline <-chan time.Time) bool {
+	if deadline == nil {
+		select {
+		case semaphore <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case semaphore <- struct{}{}:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+// Reserve a handler slot for the method.
+// Returns false if no slot became available within the queue timeout.
+func (limiter *handlerLimiter) acquire(method string) bool {
+	var deadline <-chan time.Time
+	if limiter.queueTimeout > 0 {
+		timer := time.NewTimer(limiter.queueTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	// Reserve the method slot first so requests queued on a saturated
+	// method do not hold on to global slots
+	methodSlots, limited := limiter.methods[method]
+	if limited && !acquireSlot(methodSlots, deadline) {
+		return false
+	}
+	if !acquireSlot(limiter.global, deadline) {
+		if limited {
+			<-methodSlots
+		}
+		return false
+	}
+	return true
+}
+
+// Release a handler slot previously reserved for the method
+func (limiter *handlerLimiter) release(method string) {
+	<-limiter.global
+	if methodSlots, limited := limiter.methods[method]; limited {
+		<-methodSlots
+	}
+}
+
+// Create a new handler limiter
+func newHandlerLimiter(
+	global int64,
+	methods []methodLimit,
+	queueTimeout time.Duration,
+) (*handlerLimiter, error) {
+	if global < 1 {
+		return nil, fmt.Errorf("max concurrent handlers must be >= 1")
+	} else if queueTimeout < 0 {
+		return nil, fmt.Errorf("handler queue timeout must be >= 0")
+	}
+
+	methodSlots := make(map[string]chan struct{})
+	for _, limit := range methods {
+		if limit.handlers < 1 {
+			return nil, fmt.Errorf("concurrency limit for [%s] must be >= 1", limit.method)
+		}
+		methodSlots[limit.method] = make(chan struct{}, limit.handlers)
+	}
+
+	limiter := &handlerLimiter{
+		global:       make(chan struct{}, global),
+		methods:      methodSlots,
+		queueTimeout: queueTimeout,
+	}
+	return limiter, nil
+}
+
+// Execute an RPC handler, converting any panic into an error
+func callRPCHandler(
+	handler RPCHandlerFunc,
+	host *Host,
+	peer *Peer,
+	request RPCRequest,
+) (data interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("rpc handler for [%s] panicked: %v\n%s", request.Method, r, debug.Stack())
+			data = nil
+			err = fmt.Errorf("internal error while handling [%s]", request.Method)
+		}
+	}()
+	return handler(host, peer, request)
+}
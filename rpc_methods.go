@@ -2,7 +2,9 @@ package coalition
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net"
 	"sync"
 )
 
@@ -74,17 +76,114 @@ func (host *Host) FindNode(address string, key []byte) ([]string, error) {
 		return nil, err
 	}
 
+	// Malformed responses count against the peer
 	data, ok := response.([]interface{})
 	if !ok {
+		host.recordAddressEvent(address, ScoreEventMalformedResponse)
 		return nil, fmt.Errorf("expected an array of node addresses as response")
 	}
 	addrs := make([]string, 0)
 	for _, raw := range data {
 		addr, ok := raw.(string)
 		if !ok {
+			host.recordAddressEvent(address, ScoreEventMalformedResponse)
 			return nil, fmt.Errorf("expected a string")
 		}
+
+		// Peers return the ip addresses of their route table, never hostnames
+		_, ip, _, err := ParseNodeAddress(addr)
+		if err == nil && net.ParseIP(ip) == nil {
+			err = fmt.Errorf("expected an ip address in %s", addr)
+		}
+		if err != nil {
+			host.recordAddressEvent(address, ScoreEventMalformedResponse)
+			return nil, err
+		}
 		addrs = append(addrs, addr)
 	}
 	return addrs, nil
 }
+
+// Asks a peer for the signed records of the nodes closest to a key on the network.
+// Records that fail verification are dropped and count against the peer.
+func (host *Host) FindNodeRecords(address string, key []byte) ([]*PeerRecord, error) {
+	response, err := host.SendMessage(
+		address,
+		FindNodeRecordsVersion,
+		FindNodeMethod,
+		hex.EncodeToString(key),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Malformed responses count against the peer
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	var records []*PeerRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		host.recordAddressEvent(address, ScoreEventMalformedResponse)
+		return nil, fmt.Errorf("expected an array of peer records as response")
+	}
+
+	// Only keep records that prove their addresses belong to their keys
+	verified := make([]*PeerRecord, 0)
+	for _, record := range records {
+		if record == nil {
+			host.recordAddressEvent(address, ScoreEventMalformedResponse)
+			continue
+		} else if _, err := record.Verify(host.recordTTL); err != nil {
+			host.recordAddressEvent(address, ScoreEventInvalidSignature)
+			continue
+		}
+		verified = append(verified, record)
+	}
+	return verified, nil
+}
+
+// Asks a peer to identify itself.
+// The ip address the peer observed the host from counts towards the host's public addresses.
+func (host *Host) Identify(address string) (*IdentifyInfo, error) {
+	response, err := host.SendMessage(address, 1, IdentifyMethod, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Malformed responses count against the peer
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	var info IdentifyInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		host.recordAddressEvent(address, ScoreEventMalformedResponse)
+		return nil, fmt.Errorf("expected identify info as response")
+	}
+	observedIP, _, err := net.SplitHostPort(info.ObservedAddress)
+	if err != nil {
+		host.recordAddressEvent(address, ScoreEventMalformedResponse)
+		return nil, err
+	}
+
+	// Peers reached through a relay observe the relay instead of the host
+	if IsRelayAddress(address) {
+		return &info, nil
+	}
+	peerKey, peerIP, _, err := ParseNodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	host.observedAddrs.add(observedIP, peerKey, peerIP)
+	return &info, nil
+}
+
+// Record a score event for the peer at the address
+func (host *Host) recordAddressEvent(address string, event ScoreEvent) {
+	key, _, _, err := ParsePeerAddress(address)
+	if err != nil {
+		return
+	}
+	host.scores.Record(key, event)
+}
@@ -0,0 +1,267 @@
+package coalition
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandlerPanic(t *testing.T) {
+	hostA, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostA.Listen()
+	defer hostA.Close()
+	hostA.RegisterRPCMethod("explode", func(*Host, *Peer, RPCRequest) (interface{}, error) {
+		panic("boom")
+	})
+
+	hostB, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostB.Listen()
+	defer hostB.Close()
+
+	addrs, err := hostA.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The panic should be returned as an error response
+	if _, err := hostB.SendMessage(addrs[0], 1, "explode", nil); err == nil {
+		t.Errorf("expected an error from a panicking handler")
+	}
+
+	// The host should still be serving requests
+	if err := hostB.Ping(addrs[0]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMethodConcurrency(t *testing.T) {
+	hostA, err := NewHost(
+		MethodConcurrency("slow", 1),
+		HandlerQueueTimeout(0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostA.Listen()
+	defer hostA.Close()
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	hostA.RegisterRPCMethod("slow", func(*Host, *Peer, RPCRequest) (interface{}, error) {
+		started <- struct{}{}
+		<-finish
+		return "done", nil
+	})
+
+	hostB, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostB.Listen()
+	defer hostB.Close()
+
+	addrs, err := hostA.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Occupy the only slot for the method
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := hostB.SendMessage(addrs[0], 1, "slow", nil); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow handler never started")
+	}
+
+	// A second call should be rejected immediately
+	if _, err := hostB.SendMessage(addrs[0], 1, "slow", nil); err == nil {
+		t.Errorf("expected the second call to be rejected")
+	}
+
+	// Other methods are unaffected
+	if err := hostB.Ping(addrs[0]); err != nil {
+		t.Error(err)
+	}
+
+	close(finish)
+	wg.Wait()
+}
+
+func TestRateLimit(t *testing.T) {
+	hostA, err := NewHost(PeerRateLimit(PingMethod, 0.001, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostA.Listen()
+	defer hostA.Close()
+
+	hostB, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostB.Listen()
+	defer hostB.Close()
+
+	addrs, err := hostA.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The burst should be allowed
+	for i := 0; i < 2; i++ {
+		if err := hostB.Ping(addrs[0]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Calls over the limit get a distinct error code
+	err = hostB.Ping(addrs[0])
+	rpcErr, ok := err.(*RPCError)
+	if !ok {
+		t.Fatalf("expected an rpc error, got %v", err)
+	} else if rpcErr.Code != RPCCodeRateLimited {
+		t.Errorf("expected code %d, got %d", RPCCodeRateLimited, rpcErr.Code)
+	}
+
+	// The limiter state should show the exhausted bucket
+	found := false
+	for _, state := range hostA.RateLimiter().State() {
+		if state.Scope == PeerRateLimitScope && state.Method == PingMethod && state.Tokens < 1 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected an exhausted ping bucket in the limiter state")
+	}
+}
+
+// Write a raw request payload to a host and parse its response
+func sendRawRequest(t *testing.T, host *Host, payload []byte) RPCResponse {
+	port, err := host.Port()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := WriteToConn(conn, payload); err != nil {
+		t.Fatal(err)
+	}
+	responsePayload, err := ReadFromConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response RPCResponse
+	if err := json.Unmarshal(responsePayload[PeerSignatureSize:], &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestReplayProtection(t *testing.T) {
+	hostA, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostA.Listen()
+	defer hostA.Close()
+
+	hostB, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hostB.Listen()
+	defer hostB.Close()
+
+	// A captured request is only accepted once
+	hostAKey := hostA.PeerKey()
+	payload, err := hostB.prepareRequest(hostAKey[:], 1, PingMethod, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := sendRawRequest(t, hostA, payload); !response.Success {
+		t.Errorf("expected the first request to succeed: %v", response.Data)
+	}
+	if response := sendRawRequest(t, hostA, payload); response.Code != RPCCodeReplayRejected {
+		t.Errorf("expected the replayed request to be rejected")
+	}
+
+	// A request addressed to another peer is rejected
+	hostBKey := hostB.PeerKey()
+	payload, err = hostB.prepareRequest(hostBKey[:], 1, PingMethod, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := sendRawRequest(t, hostA, payload); response.Code != RPCCodeReplayRejected {
+		t.Errorf("expected the misdirected request to be rejected")
+	}
+}
+
+func TestReplayCacheEviction(t *testing.T) {
+	cache, err := newReplayCache(time.Minute, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostKey := make([]byte, PeerKeySize)
+	peerKey := make([]byte, PeerKeySize)
+	requests := make([]RPCRequest, 0)
+	for i := 0; i < 3; i++ {
+		nonce := make([]byte, RequestNonceSize)
+		nonce[0] = byte(i)
+		requests = append(requests, RPCRequest{
+			Nonce:     hex.EncodeToString(nonce),
+			Timestamp: time.Now().UnixMilli() - int64(3-i),
+			Recipient: hex.EncodeToString(hostKey),
+		})
+	}
+	for _, request := range requests {
+		if err := cache.check(peerKey, request, hostKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The evicted nonce must still be rejected
+	if err := cache.check(peerKey, requests[0], hostKey); err == nil {
+		t.Errorf("expected the evicted request to be rejected")
+	}
+
+	// Requests outside the window are stale
+	stale := requests[2]
+	stale.Nonce = hex.EncodeToString(make([]byte, RequestNonceSize))
+	stale.Timestamp = time.Now().Add(-2 * time.Minute).UnixMilli()
+	if err := cache.check(peerKey, stale, hostKey); err == nil {
+		t.Errorf("expected the stale request to be rejected")
+	}
+
+	// Requests from the future are rejected so they can't raise the floor past the clock
+	future := stale
+	future.Timestamp = time.Now().Add(time.Second).UnixMilli()
+	if err := cache.check(peerKey, future, hostKey); err == nil {
+		t.Errorf("expected the request from the future to be rejected")
+	}
+	if cache.floor > time.Now().UnixMilli() {
+		t.Errorf("expected the floor to stay behind the clock")
+	}
+}
@@ -0,0 +1,213 @@
+package coalition
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peer behaviour that adjusts the peer's score
+type ScoreEvent int
+
+const (
+	ScoreEventSuccess ScoreEvent = iota
+	ScoreEventTimeout
+	ScoreEventUnreachable
+	ScoreEventMalformedResponse
+	ScoreEventInvalidSignature
+	ScoreEventRateLimited
+	ScoreEventUnreachableReferral
+	ScoreEventRejectedMessage
+	ScoreEventMalformedRequest
+)
+
+// Score adjustments for each peer event
+var DefaultScoreWeights = map[ScoreEvent]float64{
+	ScoreEventSuccess:             1,
+	ScoreEventTimeout:             -5,
+	ScoreEventUnreachable:         -5,
+	ScoreEventMalformedResponse:   -10,
+	ScoreEventInvalidSignature:    -20,
+	ScoreEventRateLimited:         -2,
+	ScoreEventUnreachableReferral: -2,
+	ScoreEventRejectedMessage:     -10,
+	ScoreEventMalformedRequest:    -10,
+}
+
+// Classify a connection error as a timeout or an unreachable peer
+func connErrorScoreEvent(err error) ScoreEvent {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ScoreEventTimeout
+	}
+	return ScoreEventUnreachable
+}
+
+// A peer's reputation score which decays towards zero over time
+type PeerScore struct {
+	mutex    sync.Mutex
+	value    float64
+	updated  time.Time
+	halfLife time.Duration
+}
+
+// Decay the score for the time elapsed since the last update
+func (score *PeerScore) decay(now time.Time) {
+	elapsed := now.Sub(score.updated)
+	if elapsed > 0 && score.halfLife > 0 {
+		score.value *= math.Pow(0.5, float64(elapsed)/float64(score.halfLife))
+	}
+	score.updated = now
+}
+
+// Returns the current decayed score
+func (score *PeerScore) Value() float64 {
+	if score == nil {
+		return 0
+	}
+	score.mutex.Lock()
+	defer score.mutex.Unlock()
+	score.decay(time.Now())
+	return score.value
+}
+
+// Adjust the score, keeping it within the score bounds
+func (score *PeerScore) add(delta float64) {
+	score.mutex.Lock()
+	defer score.mutex.Unlock()
+	score.decay(time.Now())
+	score.value = math.Max(PeerScoreFloor, math.Min(PeerScoreCeiling, score.value+delta))
+}
+
+// Tracks the reputation scores of peers by their keys
+type Scoreboard struct {
+	mutex     sync.Mutex
+	halfLife  time.Duration
+	threshold float64
+	weights   map[ScoreEvent]float64
+	scores    map[string]*PeerScore
+}
+
+// Set the score below which peers are only dropped from a full board once no other scores are left
+func (board *Scoreboard) SetThreshold(threshold float64) {
+	board.mutex.Lock()
+	defer board.mutex.Unlock()
+	board.threshold = threshold
+}
+
+// Make room for a new score once too many scores are tracked.
+// Scores closest to neutral decay soonest and are dropped first, scores below the threshold are
+// only dropped once no others are left so minting keys can't wash out the history of misbehaving peers.
+func (board *Scoreboard) prune() {
+	if len(board.scores) < MaxTrackedScores {
+		return
+	}
+
+	type trackedScore struct {
+		key    string
+		value  float64
+		banned bool
+	}
+	candidates := make([]trackedScore, 0, len(board.scores))
+	for key, score := range board.scores {
+		value := score.Value()
+		candidates = append(candidates, trackedScore{key, value, value < board.threshold})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].banned != candidates[j].banned {
+			return !candidates[i].banned
+		}
+		return math.Abs(candidates[i].value) < math.Abs(candidates[j].value)
+	})
+
+	// Make room for a batch of new scores so the board isn't sorted for every new peer,
+	// but only drop scores below the threshold one at a time
+	target := MaxTrackedScores - MaxTrackedScores/10
+	for _, candidate := range candidates {
+		if candidate.banned && len(board.scores) < MaxTrackedScores {
+			break
+		} else if !candidate.banned && len(board.scores) <= target && math.Abs(candidate.value) >= 0.5 {
+			continue
+		}
+		delete(board.scores, candidate.key)
+	}
+}
+
+// Returns the tracked score of a peer, creating it if it's not tracked yet
+func (board *Scoreboard) score(hexKey string) *PeerScore {
+	score, exists := board.scores[hexKey]
+	if !exists {
+		board.prune()
+		score = &PeerScore{updated: time.Now(), halfLife: board.halfLife}
+		board.scores[hexKey] = score
+	}
+	return score
+}
+
+// Returns the score of a peer, creating it if it's not tracked yet
+func (board *Scoreboard) Score(key []byte) *PeerScore {
+	board.mutex.Lock()
+	defer board.mutex.Unlock()
+	return board.score(hex.EncodeToString(key))
+}
+
+// Returns the current score of a peer without tracking it
+func (board *Scoreboard) Value(key []byte) float64 {
+	board.mutex.Lock()
+	score := board.scores[hex.EncodeToString(key)]
+	board.mutex.Unlock()
+	return score.Value()
+}
+
+// Record a peer event, adjusting the peer's score
+func (board *Scoreboard) Record(key []byte, event ScoreEvent) {
+	board.mutex.Lock()
+	defer board.mutex.Unlock()
+	board.score(hex.EncodeToString(key)).add(board.weights[event])
+}
+
+// Record a peer event only if the peer is already tracked.
+// Used for events of peers that haven't proven anything yet, so minted keys can't fill the board.
+func (board *Scoreboard) RecordTracked(key []byte, event ScoreEvent) {
+	board.mutex.Lock()
+	defer board.mutex.Unlock()
+	if score, exists := board.scores[hex.EncodeToString(key)]; exists {
+		score.add(board.weights[event])
+	}
+}
+
+// Returns the current scores of all tracked peers by hex peer key for debugging
+func (board *Scoreboard) Snapshot() map[string]float64 {
+	board.mutex.Lock()
+	defer board.mutex.Unlock()
+
+	snapshot := make(map[string]float64)
+	for key, score := range board.scores {
+		snapshot[key] = score.Value()
+	}
+	return snapshot
+}
+
+// Create a new scoreboard with the default event weights
+func NewScoreboard(halfLife time.Duration) (*Scoreboard, error) {
+	if halfLife <= 0 {
+		return nil, fmt.Errorf("score half life must be > 0")
+	}
+
+	weights := make(map[ScoreEvent]float64)
+	for event, weight := range DefaultScoreWeights {
+		weights[event] = weight
+	}
+	board := &Scoreboard{
+		halfLife:  halfLife,
+		threshold: DefaultScoreThreshold,
+		weights:   weights,
+		scores:    make(map[string]*PeerScore),
+	}
+	return board, nil
+}
@@ -0,0 +1,157 @@
+package coalition
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestScoreDecay(t *testing.T) {
+	board, err := NewScoreboard(100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := make([]byte, PeerKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	board.Record(key, ScoreEventMalformedResponse)
+	if score := board.Value(key); math.Abs(score-DefaultScoreWeights[ScoreEventMalformedResponse]) > 1 {
+		t.Errorf("unexpected score %f", score)
+	}
+
+	// The score should decay towards zero
+	time.Sleep(200 * time.Millisecond)
+	if score := board.Value(key); score < DefaultScoreWeights[ScoreEventMalformedResponse]/2 || score >= 0 {
+		t.Errorf("expected the score to have decayed, got %f", score)
+	}
+	if _, exists := board.Snapshot()[hex.EncodeToString(key)]; !exists {
+		t.Errorf("expected the peer in the score snapshot")
+	}
+
+	// Scores are bounded
+	for i := 0; i < 100; i++ {
+		board.Record(key, ScoreEventInvalidSignature)
+	}
+	if score := board.Value(key); score < PeerScoreFloor {
+		t.Errorf("score should not sink below the floor, got %f", score)
+	}
+}
+
+func TestRouteTableScoreEviction(t *testing.T) {
+	locusKey := make([]byte, PeerKeySize)
+	if _, err := rand.Read(locusKey); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewRouteTable(locusKey, 5, int64(time.Hour.Seconds()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	board, err := NewScoreboard(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetScoreboard(board, DefaultScoreThreshold)
+
+	// Fill up the table
+	for len(store.Peers()) < 5 {
+		key := make([]byte, PeerKeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Insert(key, "127.0.0.1", 3000); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Sink a peer below the threshold
+	badPeer := store.Peers()[0]
+	board.Record(badPeer.Key(), ScoreEventInvalidSignature)
+	board.Record(badPeer.Key(), ScoreEventInvalidSignature)
+
+	// Keep inserting until the bad peer is evicted for a well behaved one
+	for i := 0; i < 100 && store.Get(badPeer.Key()) != nil; i++ {
+		key := make([]byte, PeerKeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Insert(key, "127.0.0.1", 3000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.Get(badPeer.Key()) != nil {
+		t.Errorf("expected the low scoring peer to be evicted")
+	}
+	if len(store.Peers()) != 5 {
+		t.Errorf("table should still be full")
+	}
+}
+
+func TestScoreboardPrune(t *testing.T) {
+	board, err := NewScoreboard(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey := func() []byte {
+		key := make([]byte, PeerKeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	// A banned peer and a well behaved peer
+	bannedKey, goodKey := newKey(), newKey()
+	for i := 0; i < 3; i++ {
+		board.Record(bannedKey, ScoreEventInvalidSignature)
+	}
+	for i := 0; i < 10; i++ {
+		board.Record(goodKey, ScoreEventSuccess)
+	}
+
+	// Minted keys with small penalties fill up the board
+	for i := 0; i < 2*MaxTrackedScores; i++ {
+		board.Record(newKey(), ScoreEventRateLimited)
+	}
+	if len(board.Snapshot()) > MaxTrackedScores {
+		t.Errorf("expected at most %d tracked scores, got %d", MaxTrackedScores, len(board.Snapshot()))
+	}
+	if board.Value(bannedKey) >= DefaultScoreThreshold {
+		t.Errorf("the banned peer's score should be kept")
+	} else if board.Value(goodKey) < 5 {
+		t.Errorf("the good peer's score should be kept")
+	}
+
+	// Once the board is full of banned peers the score decaying soonest makes room for new peers
+	board, err = NewScoreboard(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mildKey := newKey()
+	board.Record(mildKey, ScoreEventInvalidSignature)
+	board.Record(mildKey, ScoreEventRateLimited)
+	for i := 1; i < MaxTrackedScores; i++ {
+		key := newKey()
+		board.Record(key, ScoreEventInvalidSignature)
+		board.Record(key, ScoreEventInvalidSignature)
+	}
+	newPeer := newKey()
+	board.Record(newPeer, ScoreEventTimeout)
+	if len(board.Snapshot()) != MaxTrackedScores {
+		t.Errorf("expected the board to stay full")
+	} else if board.Value(newPeer) >= 0 {
+		t.Errorf("expected the new peer's penalty to be tracked")
+	} else if board.Value(mildKey) != 0 {
+		t.Errorf("expected the score decaying soonest to be dropped")
+	}
+
+	// Events of untracked peers that haven't proven anything aren't tracked
+	untracked := newKey()
+	board.RecordTracked(untracked, ScoreEventMalformedRequest)
+	if _, exists := board.Snapshot()[hex.EncodeToString(untracked)]; exists {
+		t.Errorf("expected the untracked peer to stay untracked")
+	}
+}
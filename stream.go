@@ -0,0 +1,327 @@
+package coalition
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream frame types
+const (
+	streamFrameData byte = iota
+	streamFrameWindowUpdate
+	streamFrameClose
+	streamFrameReset
+)
+
+// Size of a stream frame header, the frame type followed by the payload length
+const streamFrameHeaderSize = 5
+
+// Returned by streams reset by either end
+var ErrStreamReset = errors.New("stream reset")
+
+// Handles streams opened by peers for a protocol, the stream is closed once the handler returns
+type StreamHandlerFunc func(*Stream)
+
+// A flow controlled byte stream with a peer, carried over the connection of an open_stream request.
+// Data is sent in chunks of at most StreamChunkSize bytes and a sender never has more than
+// StreamWindowSize unread bytes in flight, readers grant more as they consume it.
+type Stream struct {
+	conn       net.Conn
+	peerKey    []byte
+	protocol   string
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	writeMutex sync.Mutex
+	buffer     []byte
+	consumed   int
+	sendWindow int
+	readEOF    bool
+	writeEOF   bool
+	closed     bool
+	err        error
+}
+
+// Returns the key of the peer at the other end of the stream
+func (stream *Stream) PeerKey() []byte {
+	return stream.peerKey
+}
+
+// Returns the stream's protocol
+func (stream *Stream) Protocol() string {
+	return stream.protocol
+}
+
+// Write a frame to the connection
+func (stream *Stream) writeFrame(frameType byte, payload []byte) error {
+	stream.writeMutex.Lock()
+	defer stream.writeMutex.Unlock()
+
+	frame := make([]byte, streamFrameHeaderSize, streamFrameHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	frame = append(frame, payload...)
+	stream.conn.SetWriteDeadline(time.Now().Add(TCPIODeadline))
+	_, err := stream.conn.Write(frame)
+	return err
+}
+
+// Fail the stream, waking up blocked readers and writers
+func (stream *Stream) fail(err error) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.err == nil {
+		stream.err = err
+	}
+	stream.cond.Broadcast()
+}
+
+// Read frames from the connection until the stream ends
+func (stream *Stream) readFrames() {
+	defer stream.conn.Close()
+	header := make([]byte, streamFrameHeaderSize)
+	for {
+		stream.conn.SetReadDeadline(time.Now().Add(StreamIdleTimeout))
+		if _, err := io.ReadFull(stream.conn, header); err != nil {
+			stream.fail(err)
+			return
+		}
+		length := binary.BigEndian.Uint32(header[1:])
+		if length > StreamChunkSize {
+			stream.Reset()
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(stream.conn, payload); err != nil {
+			stream.fail(err)
+			return
+		}
+
+		stream.mutex.Lock()
+		switch header[0] {
+		case streamFrameData:
+			// Peers sending beyond the window granted to them break the stream
+			if len(stream.buffer)+len(payload) > StreamWindowSize || stream.readEOF {
+				stream.mutex.Unlock()
+				stream.Reset()
+				return
+			}
+			if !stream.closed {
+				stream.buffer = append(stream.buffer, payload...)
+			}
+		case streamFrameWindowUpdate:
+			if len(payload) != 4 {
+				stream.mutex.Unlock()
+				stream.Reset()
+				return
+			}
+			stream.sendWindow += int(binary.BigEndian.Uint32(payload))
+		case streamFrameClose:
+			stream.readEOF = true
+		case streamFrameReset:
+			if stream.err == nil {
+				stream.err = ErrStreamReset
+			}
+		}
+		stream.cond.Broadcast()
+		done := stream.err != nil || (stream.readEOF && stream.writeEOF)
+		stream.mutex.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// Read data sent by the peer, returns io.EOF once the peer closed the stream and all data was read
+func (stream *Stream) Read(data []byte) (int, error) {
+	stream.mutex.Lock()
+	for len(stream.buffer) == 0 && !stream.readEOF && stream.err == nil && !stream.closed {
+		stream.cond.Wait()
+	}
+	if stream.closed {
+		stream.mutex.Unlock()
+		return 0, fmt.Errorf("stream is closed")
+	} else if len(stream.buffer) == 0 {
+		err := stream.err
+		stream.mutex.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+
+	n := copy(data, stream.buffer)
+	stream.buffer = stream.buffer[n:]
+	stream.consumed += n
+
+	// Grant the peer the consumed window back once half of it was read
+	grant := 0
+	if stream.consumed >= StreamWindowSize/2 && !stream.readEOF {
+		grant = stream.consumed
+		stream.consumed = 0
+	}
+	stream.mutex.Unlock()
+
+	if grant > 0 {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(grant))
+		if err := stream.writeFrame(streamFrameWindowUpdate, payload); err != nil {
+			stream.fail(err)
+		}
+	}
+	return n, nil
+}
+
+// Write data to the peer in chunks, blocking while the peer's window is used up
+func (stream *Stream) Write(data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		stream.mutex.Lock()
+		for stream.sendWindow == 0 && stream.err == nil && !stream.writeEOF {
+			stream.cond.Wait()
+		}
+		if stream.writeEOF {
+			stream.mutex.Unlock()
+			return written, fmt.Errorf("stream is closed for writing")
+		} else if stream.err != nil {
+			err := stream.err
+			stream.mutex.Unlock()
+			return written, err
+		}
+		n := len(data) - written
+		if n > StreamChunkSize {
+			n = StreamChunkSize
+		}
+		if n > stream.sendWindow {
+			n = stream.sendWindow
+		}
+		stream.sendWindow -= n
+		stream.mutex.Unlock()
+
+		if err := stream.writeFrame(streamFrameData, data[written:written+n]); err != nil {
+			stream.fail(err)
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close the stream for writing, the peer reads io.EOF once it read all data sent before.
+// The stream can still be read from.
+func (stream *Stream) CloseWrite() error {
+	stream.mutex.Lock()
+	if stream.writeEOF || stream.err != nil {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.writeEOF = true
+	stream.cond.Broadcast()
+	stream.mutex.Unlock()
+	return stream.writeFrame(streamFrameClose, nil)
+}
+
+// Close the stream for reading and writing.
+// The connection is released once the peer closes it's end too or after StreamCloseTimeout.
+func (stream *Stream) Close() error {
+	err := stream.CloseWrite()
+	stream.mutex.Lock()
+	stream.closed = true
+	stream.buffer = nil
+	done := stream.readEOF || stream.err != nil
+	stream.cond.Broadcast()
+	stream.mutex.Unlock()
+
+	if done {
+		stream.conn.Close()
+	} else {
+		time.AfterFunc(StreamCloseTimeout, func() { stream.conn.Close() })
+	}
+	return err
+}
+
+// Abort the stream at both ends, discarding data in flight
+func (stream *Stream) Reset() error {
+	stream.mutex.Lock()
+	if stream.err != nil {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.err = ErrStreamReset
+	stream.cond.Broadcast()
+	stream.mutex.Unlock()
+
+	err := stream.writeFrame(streamFrameReset, nil)
+	stream.conn.Close()
+	return err
+}
+
+// Start a stream over the connection of an open_stream request
+func newStream(conn net.Conn, peerKey []byte, protocol string) *Stream {
+	conn.SetDeadline(time.Time{})
+	stream := &Stream{
+		conn:       conn,
+		peerKey:    peerKey,
+		protocol:   protocol,
+		buffer:     make([]byte, 0),
+		sendWindow: StreamWindowSize,
+	}
+	stream.cond = sync.NewCond(&stream.mutex)
+	go stream.readFrames()
+	return stream
+}
+
+// Registers a handler for streams of the protocol or replaces an existing one
+func (host *Host) RegisterStreamHandler(protocol string, handler StreamHandlerFunc) {
+	host.streamMutex.Lock()
+	defer host.streamMutex.Unlock()
+	host.streamHandlers[protocol] = handler
+}
+
+// Removes the stream handler of the protocol
+func (host *Host) RemoveStreamHandler(protocol string) {
+	host.streamMutex.Lock()
+	defer host.streamMutex.Unlock()
+	delete(host.streamHandlers, protocol)
+}
+
+// Open a stream of the protocol with the node at the address
+func (host *Host) OpenStream(address, protocol string) (*Stream, error) {
+	key, _, _, err := ParsePeerAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	_, conn, err := host.sendRequest(address, 1, OpenStreamMethod, protocol)
+	if err != nil {
+		return nil, err
+	}
+	return newStream(conn, key, protocol), nil
+}
+
+// Handles open_stream requests which hand the connection to the stream handler of a protocol
+func OpenStreamHandler(host *Host, remotePeer *Peer, req RPCRequest) (interface{}, error) {
+	protocol, ok := req.Data.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a stream protocol")
+	}
+	host.streamMutex.Lock()
+	handler, exists := host.streamHandlers[protocol]
+	host.streamMutex.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("unknown stream protocol %s", protocol)
+	}
+
+	response := &HijackedResponse{
+		Data: true,
+		Handler: func(conn net.Conn) {
+			stream := newStream(conn, remotePeer.Key(), protocol)
+			defer stream.Close()
+			handler(stream)
+		},
+	}
+	return response, nil
+}
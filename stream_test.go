@@ -0,0 +1,125 @@
+package coalition
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStreams(t *testing.T) {
+	server := newTestHost(t, ListenAddress("127.0.0.1"))
+	client := newTestHost(t, ListenAddress("127.0.0.1"))
+	serverAddr := testHostAddress(t, server)
+	server.RegisterStreamHandler("echo", func(stream *Stream) {
+		io.Copy(stream, stream)
+	})
+
+	// Payloads beyond the rpc payload limit are streamed in chunks
+	payload := make([]byte, 3*TCPIOBufferSize+123)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.OpenStream(serverAddr, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey := server.PeerKey()
+	if !bytes.Equal(stream.PeerKey(), serverKey[:]) || stream.Protocol() != "echo" {
+		t.Errorf("unexpected stream peer or protocol")
+	}
+	go func() {
+		stream.Write(payload)
+		stream.CloseWrite()
+	}()
+	echoed, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(echoed, payload) {
+		t.Errorf("expected the payload to be echoed, got %d of %d bytes", len(echoed), len(payload))
+	}
+	stream.Close()
+
+	// Unknown protocols are refused
+	if _, err := client.OpenStream(serverAddr, "unknown"); err == nil {
+		t.Errorf("expected unknown protocols to be refused")
+	}
+
+	// Writers block once the reader's window is used up
+	release := make(chan bool)
+	server.RegisterStreamHandler("slow", func(stream *Stream) {
+		<-release
+		io.Copy(io.Discard, stream)
+	})
+	stream, err = client.OpenStream(serverAddr, "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan bool)
+	go func() {
+		stream.Write(make([]byte, 2*StreamWindowSize))
+		stream.CloseWrite()
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Errorf("expected the writer to block on the window")
+	case <-time.After(300 * time.Millisecond):
+	}
+	stream.mutex.Lock()
+	if stream.sendWindow != 0 {
+		t.Errorf("expected the window to be used up, got %d", stream.sendWindow)
+	}
+	stream.mutex.Unlock()
+	close(release)
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the writer to resume once the reader caught up")
+	}
+	stream.Close()
+
+	// Resets reach the other end
+	server.RegisterStreamHandler("reset", func(stream *Stream) {
+		stream.Reset()
+	})
+	stream, err = client.OpenStream(serverAddr, "reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("expected the stream to be reset, got %v", err)
+	}
+}
+
+func TestStreamConcurrency(t *testing.T) {
+	server := newTestHost(t, ListenAddress("127.0.0.1"), MethodConcurrency(OpenStreamMethod, 1), HandlerQueueTimeout(0))
+	client := newTestHost(t, ListenAddress("127.0.0.1"))
+	serverAddr := testHostAddress(t, server)
+	release := make(chan bool)
+	server.RegisterStreamHandler("hold", func(stream *Stream) {
+		<-release
+	})
+
+	// Open streams keep their handler slot
+	stream, err := client.OpenStream(serverAddr, "hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := client.OpenStream(serverAddr, "hold"); err == nil {
+		t.Errorf("expected the second stream to be refused while the first is open")
+	}
+
+	// The slot is freed once the stream handler returns
+	close(release)
+	for i := 0; i < 50; i++ {
+		if stream, err = client.OpenStream(serverAddr, "hold"); err == nil {
+			stream.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("expected a stream to open once the slot was freed: %v", err)
+}
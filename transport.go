@@ -0,0 +1,50 @@
+package coalition
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Carries the host's connections to other peers
+type Transport interface {
+	// Listen for connections on the ip address and port, port 0 picks a free port
+	Listen(ipAddress string, port int) (net.Listener, error)
+
+	// Dial the ip address and port
+	Dial(ipAddress string, port int, timeout time.Duration) (net.Conn, error)
+
+	// Dial the ip address and port from the local port the host listens on.
+	// NATs mapping the outbound connection to the listening port then let the peer
+	// connect back through it, which is what hole punching relies on.
+	DialFrom(localPort int, ipAddress string, port int, timeout time.Duration) (net.Conn, error)
+}
+
+// The default transport over tcp4
+type TCPTransport struct {
+	// Share the listening port with connections dialed from it, which hole punching needs.
+	// Without it listening on a port already in use fails.
+	ReusePort bool
+}
+
+func (transport TCPTransport) Listen(ipAddress string, port int) (net.Listener, error) {
+	config := net.ListenConfig{}
+	if transport.ReusePort {
+		config.Control = reusePort
+	}
+	return config.Listen(context.Background(), "tcp4", net.JoinHostPort(ipAddress, strconv.Itoa(port)))
+}
+
+func (TCPTransport) Dial(ipAddress string, port int, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp4", net.JoinHostPort(ipAddress, strconv.Itoa(port)), timeout)
+}
+
+func (TCPTransport) DialFrom(localPort int, ipAddress string, port int, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{
+		Timeout:   timeout,
+		LocalAddr: &net.TCPAddr{Port: localPort},
+		Control:   reusePort,
+	}
+	return dialer.Dial("tcp4", net.JoinHostPort(ipAddress, strconv.Itoa(port)))
+}
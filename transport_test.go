@@ -0,0 +1,113 @@
+package coalition
+
+import (
+	"net"
+	"testing"
+)
+
+// Listen on the transport and return the listener's port and the remote addresses of accepted connections
+func listenTestTransport(t *testing.T, transport Transport, ip string) (int, chan net.Addr) {
+	listener, err := transport.Listen(ip, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	remoteAddrs := make(chan net.Addr, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			remoteAddrs <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, remoteAddrs
+}
+
+func TestTCPTransportDialFrom(t *testing.T) {
+	transport := TCPTransport{ReusePort: true}
+	port, _ := listenTestTransport(t, transport, "127.0.0.1")
+	peerPort, _ := listenTestTransport(t, transport, "127.0.0.1")
+
+	// Dialing from the listening port shares it with the listener
+	conn, err := transport.DialFrom(port, "127.0.0.1", peerPort, DialTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.LocalAddr().(*net.TCPAddr).Port != port {
+		t.Errorf("expected the connection to be dialed from the listening port")
+	}
+}
+
+func TestTCPTransportPortInUse(t *testing.T) {
+	host := newTestHost(t, ListenAddress("127.0.0.1"))
+	port := host.listener.Addr().(*net.TCPAddr).Port
+
+	// Another host can't listen on a port already in use
+	if other, err := NewHost(ListenAddress("127.0.0.1"), Port(port)); err == nil {
+		other.Close()
+		t.Errorf("expected listening on a port in use to fail")
+	}
+	if listener, err := (TCPTransport{}).Listen("127.0.0.1", port); err == nil {
+		listener.Close()
+		t.Errorf("expected listening on a port in use to fail")
+	}
+}
+
+func TestMemoryNAT(t *testing.T) {
+	network := NewMemoryNetwork()
+	if err := network.AddNAT("203.0.113.1", "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	public, err := network.Transport("198.51.100.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := network.Transport("198.51.100.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := network.Transport("10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPort, remoteAddrs := listenTestTransport(t, public, "198.51.100.1")
+	privatePort, _ := listenTestTransport(t, private, "10.0.0.2")
+
+	// Hosts behind the NAT can't be reached from outside
+	if _, err := public.Dial("10.0.0.2", privatePort, DialTimeout); err == nil {
+		t.Errorf("expected the internal address to be unreachable")
+	}
+	if _, err := public.Dial("203.0.113.1", privatePort, DialTimeout); err == nil {
+		t.Errorf("expected the unmapped port to be unreachable")
+	}
+
+	// Outbound connections are seen from the external ip address
+	conn, err := private.Dial("198.51.100.1", publicPort, DialTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if ip := (<-remoteAddrs).(*net.TCPAddr).IP.String(); ip != "203.0.113.1" {
+		t.Errorf("expected the connection from the external ip address, got %s", ip)
+	}
+
+	// Dialing out from the listening port lets the dialed ip address in
+	conn, err = private.DialFrom(privatePort, "198.51.100.1", publicPort, DialTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-remoteAddrs
+	conn, err = public.Dial("203.0.113.1", privatePort, DialTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, err := other.Dial("203.0.113.1", privatePort, DialTimeout); err == nil {
+		t.Errorf("expected other ip addresses to be filtered")
+	}
+}
@@ -0,0 +1,277 @@
+package coalition
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UPnP service types able to map ports
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// A UPnP device description
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// Find a service of the type within the device or it's embedded devices
+func (device upnpDevice) findService(serviceType string) *upnpService {
+	for i := range device.Services {
+		if device.Services[i].ServiceType == serviceType {
+			return &device.Services[i]
+		}
+	}
+	for _, embedded := range device.Devices {
+		if service := embedded.findService(serviceType); service != nil {
+			return service
+		}
+	}
+	return nil
+}
+
+// Maps ports with a UPnP internet gateway device
+type UPnPMapper struct {
+	client      *http.Client
+	controlURL  string
+	serviceType string
+	localIP     string
+}
+
+func (mapper *UPnPMapper) Name() string {
+	return "upnp"
+}
+
+// Call a SOAP action on the gateway's connection service and return the response body
+func (mapper *UPnPMapper) soapCall(action string, args [][2]string) ([]byte, error) {
+	body := new(bytes.Buffer)
+	body.WriteString(`<?xml version="1.0"?>`)
+	body.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" `)
+	body.WriteString(`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(body, `<u:%s xmlns:u="%s">`, action, mapper.serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(body, "<%s>", arg[0])
+		xml.EscapeText(body, []byte(arg[1]))
+		fmt.Fprintf(body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(body, "</u:%s></s:Body></s:Envelope>", action)
+
+	request, err := http.NewRequest(http.MethodPost, mapper.controlURL, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, mapper.serviceType, action))
+
+	response, err := mapper.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, TCPIOBufferSize))
+	if err != nil {
+		return nil, err
+	} else if response.StatusCode != http.StatusOK {
+		code, _ := soapValue(responseBody, "errorCode")
+		return nil, fmt.Errorf("upnp %s failed with status %d and error code %s", action, response.StatusCode, code)
+	}
+	return responseBody, nil
+}
+
+// Returns the text of the first element with the local name in a SOAP response
+func soapValue(body []byte, name string) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", fmt.Errorf("%s not found in soap response", name)
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == name {
+			var value string
+			if err := decoder.DecodeElement(&value, &start); err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(value), nil
+		}
+	}
+}
+
+func (mapper *UPnPMapper) AddPortMapping(internalPort int, lifetime time.Duration) (*PortMapping, error) {
+	response, err := mapper.soapCall("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	externalIP, err := soapValue(response, "NewExternalIPAddress")
+	if err != nil {
+		return nil, err
+	} else if net.ParseIP(externalIP) == nil {
+		return nil, fmt.Errorf("invalid upnp external ip address %s", externalIP)
+	}
+
+	addMapping := func(lifetime time.Duration) error {
+		_, err := mapper.soapCall("AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(internalPort)},
+			{"NewProtocol", "TCP"},
+			{"NewInternalPort", strconv.Itoa(internalPort)},
+			{"NewInternalClient", mapper.localIP},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", PortMappingDescription},
+			{"NewLeaseDuration", strconv.Itoa(int(lifetime.Seconds()))},
+		})
+		return err
+	}
+
+	// Some gateways only support permanent mappings
+	if err := addMapping(lifetime); err != nil {
+		lifetime = 0
+		if err := addMapping(lifetime); err != nil {
+			return nil, err
+		}
+	}
+	return &PortMapping{externalIP, internalPort, internalPort, lifetime}, nil
+}
+
+func (mapper *UPnPMapper) DeletePortMapping(mapping *PortMapping) error {
+	_, err := mapper.soapCall("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(mapping.ExternalPort)},
+		{"NewProtocol", "TCP"},
+	})
+	return err
+}
+
+// Create a UPnP port mapper from the url of an internet gateway device's description
+func NewUPnPMapper(descriptionURL string) (*UPnPMapper, error) {
+	location, err := url.Parse(descriptionURL)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: PortMappingTimeout}
+	response, err := client.Get(descriptionURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upnp device description request failed with status %d", response.StatusCode)
+	}
+
+	var root upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(response.Body, TCPIOBufferSize)).Decode(&root); err != nil {
+		return nil, err
+	}
+
+	// Find a connection service that can map ports
+	var service *upnpService
+	for _, serviceType := range upnpServiceTypes {
+		if service = root.Device.findService(serviceType); service != nil {
+			break
+		}
+	}
+	if service == nil {
+		return nil, fmt.Errorf("upnp device has no wan connection service")
+	}
+
+	// Control urls are relative to the url base or the description url
+	base := location
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, err
+		}
+	}
+	controlURL, err := base.Parse(service.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the local ip address the gateway sees the host on
+	port := controlURL.Port()
+	if port == "" {
+		port = "80"
+	}
+	conn, err := net.Dial("udp4", net.JoinHostPort(controlURL.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP.String()
+	conn.Close()
+
+	mapper := &UPnPMapper{
+		client:      client,
+		controlURL:  controlURL.String(),
+		serviceType: service.ServiceType,
+		localIP:     localIP,
+	}
+	return mapper, nil
+}
+
+// Search the local network for a UPnP internet gateway device with SSDP
+func DiscoverUPnPMapper(timeout time.Duration) (*UPnPMapper, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ssdpAddr, err := net.ResolveUDPAddr("udp4", SSDPAddress)
+	if err != nil {
+		return nil, err
+	}
+	search := strings.Join([]string{
+		"M-SEARCH * HTTP/1.1",
+		"HOST: " + SSDPAddress,
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+		`MAN: "ssdp:discover"`,
+		"MX: 2",
+		"", "",
+	}, "\r\n")
+	if _, err := conn.WriteTo([]byte(search), ssdpAddr); err != nil {
+		return nil, err
+	}
+
+	// Try each gateway that answers until one can map ports
+	buffer := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("no upnp gateway found")
+		}
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		response.Body.Close()
+		location := response.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+		if mapper, err := NewUPnPMapper(location); err == nil {
+			return mapper, nil
+		}
+	}
+}